@@ -2,58 +2,177 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/bacv/kingip/lib/logging"
 	"github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/trace"
+	sdk_edge "github.com/bacv/kingip/sdk/edge"
 	"github.com/bacv/kingip/svc/edge"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 func main() {
-	log.SetOutput(os.Stdout)
-
 	var (
-		hostname  string
-		relayAddr string
-		region    string
+		hostname        string
+		relayAddrs      []string
+		relayDiscovery  string
+		maxRelays       int
+		relayRefresh    time.Duration
+		network         string
+		region          string
+		secret          string
+		maxBandwidth    int64
+		maxSessions     int
+		schedule        []sdk_edge.ScheduleWindow
+		shutdownTimeout time.Duration
+		configFile      string
+		quicConfig      = quic.DefaultQUICConfig()
+		tracerConfig    = trace.DefaultConfig("kingip-edge")
+		logConfig       = logging.DefaultConfig()
+		config          = edge.DefaultConfig()
 	)
 
 	pflag.StringVar(&hostname, "hostname", "edge", "Hostname of the edge")
-	pflag.StringVar(&relayAddr, "relayAddr", "127.0.0.1:5555", "UDP address for the relay")
+	pflag.StringArrayVar(&relayAddrs, "relayAddr", []string{"127.0.0.1:5555"}, "Address of a relay, repeat for more")
+	pflag.StringVar(&relayDiscovery, "relayDiscovery", "", "URL of a JSON list of relays to use next to relayAddr")
+	pflag.IntVar(&maxRelays, "maxRelays", 0, "Max relays connected at once, picked by round trip time, 0 connects to all")
+	pflag.DurationVar(&relayRefresh, "relayRefresh", time.Minute, "How often relays are discovered and their round trips measured")
 	pflag.StringVar(&region, "region", "red", "Region of the edge")
+	pflag.StringVar(&secret, "secret", "", "Secret to authenticate with as hostname, for relays that require it")
+	pflag.Int64Var(&maxBandwidth, "maxBandwidth", 0, "Max bytes per second across all sessions, 0 means unlimited")
+	pflag.IntVar(&maxSessions, "maxSessions", 0, "Max concurrent sessions, 0 means unlimited")
+	pflag.StringVar(&network, "network", "auto", "Network for the relay conn (auto, quic, tcp or websocket)")
+	pflag.IntVar(&config.Dialer.MaxPerHost, "maxDialsPerHost", config.Dialer.MaxPerHost, "Max concurrent dials to a single destination host")
+	pflag.IntVar(&config.Dialer.MaxTotal, "maxDials", config.Dialer.MaxTotal, "Max concurrent dials to all destinations")
+	pflag.DurationVar(&config.Dialer.WaitTimeout, "dialWaitTimeout", config.Dialer.WaitTimeout, "Max time to wait for a free dial slot")
+	pflag.DurationVar(&config.Dialer.DialTimeout, "dialTimeout", config.Dialer.DialTimeout, "Timeout for connecting to a destination")
+	pflag.DurationVar(&config.Dialer.FallbackDelay, "dialFallbackDelay", config.Dialer.FallbackDelay, "Delay before trying the other IP family")
+	pflag.StringArrayVar(&config.Resolver.Servers, "dnsServers", nil, "Upstream DNS servers (udp://, tcp:// or https:// URLs)")
+	pflag.DurationVar(&config.Resolver.Timeout, "dnsTimeout", config.Resolver.Timeout, "Timeout of a single DNS query")
+	pflag.IntVar(&config.Resolver.CacheSize, "dnsCacheSize", config.Resolver.CacheSize, "Max number of cached hostnames")
+	pflag.BoolVar(&config.Resolver.RemoteOnly, "dnsRemoteOnly", config.Resolver.RemoteOnly, "Never fall back to the system resolver")
+	pflag.StringArrayVar(&config.Health.Targets, "probeTargets", nil, "Addresses dialed to check the uplink, e.g. 1.1.1.1:443")
+	pflag.DurationVar(&config.Health.Interval, "probeInterval", config.Health.Interval, "Interval of the uplink checks")
+	pflag.Float64Var(&config.Health.MinSuccessRate, "minSuccessRate", config.Health.MinSuccessRate, "Withdraw from the regions while fewer sessions reach their destination")
+	pflag.DurationVar(&shutdownTimeout, "shutdownTimeout", 30*time.Second, "Max time to wait for active streams on shutdown")
+	pflag.DurationVar(&config.IdleTimeout, "idleTimeout", config.IdleTimeout, "Close sessions that transferred no data for this long, 0 disables it")
+	pflag.DurationVar(&config.MaxDuration, "maxSessionDuration", config.MaxDuration, "Cap on the session duration requested by gateways, 0 means no cap")
+	pflag.StringVar(&tracerConfig.Endpoint, "otlpEndpoint", "", "OTLP/HTTP traces URL to export session spans to")
+	pflag.StringVar(&logConfig.Level, "logLevel", logConfig.Level, "Log level (debug, info, warn or error)")
+	pflag.StringVar(&logConfig.Format, "logFormat", logConfig.Format, "Log format (text or json)")
+	pflag.StringVar(&configFile, "config", "", "Path to config file")
 	pflag.Parse()
 
-	dialerConfig := quic.DialerConfig{
-		Addr: relayAddr,
-		Regions: map[string]string{
-			region: hostname,
-		},
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logging.Fatal(slog.Default(), "Error reading config file", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("quic", &quicConfig); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling quic configuration", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("schedule", &schedule); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling schedule configuration", logging.Err(err))
+		}
+	}
+
+	logger, err := logging.New(logConfig, os.Stdout)
+	if err != nil {
+		logging.Fatal(slog.Default(), "Invalid log configuration", logging.Err(err))
+	}
+	logger = logger.With(logging.KeyService, "edge", logging.KeyNode, hostname)
+	slog.SetDefault(logger)
+
+	if err := quicConfig.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid quic configuration", logging.Err(err))
+	}
+	if err := quic.Network(network).Validate(); err != nil {
+		logging.Fatal(logger, "Invalid network", logging.Err(err))
+	}
+
+	config.Tracer = trace.NewTracer(tracerConfig)
+
+	if viper.IsSet("relays") {
+		relayAddrs = viper.GetStringSlice("relays")
 	}
 
+	regions := []string{region}
 	if viper.IsSet("regions") {
-		dialerConfig.Regions = viper.GetStringMapString("regions")
+		regions = nil
+		for region := range viper.GetStringMapString("regions") {
+			regions = append(regions, region)
+		}
 	}
 
-	spawn(dialerConfig)
-}
+	options := sdk_edge.Options{
+		Relays:          relayAddrs,
+		DiscoveryURL:    relayDiscovery,
+		MaxRelays:       maxRelays,
+		RefreshInterval: relayRefresh,
+		Regions:         regions,
+		Hostname:        hostname,
+		Network:         quic.Network(network),
+		MaxSessions:     maxSessions,
+		MaxBandwidth:    maxBandwidth,
+		Schedule:        schedule,
+		Logger:          logger,
+		DrainTimeout:    shutdownTimeout,
+		QUIC:            quicConfig,
+		Edge:            &config,
+	}
+	if secret != "" {
+		options.Credentials = &sdk_edge.Credentials{Name: hostname, Secret: secret}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	node, err := sdk_edge.Start(ctx, options)
+	if err != nil {
+		logging.Fatal(logger, "Failed to start edge", logging.Err(err))
+	}
+	watchRelays(ctx, logger, node, configFile != "")
+
+	// Stopping drains the relay connections once a signal arrives.
+	<-node.Done()
 
-func spawn(dialerConfig quic.DialerConfig) {
-	handler := edge.NewEdge()
-	dialer := quic.NewDialer(dialerConfig, handler.RelayHandle)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-	var wg sync.WaitGroup
+	if err := config.Tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Failed to flush spans", logging.Err(err))
+	}
+}
 
-	wg.Add(1)
+// Re-reads relays from the config file, if there is one, and rediscovers
+// relays on SIGHUP.
+func watchRelays(ctx context.Context, logger *slog.Logger, node *sdk_edge.Node, read bool) {
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
 	go func() {
-		defer wg.Done()
-		err := dialer.Dial(context.Background())
-		if err != nil {
-			log.Fatal(err)
+		defer signal.Stop(hupC)
+		for {
+			select {
+			case <-hupC:
+			case <-ctx.Done():
+				return
+			}
+
+			if read {
+				if err := viper.ReadInConfig(); err != nil {
+					logger.Warn("Error reading config file", logging.Err(err))
+				} else if viper.IsSet("relays") {
+					node.SetRelays(viper.GetStringSlice("relays"))
+				}
+			}
+			node.Refresh()
+			logger.Info("Reloaded relays")
 		}
 	}()
-
-	wg.Wait()
 }
@@ -2,48 +2,111 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bacv/kingip/lib/accesslog"
+	"github.com/bacv/kingip/lib/logging"
 	"github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/redis"
+	"github.com/bacv/kingip/lib/trace"
 	"github.com/bacv/kingip/svc"
+	"github.com/bacv/kingip/svc/cluster"
 	"github.com/bacv/kingip/svc/gateway"
 	"github.com/bacv/kingip/svc/store"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-func main() {
-	log.SetOutput(os.Stdout)
+// Lets clients from a network use the proxies as a user without
+// credentials.
+type ipAuthConfig struct {
+	Network string `mapstructure:"network"`
+	User    string `mapstructure:"user"`
+}
 
+func main() {
 	var (
 		listenRelayAddr string
 		listenProxyAddr string
 		region          string
+		remoteResolve   bool
+		shutdownTimeout time.Duration
+		watchConfig     bool
 		configFile      string
 		listenerConfig  quic.ListenerConfig
+		quicConfig      = quic.DefaultQUICConfig()
 		proxyConfigs    []gateway.ProxyConfig
+		accessLogConfig []accesslog.SinkConfig
+		ipAuthConfigs   []ipAuthConfig
 	)
 
 	pflag.StringVar(&listenRelayAddr, "listenRelayAddr", "127.0.0.1:4444", "Address for relay listener")
 	pflag.StringVar(&listenProxyAddr, "listenProxyAddr", "127.0.0.1:10700", "Address for user cons")
 	pflag.StringVar(&region, "region", "red", "Default gateway region")
+	pflag.BoolVar(&remoteResolve, "remoteResolve", false, "Resolve destinations only with edge upstream resolvers")
+	pflag.DurationVar(&shutdownTimeout, "shutdownTimeout", 30*time.Second, "Max time to wait for active sessions on shutdown")
 	pflag.StringVar(&configFile, "config", "", "Path to config file")
+	pflag.BoolVar(&watchConfig, "watchConfig", false, "Reload proxies when the config file changes")
+	pflag.Duration("idleTimeout", 5*time.Minute, "Close sessions that transferred no data for this long, 0 disables it")
+	pflag.String("network", "auto", "Network for relay conns (auto, quic or tcp)")
+	pflag.String("otlpEndpoint", "", "OTLP/HTTP traces URL to export session spans to")
+	pflag.String("logLevel", "info", "Log level (debug, info, warn or error)")
+	pflag.String("logFormat", logging.FormatText, "Log format (text or json)")
+	pflag.String("redisAddr", "", "Redis address to share session and bandwidth counts with other gateways")
+	pflag.String("redisPassword", "", "Redis password")
+	pflag.Int("redisDB", 0, "Redis database")
+	pflag.String("gatewayID", "", "Gateway id in the cluster and among those sharing Redis, random if empty")
+	pflag.String("clusterAddr", "", "Address for the cluster API, empty disables clustering")
+	pflag.String("advertiseClusterAddr", "", "Cluster API address other gateways and relays use, defaults to clusterAddr")
+	pflag.String("advertiseRelayAddr", "", "Relay listener address relays use, defaults to listenRelayAddr")
+	pflag.StringArray("clusterSeeds", nil, "Cluster API addresses of gateways to join")
+	pflag.String("clusterSecret", "", "Secret shared by the gateways and relays of the cluster, required with clusterAddr")
 	pflag.Parse()
 
 	viper.BindPFlag("listenRelayAddr", pflag.Lookup("listenRelayAddr"))
 	viper.BindPFlag("listenProxyAddr", pflag.Lookup("listenProxyAddr"))
 	viper.BindPFlag("region", pflag.Lookup("region"))
+	viper.BindPFlag("remoteResolve", pflag.Lookup("remoteResolve"))
+	viper.BindPFlag("shutdownTimeout", pflag.Lookup("shutdownTimeout"))
+	viper.BindPFlag("idleTimeout", pflag.Lookup("idleTimeout"))
+	viper.BindPFlag("network", pflag.Lookup("network"))
+	viper.BindPFlag("otlpEndpoint", pflag.Lookup("otlpEndpoint"))
+	viper.BindPFlag("logLevel", pflag.Lookup("logLevel"))
+	viper.BindPFlag("logFormat", pflag.Lookup("logFormat"))
+	viper.BindPFlag("redisAddr", pflag.Lookup("redisAddr"))
+	viper.BindPFlag("redisPassword", pflag.Lookup("redisPassword"))
+	viper.BindPFlag("redisDB", pflag.Lookup("redisDB"))
+	viper.BindPFlag("gatewayID", pflag.Lookup("gatewayID"))
+	viper.BindPFlag("clusterAddr", pflag.Lookup("clusterAddr"))
+	viper.BindPFlag("advertiseClusterAddr", pflag.Lookup("advertiseClusterAddr"))
+	viper.BindPFlag("advertiseRelayAddr", pflag.Lookup("advertiseRelayAddr"))
+	viper.BindPFlag("clusterSeeds", pflag.Lookup("clusterSeeds"))
+	viper.BindPFlag("clusterSecret", pflag.Lookup("clusterSecret"))
 	viper.SetConfigFile(configFile)
 
 	if configFile != "" {
 		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("Error reading config file: %s", err)
+			logging.Fatal(slog.Default(), "Error reading config file", logging.Err(err))
 		}
 		if err := viper.UnmarshalKey("proxies", &proxyConfigs); err != nil {
-			log.Fatalf("Error unmarshaling proxies configuration: %s", err)
+			logging.Fatal(slog.Default(), "Error unmarshaling proxies configuration", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("accessLog", &accessLogConfig); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling access log configuration", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("ipAuth", &ipAuthConfigs); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling ip auth configuration", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("quic", &quicConfig); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling quic configuration", logging.Err(err))
 		}
 	} else {
 		proxyConfig := gateway.ProxyConfig{
@@ -53,12 +116,33 @@ func main() {
 		proxyConfigs = append(proxyConfigs, proxyConfig)
 	}
 
+	logger, err := logging.New(logging.Config{
+		Level:  viper.GetString("logLevel"),
+		Format: viper.GetString("logFormat"),
+	}, os.Stdout)
+	if err != nil {
+		logging.Fatal(slog.Default(), "Invalid log configuration", logging.Err(err))
+	}
+	logger = logger.With(logging.KeyService, "gateway")
+	slog.SetDefault(logger)
+
 	listenRelayAddr = viper.GetString("listenRelayAddr")
+	if err := quicConfig.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid quic configuration", logging.Err(err))
+	}
+	network := quic.Network(viper.GetString("network"))
+	if err := network.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid network", logging.Err(err))
+	}
 	listenerConfig = quic.ListenerConfig{
-		Addr: listenRelayAddr,
+		Addr:    listenRelayAddr,
+		Network: network,
+		QUIC:    quicConfig,
 	}
 
-	testUser := svc.NewUser("user", 1, svc.DefaultUserConfig())
+	// The test user may not send mail through the proxy.
+	testUserPolicy := svc.UserPolicy{DeniedPorts: []svc.PortRange{{From: 25, To: 25}}}
+	testUser := svc.NewUser("user", 1, svc.DefaultUserConfig().WithPolicy(testUserPolicy))
 	testUserAuth := svc.UserAuth{Name: testUser.Name(), Password: "pass"}
 
 	unlimitedUser := svc.NewUser("unlimited", 2, svc.NewUserConfig(65000, 1_000_000_000, 24*time.Hour))
@@ -67,45 +151,217 @@ func main() {
 	mockStore := store.NewMockUserStore()
 	mockStore.Users[testUserAuth] = testUser
 	mockStore.Users[unlimitedUserAuth] = unlimitedUser
-	mockSessionStore := store.NewMockSessionStore()
 
-	handler := gateway.NewGateway(mockStore, mockStore, mockSessionStore)
+	usersByName := map[string]*svc.User{
+		testUser.Name():      testUser,
+		unlimitedUser.Name(): unlimitedUser,
+	}
+	for _, cfg := range ipAuthConfigs {
+		user, ok := usersByName[cfg.User]
+		if !ok {
+			logging.Fatal(logger, "Unknown user in ip auth configuration", logging.KeyUser, cfg.User)
+		}
+		if err := mockStore.AddUserNetwork(cfg.Network, user); err != nil {
+			logging.Fatal(logger, "Invalid ip auth network", "network", cfg.Network, logging.Err(err))
+		}
+	}
+	gatewayID := viper.GetString("gatewayID")
+	if gatewayID == "" {
+		gatewayID = cluster.DefaultConfig().Self.ID
+	}
+
+	var (
+		bandwidthStore svc.BandwidthStore = mockStore
+		sessionStore   svc.SessionStore   = store.NewMockSessionStore()
+	)
+	if redisAddr := viper.GetString("redisAddr"); redisAddr != "" {
+		client := redis.NewClient(redis.Config{
+			Addr:     redisAddr,
+			Password: viper.GetString("redisPassword"),
+			DB:       viper.GetInt("redisDB"),
+		})
+		defer client.Close()
+
+		redisConfig := store.DefaultRedisConfig()
+		redisConfig.GatewayID = gatewayID
+		redisStore := store.NewRedisStore(redisConfig, client, logger)
+		defer func() {
+			if err := redisStore.Close(); err != nil {
+				logger.Warn("Failed to release gateway lease", logging.Err(err))
+			}
+		}()
+		bandwidthStore, sessionStore = redisStore, redisStore
+		logger.Info("Sharing session and bandwidth counts through Redis", logging.KeyAddr, redisAddr, "gateway", redisConfig.GatewayID)
+	}
+
+	accessLog, err := accesslog.NewLoggerFromConfig(accessLogConfig)
+	if err != nil {
+		logging.Fatal(logger, "Error creating access log", logging.Err(err))
+	}
+	defer accessLog.Close()
+
+	tracerConfig := trace.DefaultConfig("kingip-gateway")
+	tracerConfig.Endpoint = viper.GetString("otlpEndpoint")
+	tracer := trace.NewTracer(tracerConfig)
+
+	gatewayConfig := gateway.Config{
+		AccessLog:     accessLog,
+		Tracer:        tracer,
+		IdleTimeout:   viper.GetDuration("idleTimeout"),
+		RemoteResolve: viper.GetBool("remoteResolve"),
+	}
+
+	handler := gateway.NewGateway(gatewayConfig, logger, mockStore, bandwidthStore, sessionStore)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	var wg sync.WaitGroup
-	spawnListener(&wg, listenerConfig, handler)
-	spawnProxies(&wg, proxyConfigs, handler)
+	listener := spawnListener(ctx, &wg, logger, listenerConfig, handler)
+	clusterServer, leave := spawnCluster(ctx, &wg, logger, gatewayID)
+
+	proxies := gateway.NewProxyManager(logger, handler.AuthHandle, handler.PolicyHandle, handler.SessionHandle, viper.GetDuration("shutdownTimeout"))
+	if err := proxies.Apply(proxyConfigs); err != nil {
+		logging.Fatal(logger, "Failed to start proxies", logging.Err(err))
+	}
+
+	if configFile != "" {
+		watchProxies(ctx, logger, proxies, watchConfig)
+	}
+
+	<-ctx.Done()
+	logger.Info("Shutting down, waiting for active sessions")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout"))
+	defer cancel()
+
+	// Relays stop dialing this gateway while its sessions finish.
+	if leave != nil {
+		if err := leave(shutdownCtx); err != nil {
+			logger.Warn("Failed to announce leaving the cluster", logging.Err(err))
+		}
+	}
+
+	if err := proxies.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Failed to shut down proxies", logging.Err(err))
+	}
+	if err := handler.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Closing active sessions", logging.Err(err))
+	}
+	listener.Close()
+	if clusterServer != nil {
+		clusterServer.Shutdown(shutdownCtx)
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Failed to flush spans", logging.Err(err))
+	}
+
 	wg.Wait()
 }
 
-func spawnProxies(wg *sync.WaitGroup, proxyConfigs []gateway.ProxyConfig, handler *gateway.Gateway) {
-	for _, cfg := range proxyConfigs {
-		wg.Add(1)
-		go func(cfg gateway.ProxyConfig) {
-			defer wg.Done()
-
-			proxy, err := gateway.NewProxyServer(
-				cfg,
-				handler.AuthHandle,
-				handler.SessionHandle,
-			)
-			if err != nil {
-				log.Fatalf("Failed to start proxy for region %s: %v", cfg.Region, err)
+// Reloads proxies from the config file on SIGHUP, and on file changes if
+// watch is set.
+func watchProxies(ctx context.Context, logger *slog.Logger, proxies *gateway.ProxyManager, watch bool) {
+	var mu sync.Mutex
+	reload := func(read bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if read {
+			if err := viper.ReadInConfig(); err != nil {
+				logger.Warn("Error reading config file", logging.Err(err))
+				return
 			}
+		}
 
-			err = proxy.ListenUser()
-			if err != nil {
-				log.Fatalf("Failed to listen on proxy for region %s: %v", cfg.Region, err)
+		var proxyConfigs []gateway.ProxyConfig
+		if err := viper.UnmarshalKey("proxies", &proxyConfigs); err != nil {
+			logger.Warn("Error unmarshaling proxies configuration", logging.Err(err))
+			return
+		}
+		if err := proxies.Apply(proxyConfigs); err != nil {
+			logger.Warn("Failed to reload proxies", logging.Err(err))
+			return
+		}
+		logger.Info("Reloaded proxies configuration")
+	}
+
+	if watch {
+		viper.OnConfigChange(func(fsnotify.Event) {
+			reload(false)
+		})
+		viper.WatchConfig()
+	}
+
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hupC)
+		for {
+			select {
+			case <-hupC:
+				reload(true)
+			case <-ctx.Done():
+				return
 			}
-		}(cfg)
+		}
+	}()
+}
+
+// Serves the cluster API and gossips membership with the other gateways
+// if clusterAddr is set. Returns the server and a func that announces
+// this gateway is leaving.
+func spawnCluster(ctx context.Context, wg *sync.WaitGroup, logger *slog.Logger, gatewayID string) (*http.Server, func(context.Context) error) {
+	addr := viper.GetString("clusterAddr")
+	if addr == "" {
+		return nil, nil
+	}
+
+	config := cluster.DefaultConfig()
+	config.Self = cluster.Member{
+		ID:        gatewayID,
+		RelayAddr: viper.GetString("advertiseRelayAddr"),
+		Addr:      viper.GetString("advertiseClusterAddr"),
 	}
+	if config.Self.RelayAddr == "" {
+		config.Self.RelayAddr = viper.GetString("listenRelayAddr")
+	}
+	if config.Self.Addr == "" {
+		config.Self.Addr = addr
+	}
+	config.Seeds = viper.GetStringSlice("clusterSeeds")
+	config.Secret = viper.GetString("clusterSecret")
+	members, err := cluster.New(config, logger)
+	if err != nil {
+		logging.Fatal(logger, "Invalid cluster configuration", logging.Err(err))
+	}
+
+	server := &http.Server{Addr: addr, Handler: members.Handler()}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		logger.Info("Serving cluster API", logging.KeyAddr, addr, "gateway", gatewayID)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal(logger, "Cluster API failed", logging.Err(err))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		members.Run(ctx)
+	}()
+
+	return server, members.Leave
 }
 
-func spawnListener(wg *sync.WaitGroup, listenerConfig quic.ListenerConfig, handler *gateway.Gateway) {
+func spawnListener(ctx context.Context, wg *sync.WaitGroup, logger *slog.Logger, listenerConfig quic.ListenerConfig, handler *gateway.Gateway) *quic.Listener {
 	listener := quic.NewListener(
-		context.Background(),
+		ctx,
 		listenerConfig,
+		logger,
 		handler.RegisterHandle,
 		handler.RegionsHandle,
+		handler.DrainHandle,
+		nil,
 		handler.CloseHandle,
 	)
 
@@ -114,7 +370,9 @@ func spawnListener(wg *sync.WaitGroup, listenerConfig quic.ListenerConfig, handl
 		defer wg.Done()
 		err := listener.Listen()
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Relay listener failed", logging.Err(err))
 		}
 	}()
+
+	return listener
 }
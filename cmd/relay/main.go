@@ -2,102 +2,274 @@ package main
 
 import (
 	"context"
-	"log"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/bacv/kingip/lib/logging"
 	"github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/trace"
+	"github.com/bacv/kingip/svc/cluster"
 	"github.com/bacv/kingip/svc/relay"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 func main() {
-	log.SetOutput(os.Stdout)
-
 	var (
 		hostname       string
 		listenAddr     string
 		gateways       []string
+		upstreamRelays []string
 		regions        []string
 		configFile     string
-		dialerConfigs  []quic.DialerConfig
 		listenerConfig quic.ListenerConfig
+		quicConfig     = quic.DefaultQUICConfig()
+		relayConfig    = relay.DefaultConfig()
 	)
 
 	pflag.StringVar(&hostname, "hostname", "relay", "Hostname of the relay")
 	pflag.StringVar(&listenAddr, "listenAddr", "127.0.0.1:5555", "Address for edge conns")
 	pflag.StringArray("gateways", gateways, "Addresses of gateways")
+	pflag.StringArray("gatewaySeeds", nil, "Cluster API addresses of gateways to discover the other gateways from")
+	pflag.String("gatewaySRV", "", "DNS name with SRV records of the gateways, e.g. _kingip._udp.example.com")
+	pflag.String("gatewaySecret", "", "Cluster secret of the gateways, sent to gatewaySeeds")
+	pflag.Duration("discoveryInterval", 10*time.Second, "How often discovered gateways are refreshed")
+	pflag.StringArray("upstreamRelays", upstreamRelays, "Addresses of relays to connect to as an edge")
 	pflag.StringArray("regions", regions, "Relay regions")
+	pflag.String("id", relayConfig.ID, "Relay id used in proxy paths")
+	pflag.Int("maxHops", relayConfig.MaxHops, "Max number of relays a proxy request may pass through")
+	pflag.Duration("shutdownTimeout", 30*time.Second, "Max time to wait for active streams on shutdown")
+	pflag.Duration("idleTimeout", relayConfig.IdleTimeout, "Close sessions that transferred no data for this long, 0 disables it")
+	pflag.Duration("maxSessionDuration", relayConfig.MaxDuration, "Cap on the session duration requested by gateways, 0 means no cap")
+	pflag.Float64("quarantineFailureRate", relayConfig.QuarantineFailureRate, "Quarantine edges failing this share of their recent sessions, 0 disables it")
+	pflag.Duration("quarantineTime", relayConfig.QuarantineTime, "How long quarantined edges get no sessions")
+	pflag.String("adminAddr", "", "Address for the admin API, empty disables it")
+	pflag.String("network", "auto", "Network for conns between tiers (auto, quic, tcp or websocket)")
+	pflag.String("otlpEndpoint", "", "OTLP/HTTP traces URL to export session spans to")
+	pflag.String("logLevel", "info", "Log level (debug, info, warn or error)")
+	pflag.String("logFormat", logging.FormatText, "Log format (text or json)")
 	pflag.StringVar(&configFile, "config", "", "Path to config file")
 	pflag.Parse()
 
 	viper.BindPFlag("hostname", pflag.Lookup("hostname"))
 	viper.BindPFlag("listenAddr", pflag.Lookup("listenAddr"))
 	viper.BindPFlag("gateways", pflag.Lookup("gateways"))
+	viper.BindPFlag("gatewaySeeds", pflag.Lookup("gatewaySeeds"))
+	viper.BindPFlag("gatewaySRV", pflag.Lookup("gatewaySRV"))
+	viper.BindPFlag("gatewaySecret", pflag.Lookup("gatewaySecret"))
+	viper.BindPFlag("discoveryInterval", pflag.Lookup("discoveryInterval"))
+	viper.BindPFlag("upstreamRelays", pflag.Lookup("upstreamRelays"))
 	viper.BindPFlag("regions", pflag.Lookup("regions"))
+	viper.BindPFlag("id", pflag.Lookup("id"))
+	viper.BindPFlag("maxHops", pflag.Lookup("maxHops"))
+	viper.BindPFlag("shutdownTimeout", pflag.Lookup("shutdownTimeout"))
+	viper.BindPFlag("idleTimeout", pflag.Lookup("idleTimeout"))
+	viper.BindPFlag("maxSessionDuration", pflag.Lookup("maxSessionDuration"))
+	viper.BindPFlag("quarantineFailureRate", pflag.Lookup("quarantineFailureRate"))
+	viper.BindPFlag("quarantineTime", pflag.Lookup("quarantineTime"))
+	viper.BindPFlag("adminAddr", pflag.Lookup("adminAddr"))
+	viper.BindPFlag("network", pflag.Lookup("network"))
+	viper.BindPFlag("otlpEndpoint", pflag.Lookup("otlpEndpoint"))
+	viper.BindPFlag("logLevel", pflag.Lookup("logLevel"))
+	viper.BindPFlag("logFormat", pflag.Lookup("logFormat"))
 	viper.SetConfigFile(configFile)
 
 	if configFile != "" {
 		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("Error reading config file: %s", err)
+			logging.Fatal(slog.Default(), "Error reading config file", logging.Err(err))
 		}
 		if err := viper.UnmarshalKey("regions", &regions); err != nil {
-			log.Fatalf("Error unmarshaling regions configuration: %s", err)
+			logging.Fatal(slog.Default(), "Error unmarshaling regions configuration", logging.Err(err))
 		}
 		if err := viper.UnmarshalKey("gateways", &gateways); err != nil {
-			log.Fatalf("Error unmarshaling gateways configuration: %s", err)
+			logging.Fatal(slog.Default(), "Error unmarshaling gateways configuration", logging.Err(err))
+		}
+		if err := viper.UnmarshalKey("quic", &quicConfig); err != nil {
+			logging.Fatal(slog.Default(), "Error unmarshaling quic configuration", logging.Err(err))
 		}
 		regions = viper.GetStringSlice("regions")
 	}
 
 	regions = viper.GetStringSlice("regions")
 	gateways = viper.GetStringSlice("gateways")
+	upstreamRelays = viper.GetStringSlice("upstreamRelays")
+	relayConfig.ID = viper.GetString("id")
+	relayConfig.MaxHops = viper.GetInt("maxHops")
+	relayConfig.IdleTimeout = viper.GetDuration("idleTimeout")
+	relayConfig.MaxDuration = viper.GetDuration("maxSessionDuration")
+	relayConfig.QuarantineFailureRate = viper.GetFloat64("quarantineFailureRate")
+	relayConfig.QuarantineTime = viper.GetDuration("quarantineTime")
+
+	logger, err := logging.New(logging.Config{
+		Level:  viper.GetString("logLevel"),
+		Format: viper.GetString("logFormat"),
+	}, os.Stdout)
+	if err != nil {
+		logging.Fatal(slog.Default(), "Invalid log configuration", logging.Err(err))
+	}
+	logger = logger.With(logging.KeyService, "relay", logging.KeyNode, relayConfig.ID)
+	slog.SetDefault(logger)
+
+	if err := relayConfig.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid relay configuration", logging.Err(err))
+	}
+	if err := quicConfig.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid quic configuration", logging.Err(err))
+	}
+	network := quic.Network(viper.GetString("network"))
+	if err := network.Validate(); err != nil {
+		logging.Fatal(logger, "Invalid network", logging.Err(err))
+	}
+
+	tracerConfig := trace.DefaultConfig("kingip-relay")
+	tracerConfig.Endpoint = viper.GetString("otlpEndpoint")
+	relayConfig.Tracer = trace.NewTracer(tracerConfig)
 
 	dialerRegions := make(map[string]string)
 	for _, region := range regions {
 		dialerRegions[region] = hostname
 	}
-	for _, addr := range gateways {
-		dialerConfig := quic.DialerConfig{
+
+	handler := relay.NewRelay(relayConfig, logger)
+
+	// Upstream relays see this relay as an edge serving its regions.
+	newDialer := func(addr string) *quic.Dialer {
+		return quic.NewDialer(quic.DialerConfig{
 			Addr:    addr,
 			Regions: dialerRegions,
-		}
-		dialerConfigs = append(dialerConfigs, dialerConfig)
+			Network: network,
+			QUIC:    quicConfig,
+		}, logger, handler.GatewayHandle)
 	}
 
 	listenerConfig = quic.ListenerConfig{
-		Addr: listenAddr,
+		Addr:    listenAddr,
+		Network: network,
+		QUIC:    quicConfig,
+	}
+	if credentials := viper.GetStringMapString("edgeCredentials"); len(credentials) > 0 {
+		listenerConfig.Authenticate = authenticate(credentials)
 	}
 
-	handler := relay.NewRelay()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	var wg sync.WaitGroup
-	spawnListener(&wg, listenerConfig, handler)
-	spawnDialers(&wg, dialerConfigs, handler)
+	listener := spawnListener(ctx, &wg, logger, listenerConfig, handler)
+
+	// Configured upstreams stay in their pool, discovered gateways come
+	// and go with discovery. Both are redialed when their conn is lost.
+	upstreams := relay.NewGatewayPool(handler, logger, viper.GetDuration("shutdownTimeout"), newDialer)
+	upstreams.Set(append(gateways, upstreamRelays...))
+	pool := relay.NewGatewayPool(handler, logger, viper.GetDuration("shutdownTimeout"), newDialer)
+	discoveryConfig := cluster.DiscoveryConfig{
+		Seeds:  viper.GetStringSlice("gatewaySeeds"),
+		SRV:    viper.GetString("gatewaySRV"),
+		Secret: viper.GetString("gatewaySecret"),
+	}
+	discoveryCtx, stopDiscovery := context.WithCancel(ctx)
+	defer stopDiscovery()
+	if len(discoveryConfig.Seeds) > 0 || discoveryConfig.SRV != "" {
+		discovery := cluster.NewDiscovery(discoveryConfig)
+		spawnDiscovery(discoveryCtx, &wg, logger, discovery, viper.GetDuration("discoveryInterval"), gateways, pool)
+	}
+	admin := spawnAdmin(&wg, logger, viper.GetString("adminAddr"), handler)
+
+	<-ctx.Done()
+	logger.Info("Shutting down, draining upstream connections")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout"))
+	defer cancel()
+
+	// Upstreams stop routing to this relay while its streams finish, edges
+	// are disconnected only after that.
+	listener.Stop()
+	stopDiscovery()
+	var dwg sync.WaitGroup
+	dwg.Add(2)
+	go func() {
+		defer dwg.Done()
+		if err := pool.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to shut down discovered gateway dialers", logging.Err(err))
+		}
+	}()
+	go func() {
+		defer dwg.Done()
+		if err := upstreams.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to shut down dialer", logging.Err(err))
+		}
+	}()
+	dwg.Wait()
+	listener.Close()
+	if admin != nil {
+		admin.Shutdown(shutdownCtx)
+	}
+	if err := relayConfig.Tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Failed to flush spans", logging.Err(err))
+	}
+
 	wg.Wait()
 }
 
-func spawnDialers(wg *sync.WaitGroup, dialerConfigs []quic.DialerConfig, handler *relay.Relay) {
-	for _, cfg := range dialerConfigs {
-		wg.Add(1)
-		go func(cfg quic.DialerConfig) {
-			defer wg.Done()
+// Refreshes the discovered gateways every interval until ctx is done. The
+// configured ones are left out, they have a pool of their own. On failure
+// the gateways found last are kept.
+func spawnDiscovery(ctx context.Context, wg *sync.WaitGroup, logger *slog.Logger, discovery *cluster.Discovery, interval time.Duration, configured []string, pool *relay.GatewayPool) {
+	skip := make(map[string]bool, len(configured))
+	for _, addr := range configured {
+		skip[addr] = true
+	}
 
-			dialer := quic.NewDialer(cfg, handler.GatewayHandle)
-			err := dialer.Dial(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			addrs, err := discovery.Lookup(ctx)
 			if err != nil {
-				log.Fatal(err)
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warn("Gateway discovery failed", logging.Err(err))
+			} else {
+				discovered := addrs[:0]
+				for _, addr := range addrs {
+					if !skip[addr] {
+						discovered = append(discovered, addr)
+					}
+				}
+				pool.Set(discovered)
 			}
-		}(cfg)
-	}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 }
-func spawnListener(wg *sync.WaitGroup, listenerConfig quic.ListenerConfig, handler *relay.Relay) {
+
+func spawnListener(ctx context.Context, wg *sync.WaitGroup, logger *slog.Logger, listenerConfig quic.ListenerConfig, handler *relay.Relay) *quic.Listener {
 	listener := quic.NewListener(
-		context.Background(),
+		ctx,
 		listenerConfig,
+		logger,
 		handler.RegisterHandle,
 		handler.RegionsHandle,
+		handler.DrainHandle,
+		handler.CapacityHandle,
 		handler.CloseHandle,
 	)
 
@@ -106,7 +278,39 @@ func spawnListener(wg *sync.WaitGroup, listenerConfig quic.ListenerConfig, handl
 		defer wg.Done()
 		err := listener.Listen()
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Edge listener failed", logging.Err(err))
 		}
 	}()
+
+	return listener
+}
+
+func spawnAdmin(wg *sync.WaitGroup, logger *slog.Logger, addr string, handler *relay.Relay) *http.Server {
+	if addr == "" {
+		return nil
+	}
+
+	server := &http.Server{Addr: addr, Handler: handler.AdminHandler()}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		logger.Info("Serving admin API", logging.KeyAddr, addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal(logger, "Admin API failed", logging.Err(err))
+		}
+	}()
+
+	return server
+}
+
+// Checks dialers against secrets by name. Viper lowercases map keys, so
+// names are matched case insensitively.
+func authenticate(credentials map[string]string) func(name, secret string) error {
+	return func(name, secret string) error {
+		expected, ok := credentials[strings.ToLower(name)]
+		if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) != 1 {
+			return errors.New("Invalid credentials")
+		}
+		return nil
+	}
 }
@@ -0,0 +1,98 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+)
+
+// Why a session was closed.
+const (
+	ReasonClientClosed      = "client_closed"
+	ReasonDestinationClosed = "destination_closed"
+	ReasonMaxDuration       = "max_duration"
+	ReasonIdleTimeout       = "idle_timeout"
+	ReasonRemoteTimeout     = "remote_timeout" // timeout of a relay or edge
+	ReasonLimitExceeded     = "limit_exceeded"
+	ReasonPolicyDenied      = "policy_denied"
+	ReasonSetupFailed       = "setup_failed"
+	ReasonTransferError     = "transfer_error"
+	ReasonShutdown          = "shutdown"
+)
+
+// Record describes a single proxied session, written once the session is
+// closed.
+type Record struct {
+	Time        time.Time `json:"time"`
+	SessionID   string    `json:"session_id"`
+	User        string    `json:"user"`
+	ClientIP    string    `json:"client_ip"`
+	Protocol    string    `json:"protocol"`
+	Region      string    `json:"region"`
+	RelayID     string    `json:"relay_id,omitempty"`
+	EdgeID      string    `json:"edge_id,omitempty"`
+	ExitIP      string    `json:"exit_ip,omitempty"`
+	Destination string    `json:"destination"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+	DurationMs  int64     `json:"duration_ms"`
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type Sink interface {
+	// Writes a single JSON encoded record, without the trailing newline.
+	Write([]byte) error
+	Close() error
+}
+
+// Logger encodes records as JSON lines and writes them to all sinks.
+type Logger struct {
+	sinks []Sink
+	mu    sync.Mutex
+}
+
+func NewLogger(sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// Log is safe to call on a nil logger, which discards the record.
+func (l *Logger) Log(record Record) {
+	if l == nil || len(l.sinks) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Failed to encode access log record", logging.Err(err))
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(line); err != nil {
+			slog.Warn("Failed to write access log record", logging.Err(err))
+		}
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var errs []error
+	for _, sink := range l.sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,68 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	sink, err := NewFileSink(path, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"first", "second", "third", "fourth"} {
+		assert.NoError(t, sink.Write([]byte(line)))
+	}
+	assert.NoError(t, sink.Close())
+
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	logger, err := NewLoggerFromConfig([]SinkConfig{{Type: "file", Path: path}})
+	assert.NoError(t, err)
+
+	logger.Log(Record{SessionID: "1", User: "user", BytesUp: 10, Reason: ReasonClientClosed})
+	logger.Log(Record{SessionID: "2", User: "user", BytesDown: 20, Reason: ReasonMaxDuration})
+	assert.NoError(t, logger.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+
+	var record Record
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "2", record.SessionID)
+	assert.Equal(t, int64(20), record.BytesDown)
+	assert.Equal(t, ReasonMaxDuration, record.Reason)
+}
+
+func TestNilLoggerDiscards(t *testing.T) {
+	var logger *Logger
+	logger.Log(Record{})
+	assert.NoError(t, logger.Close())
+}
+
+func TestUnknownSinkType(t *testing.T) {
+	_, err := NewLoggerFromConfig([]SinkConfig{{Type: "kafka"}})
+	assert.ErrorIs(t, err, ErrorSinkType)
+}
@@ -0,0 +1,178 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+var ErrorSinkType = errors.New("Unknown access log sink type")
+
+type SinkConfig struct {
+	// One of "stdout", "file" or "syslog".
+	Type string `mapstructure:"type"`
+
+	// File sink.
+	Path       string `mapstructure:"path"`
+	MaxSizeMB  int    `mapstructure:"maxSizeMB"`
+	MaxBackups int    `mapstructure:"maxBackups"`
+
+	// Syslog sink, an empty network connects to the local syslog daemon.
+	Network string `mapstructure:"network"`
+	Addr    string `mapstructure:"addr"`
+	Tag     string `mapstructure:"tag"`
+}
+
+func NewSink(config SinkConfig) (Sink, error) {
+	switch config.Type {
+	case "stdout":
+		return &writerSink{w: os.Stdout}, nil
+	case "file":
+		return NewFileSink(config.Path, int64(config.MaxSizeMB)*1024*1024, config.MaxBackups)
+	case "syslog":
+		return NewSyslogSink(config.Network, config.Addr, config.Tag)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrorSinkType, config.Type)
+	}
+}
+
+func NewLoggerFromConfig(configs []SinkConfig) (*Logger, error) {
+	var sinks []Sink
+	for _, config := range configs {
+		sink, err := NewSink(config)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return NewLogger(sinks...), nil
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Write(line []byte) error {
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// FileSink appends records to a file, rotating it to path.1, path.2, ...
+// once it would grow over maxSize bytes. Zero maxSize disables rotation.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line = append(line, '\n')
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		os.Remove(s.backup(s.maxBackups))
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(s.backup(i), s.backup(i+1))
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// SyslogSink sends records to a syslog daemon, either the local one or a
+// remote one over UDP/TCP.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(network, addr, tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "kingip"
+	}
+
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (s *SyslogSink) Write(line []byte) error {
+	return s.writer.Info(string(line))
+}
+
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
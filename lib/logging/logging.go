@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys shared by all services, so logs of different hops can be
+// filtered and joined on the same fields.
+const (
+	KeyService = "service"
+	// Id of the node writing the log.
+	KeyNode = "node"
+	// Local listen address.
+	KeyAddr = "addr"
+	// Address of the other side of an inter-tier connection.
+	KeyRemote = "remote"
+	// Id the listener assigned to an inter-tier connection.
+	KeyConn        = "conn"
+	KeyRelay       = "relay"
+	KeyEdge        = "edge"
+	KeyRegion      = "region"
+	KeyRegions     = "regions"
+	KeySession     = "session"
+	KeyUser        = "user"
+	KeyDestination = "destination"
+	KeyPath        = "path"
+	KeyError       = "err"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	ErrorLevel  = errors.New("Unknown log level")
+	ErrorFormat = errors.New("Unknown log format")
+)
+
+type Config struct {
+	// One of debug, info, warn or error.
+	Level string
+	// Either text or json.
+	Format string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Level:  "info",
+		Format: FormatText,
+	}
+}
+
+// Creates a logger writing to w with the configured level and format.
+func New(config Config, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, ErrorLevel
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(config.Format) {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, ErrorFormat
+	}
+}
+
+// Err returns the attribute errors are logged with.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+// Discard returns a logger that drops everything, for tests and embedding.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// Fatal logs msg at error level and exits, for use in main packages only.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// OrDefault returns logger, or the default logger if it is nil.
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
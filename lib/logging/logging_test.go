@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(Config{Level: "warn", Format: FormatJSON}, &buf)
+	assert.NoError(t, err)
+
+	logger.Info("dropped")
+	logger.Warn("Relay closed", KeyConn, "42", Err(errors.New("timeout")))
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, "Relay closed", line["msg"])
+	assert.Equal(t, "42", line[KeyConn])
+	assert.Equal(t, "timeout", line[KeyError])
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New(Config{Level: "loud"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrorLevel)
+
+	_, err = New(Config{Level: "info", Format: "xml"}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrorFormat)
+}
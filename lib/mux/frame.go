@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrorFrameType    = errors.New("Unknown frame type")
+	ErrorFrameSize    = errors.New("Frame payload is too large")
+	ErrorFlowControl  = errors.New("Peer exceeded the stream receive window")
+	ErrorStreamLimit  = errors.New("Max number of streams the peer accepts are open")
+	ErrorStreamClosed = errors.New("Stream is closed")
+	ErrorStreamID     = errors.New("Peer sent a frame for a stream it may not open")
+)
+
+type frameType uint8
+
+const (
+	// Announces the receive window of the sender, the first frame on a
+	// session. The payload holds the max number of streams it accepts.
+	frameSettings frameType = iota
+	// Carries stream data, opens the stream if the peer has not seen it.
+	frameData
+	// Closes the write direction of a stream.
+	frameFin
+	// Aborts the write direction of a stream with an error code.
+	frameReset
+	// Asks the peer to abort the write direction of a stream.
+	frameStopSending
+	// Lets the peer send value more bytes on a stream.
+	frameWindow
+	// Closes the session with an error code and a message.
+	frameClose
+)
+
+// Each frame starts with the type, the stream id, a value whose meaning
+// depends on the type and the length of the payload that follows.
+const (
+	headerSize = 1 + 4 + 8 + 4
+	maxPayload = 32 << 10
+)
+
+type frame struct {
+	typ     frameType
+	stream  uint32
+	value   uint64
+	payload []byte
+}
+
+func (f frame) header() [headerSize]byte {
+	var h [headerSize]byte
+	h[0] = byte(f.typ)
+	binary.BigEndian.PutUint32(h[1:5], f.stream)
+	binary.BigEndian.PutUint64(h[5:13], f.value)
+	binary.BigEndian.PutUint32(h[13:17], uint32(len(f.payload)))
+	return h
+}
+
+func (f frame) writeTo(w io.Writer) error {
+	h := f.header()
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if len(f.payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+// Reads a frame header and returns the frame with the length of its
+// payload, which is left unread.
+func readHeader(r io.Reader, h *[headerSize]byte) (frame, int, error) {
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, 0, err
+	}
+
+	f := frame{
+		typ:    frameType(h[0]),
+		stream: binary.BigEndian.Uint32(h[1:5]),
+		value:  binary.BigEndian.Uint64(h[5:13]),
+	}
+	if f.typ > frameClose {
+		return frame{}, 0, ErrorFrameType
+	}
+	length := binary.BigEndian.Uint32(h[13:17])
+	if length > maxPayload {
+		return frame{}, 0, ErrorFrameSize
+	}
+	return f, int(length), nil
+}
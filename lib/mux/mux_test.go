@@ -0,0 +1,208 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns both ends of a session with a small window, so flow control
+// kicks in quickly.
+func sessionPair(t *testing.T) (*Session, *Session) {
+	config := Config{StreamReceiveWindow: 4 << 10, MaxIncomingStreams: 10}
+	a, b := net.Pipe()
+	client, server := New(a, true, config), New(b, false, config)
+	t.Cleanup(func() {
+		client.CloseWithError(0, "")
+		server.CloseWithError(0, "")
+	})
+	return client, server
+}
+
+func acceptStream(t *testing.T, s *Session) quic.Stream {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	stream, err := s.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestStreamEcho(t *testing.T) {
+	client, server := sessionPair(t)
+	request := bytes.Repeat([]byte("kingip"), 10<<10)
+
+	go func() {
+		stream := acceptStream(t, server)
+		received, _ := io.ReadAll(stream)
+		stream.Write(received)
+		stream.Close()
+	}()
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	assert.Equal(t, quic.StreamID(1), stream.StreamID())
+
+	go func() {
+		stream.Write(request)
+		stream.Close()
+	}()
+
+	response, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, request, response)
+	assert.Error(t, stream.Context().Err())
+}
+
+func TestStreamCancel(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	stream.Write([]byte("hello"))
+	accepted := acceptStream(t, server)
+
+	// Stop sending resets the write direction of the peer.
+	accepted.CancelRead(7)
+	var streamErr *quic.StreamError
+	assert.Eventually(t, func() bool {
+		_, err := stream.Write([]byte("more"))
+		return errors.As(err, &streamErr)
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, quic.StreamErrorCode(7), streamErr.ErrorCode)
+	assert.True(t, streamErr.Remote)
+
+	// A reset fails reading on the peer.
+	stream, err = client.OpenStream()
+	assert.NoError(t, err)
+	stream.Write([]byte("hello"))
+	stream.CancelWrite(3)
+	_, err = io.ReadAll(acceptStream(t, server))
+	assert.ErrorAs(t, err, &streamErr)
+	assert.Equal(t, quic.StreamErrorCode(3), streamErr.ErrorCode)
+	assert.True(t, streamErr.Remote)
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, _ := sessionPair(t)
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestCloseWithError(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	stream.Write([]byte("hello"))
+	acceptStream(t, server)
+
+	server.CloseWithError(5, "bye")
+
+	var appErr *quic.ApplicationError
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorAs(t, err, &appErr)
+	assert.True(t, appErr.Remote)
+	assert.Equal(t, quic.ApplicationErrorCode(5), appErr.ErrorCode)
+	assert.Equal(t, "bye", appErr.ErrorMessage)
+
+	<-client.Context().Done()
+	_, err = client.AcceptStream(context.Background())
+	assert.ErrorAs(t, err, &appErr)
+	_, err = client.OpenStream()
+	assert.ErrorAs(t, err, &appErr)
+}
+
+// Waits until the client learned the stream limit of the server.
+func waitSettings(t *testing.T, client *Session) {
+	assert.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.peerMaxStreams == 10
+	}, time.Second, time.Millisecond)
+}
+
+func TestStreamLimit(t *testing.T) {
+	client, server := sessionPair(t)
+	waitSettings(t, client)
+
+	var streams []quic.Stream
+	for i := 0; i < 10; i++ {
+		stream, err := client.OpenStream()
+		assert.NoError(t, err)
+		stream.Write([]byte("x"))
+		streams = append(streams, stream)
+	}
+	_, err := client.OpenStream()
+	assert.ErrorIs(t, err, ErrorStreamLimit)
+
+	// A stream done in both directions makes room for another.
+	peer := acceptStream(t, server)
+	peer.Close()
+	streams[0].Close()
+	_, err = io.ReadAll(streams[0])
+	assert.NoError(t, err)
+	_, err = client.OpenStream()
+	assert.NoError(t, err)
+	assert.NoError(t, server.Context().Err())
+}
+
+func TestStreamLimitRefused(t *testing.T) {
+	client, server := sessionPair(t)
+	waitSettings(t, client)
+	// As if the client had not yet seen streams end on the server.
+	client.mu.Lock()
+	client.peerMaxStreams = 0
+	client.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		stream, err := client.OpenStream()
+		assert.NoError(t, err)
+		stream.Write([]byte("x"))
+	}
+	stream, err := client.OpenStream()
+	assert.NoError(t, err)
+	stream.Write([]byte("x"))
+
+	// Only the stream over the limit fails, the session stays up.
+	_, err = stream.Read(make([]byte, 1))
+	var streamErr *quic.StreamError
+	assert.ErrorAs(t, err, &streamErr)
+	assert.Equal(t, StreamErrorCodeRefused, streamErr.ErrorCode)
+	assert.NoError(t, server.Context().Err())
+	acceptStream(t, server)
+}
+
+func TestStreamIDOutOfRange(t *testing.T) {
+	for _, id := range []uint32{0xFFFFFFFF, 23, 2} {
+		a, b := net.Pipe()
+		server := New(b, false, Config{StreamReceiveWindow: 4 << 10, MaxIncomingStreams: 10})
+		t.Cleanup(func() { server.CloseWithError(0, "") })
+		go io.Copy(io.Discard, a)
+
+		// Opening the stream would open 10 more than the server accepts,
+		// or it is one the server never opened itself.
+		assert.NoError(t, frame{typ: frameData, stream: id, payload: []byte("x")}.writeTo(a))
+		select {
+		case <-server.Context().Done():
+			assert.ErrorIs(t, context.Cause(server.Context()), ErrorStreamID)
+		case <-time.After(time.Second):
+			t.Fatalf("session stayed up after a frame for stream %d", id)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+// Package mux multiplexes streams over a single reliable connection, such
+// as TCP with TLS, for networks that block QUIC. Streams and errors mirror
+// those of quic-go, so code written against QUIC connections works on top
+// of a session unchanged.
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Max time to wait for the close frame to be sent before the connection is
+// closed anyway.
+const closeTimeout = time.Second
+
+// Resets streams the peer opened over the limit, which only happens when
+// it has not yet seen earlier streams end.
+const StreamErrorCodeRefused = quic.StreamErrorCode(0x04)
+
+type Config struct {
+	// Max bytes the peer may send on a stream before they are read.
+	StreamReceiveWindow uint32
+	// Max number of concurrent streams the peer may open.
+	MaxIncomingStreams int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StreamReceiveWindow: 1 << 20,
+		MaxIncomingStreams:  1000,
+	}
+}
+
+type writeRequest struct {
+	frame frame
+	done  chan error
+}
+
+// Session carries streams over one connection. Reading frames never waits
+// for writes, data is limited by per stream flow control and control
+// frames are queued for the writer, so two peers can not block each other.
+type Session struct {
+	conn   net.Conn
+	config Config
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	writeC    chan writeRequest
+	controlC  chan struct{}
+	acceptC   chan struct{}
+	writeDone chan struct{}
+
+	control    []frame
+	streams    map[uint32]*Stream
+	acceptQ    []*Stream
+	nextID     uint32
+	nextPeerID uint32
+	incoming   int
+	outgoing   int
+	peerWindow uint64
+	// Max streams the peer accepts, zero until it announced it.
+	peerMaxStreams int
+	err            error
+	mu             sync.Mutex
+}
+
+// Starts a session over conn. The two ends of a connection must pass
+// different values of client, so the streams they open get distinct ids.
+func New(conn net.Conn, client bool, config Config) *Session {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s := &Session{
+		conn:       conn,
+		config:     config,
+		ctx:        ctx,
+		cancel:     cancel,
+		writeC:     make(chan writeRequest),
+		controlC:   make(chan struct{}, 1),
+		acceptC:    make(chan struct{}, 1),
+		writeDone:  make(chan struct{}),
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		nextPeerID: 1,
+	}
+	if client {
+		s.nextID, s.nextPeerID = 1, 2
+	}
+
+	settings := frame{typ: frameSettings, value: uint64(config.StreamReceiveWindow), payload: make([]byte, 4)}
+	binary.BigEndian.PutUint32(settings.payload, uint32(max(config.MaxIncomingStreams, 0)))
+	s.queue(settings)
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+func (s *Session) OpenStream() (quic.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	// Like QUIC, the limit of the peer applies to streams still open.
+	if s.peerMaxStreams > 0 && s.outgoing >= s.peerMaxStreams {
+		return nil, ErrorStreamLimit
+	}
+
+	stream := newStream(s, s.nextID, s.peerWindow)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.outgoing++
+	return stream, nil
+}
+
+// Returns the next stream opened by the peer.
+func (s *Session) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			s.mu.Unlock()
+			return nil, s.err
+		}
+		if len(s.acceptQ) > 0 {
+			stream := s.acceptQ[0]
+			s.acceptQ = s.acceptQ[1:]
+			if len(s.acceptQ) > 0 {
+				signal(s.acceptC)
+			}
+			s.mu.Unlock()
+			return stream, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.acceptC:
+		case <-s.ctx.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Tells the peer why the session is closed and closes the connection.
+func (s *Session) CloseWithError(code quic.ApplicationErrorCode, msg string) error {
+	if len(msg) > maxPayload {
+		msg = msg[:maxPayload]
+	}
+	s.queue(frame{typ: frameClose, value: uint64(code), payload: []byte(msg)})
+
+	select {
+	case <-s.writeDone:
+	case <-time.After(closeTimeout):
+	}
+
+	s.teardown(&quic.ApplicationError{ErrorCode: code, ErrorMessage: msg})
+	return nil
+}
+
+// Done when the session is closed, the cause is the close error.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) readLoop() {
+	r := bufio.NewReaderSize(s.conn, 64<<10)
+	payload := make([]byte, maxPayload)
+	var header [headerSize]byte
+
+	for {
+		f, n, err := readHeader(r, &header)
+		if err == nil {
+			f.payload = payload[:n]
+			_, err = io.ReadFull(r, f.payload)
+		}
+		if err == nil {
+			err = s.handle(f)
+		}
+		if err != nil {
+			s.teardown(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(f frame) error {
+	switch f.typ {
+	case frameSettings:
+		if len(f.payload) >= 4 {
+			s.setPeerMaxStreams(int(binary.BigEndian.Uint32(f.payload)))
+		}
+		s.updatePeerWindow(f.value)
+		return nil
+	case frameClose:
+		return &quic.ApplicationError{
+			Remote:       true,
+			ErrorCode:    quic.ApplicationErrorCode(f.value),
+			ErrorMessage: string(f.payload),
+		}
+	}
+
+	stream, err := s.stream(f.stream)
+	if stream == nil {
+		return err
+	}
+
+	switch f.typ {
+	case frameData:
+		return stream.receive(f.payload)
+	case frameFin:
+		stream.receiveFin()
+	case frameReset:
+		stream.receiveReset(quic.StreamErrorCode(f.value))
+	case frameStopSending:
+		stream.receiveStopSending(quic.StreamErrorCode(f.value))
+	case frameWindow:
+		stream.receiveWindow(f.value)
+	}
+	return nil
+}
+
+// Returns the stream a frame is for, creating it if the peer opened it.
+// Like with QUIC, opening a stream opens all streams of the peer with lower
+// ids, so they are accepted in order. One stream over the limit, opened
+// before the peer saw another end, is reset instead, and an id further
+// past the limit is a protocol error. Returns nil for frames of streams
+// that are gone or refused.
+func (s *Session) stream(id uint32) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stream, ok := s.streams[id]; ok {
+		return stream, nil
+	}
+	if s.err != nil {
+		return nil, nil
+	}
+	if !s.isPeerStream(id) {
+		// Streams of this side are only gone once opened.
+		if id >= s.nextID {
+			return nil, ErrorStreamID
+		}
+		return nil, nil
+	}
+	if id < s.nextPeerID {
+		return nil, nil
+	}
+	// Checked before walking the ids, so that neither the walk nor the
+	// addition overflows.
+	if uint64(id-s.nextPeerID) > 2*uint64(max(s.config.MaxIncomingStreams-s.incoming, 0)) {
+		return nil, ErrorStreamID
+	}
+
+	var stream *Stream
+	for n := (id-s.nextPeerID)/2 + 1; n > 0; n-- {
+		next := s.nextPeerID
+		s.nextPeerID += 2
+		if s.incoming >= s.config.MaxIncomingStreams {
+			stream = nil
+			s.control = append(s.control,
+				frame{typ: frameStopSending, stream: next, value: uint64(StreamErrorCodeRefused)},
+				frame{typ: frameReset, stream: next, value: uint64(StreamErrorCodeRefused)},
+			)
+			signal(s.controlC)
+			continue
+		}
+		stream = newStream(s, next, s.peerWindow)
+		s.streams[stream.id] = stream
+		s.incoming++
+		s.acceptQ = append(s.acceptQ, stream)
+		signal(s.acceptC)
+	}
+	return stream, nil
+}
+
+func (s *Session) isPeerStream(id uint32) bool {
+	return id%2 != s.nextID%2
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.streams[id]; !ok {
+		return
+	}
+	delete(s.streams, id)
+	if s.isPeerStream(id) {
+		s.incoming--
+	} else {
+		s.outgoing--
+	}
+}
+
+func (s *Session) setPeerMaxStreams(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peerMaxStreams = n
+}
+
+// Streams opened before the peer announced its window start with none.
+func (s *Session) updatePeerWindow(window uint64) {
+	s.mu.Lock()
+	if window <= s.peerWindow {
+		s.mu.Unlock()
+		return
+	}
+	increase := window - s.peerWindow
+	s.peerWindow = window
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.receiveWindow(increase)
+	}
+}
+
+// Queues a control frame, which is sent ahead of any pending data.
+func (s *Session) queue(f frame) {
+	s.mu.Lock()
+	s.control = append(s.control, f)
+	s.mu.Unlock()
+
+	signal(s.controlC)
+}
+
+// Sends a data frame and waits until it is written to the connection.
+func (s *Session) write(f frame) error {
+	done := make(chan error, 1)
+	select {
+	case s.writeC <- writeRequest{frame: f, done: done}:
+	case <-s.ctx.Done():
+		return s.closeErr()
+	}
+
+	// The writer owns the payload until it answers.
+	if err := <-done; err != nil {
+		if closeErr := s.closeErr(); closeErr != nil {
+			return closeErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Session) writeLoop() {
+	defer close(s.writeDone)
+	w := bufio.NewWriterSize(s.conn, headerSize+maxPayload)
+
+	for {
+		var req *writeRequest
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.controlC:
+		case r := <-s.writeC:
+			req = &r
+		}
+
+		closing, err := s.writeControl(w)
+		if err == nil && req != nil {
+			if closing {
+				err = net.ErrClosed
+			} else {
+				err = req.frame.writeTo(w)
+			}
+		}
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		if req != nil {
+			req.done <- err
+		}
+
+		if err != nil {
+			s.teardown(err)
+			return
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// Writes the queued control frames, returns true if the session is closed
+// by one of them.
+func (s *Session) writeControl(w io.Writer) (bool, error) {
+	s.mu.Lock()
+	frames := s.control
+	s.control = nil
+	s.mu.Unlock()
+
+	for _, f := range frames {
+		if err := f.writeTo(w); err != nil {
+			return false, err
+		}
+		if f.typ == frameClose {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Closes the connection and fails all streams with err.
+func (s *Session) teardown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	s.cancel(err)
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.closeWithError(err)
+	}
+}
+
+// Wakes up whoever waits on c, without blocking if nobody does.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Waits until c is signalled, returns false if deadline passes first.
+func wait(c <-chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-c
+		return true
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-c:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
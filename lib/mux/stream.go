@@ -0,0 +1,306 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Stream is a bidirectional stream of a session. Like with QUIC, Close only
+// closes the write direction and the peer only learns about a new stream
+// once a frame is sent on it.
+type Stream struct {
+	id      uint32
+	session *Session
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	readC  chan struct{}
+	writeC chan struct{}
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	unacked       uint64
+	finReceived   bool
+	readErr       error
+	readDeadline  time.Time
+	sendWindow    uint64
+	finSent       bool
+	resetSent     bool
+	writeErr      error
+	writeDeadline time.Time
+}
+
+var _ quic.Stream = (*Stream)(nil)
+
+func newStream(session *Session, id uint32, sendWindow uint64) *Stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stream{
+		id:         id,
+		session:    session,
+		ctx:        ctx,
+		cancel:     cancel,
+		readC:      make(chan struct{}, 1),
+		writeC:     make(chan struct{}, 1),
+		sendWindow: sendWindow,
+	}
+}
+
+func (st *Stream) StreamID() quic.StreamID {
+	return quic.StreamID(st.id)
+}
+
+// Done when the write direction is closed or reset.
+func (st *Stream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.readErr != nil {
+			err := st.readErr
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			update := st.ack(n)
+			st.mu.Unlock()
+
+			if update > 0 {
+				st.session.queue(frame{typ: frameWindow, stream: st.id, value: update})
+			}
+			return n, nil
+		}
+		if st.finReceived {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if !wait(st.readC, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Counts n read bytes and returns the window to hand back to the peer once
+// half of it is used up.
+func (st *Stream) ack(n int) uint64 {
+	st.unacked += uint64(n)
+	if st.finReceived || st.unacked < uint64(st.session.config.StreamReceiveWindow)/2 {
+		return 0
+	}
+	update := st.unacked
+	st.unacked = 0
+	return update
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.writeErr != nil {
+			err := st.writeErr
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if !wait(st.writeC, deadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		n := int(min(uint64(len(p)), uint64(maxPayload), st.sendWindow))
+		st.sendWindow -= uint64(n)
+		st.mu.Unlock()
+
+		if err := st.session.write(frame{typ: frameData, stream: st.id, payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Closes the write direction, the peer reads EOF after the sent data.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.finSent || st.resetSent {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.writeErr = fmt.Errorf("write on closed stream %d", st.id)
+	st.mu.Unlock()
+
+	st.cancel()
+	signal(st.writeC)
+	st.session.queue(frame{typ: frameFin, stream: st.id})
+	st.maybeRemove()
+	return nil
+}
+
+// Aborts the write direction, the peer fails to read with code. Data sent
+// before Close is delivered anyway, as TCP never loses it.
+func (st *Stream) CancelWrite(code quic.StreamErrorCode) {
+	st.mu.Lock()
+	if st.finSent || st.resetSent {
+		st.mu.Unlock()
+		return
+	}
+	st.resetSent = true
+	st.writeErr = &quic.StreamError{StreamID: st.StreamID(), ErrorCode: code}
+	st.mu.Unlock()
+
+	st.cancel()
+	signal(st.writeC)
+	st.session.queue(frame{typ: frameReset, stream: st.id, value: uint64(code)})
+	st.maybeRemove()
+}
+
+// Discards unread data and asks the peer to stop sending with code.
+func (st *Stream) CancelRead(code quic.StreamErrorCode) {
+	st.mu.Lock()
+	if st.readErr != nil {
+		st.mu.Unlock()
+		return
+	}
+	st.readErr = &quic.StreamError{StreamID: st.StreamID(), ErrorCode: code}
+	stopSending := !st.finReceived
+	st.buf.Reset()
+	st.mu.Unlock()
+
+	signal(st.readC)
+	if stopSending {
+		st.session.queue(frame{typ: frameStopSending, stream: st.id, value: uint64(code)})
+	}
+	st.maybeRemove()
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	signal(st.readC)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	signal(st.writeC)
+	return nil
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Data that arrives after reading was cancelled is dropped.
+	if st.readErr != nil || st.finReceived {
+		return nil
+	}
+	if uint64(st.buf.Len())+st.unacked+uint64(len(data)) > uint64(st.session.config.StreamReceiveWindow) {
+		return ErrorFlowControl
+	}
+
+	st.buf.Write(data)
+	signal(st.readC)
+	return nil
+}
+
+func (st *Stream) receiveFin() {
+	st.mu.Lock()
+	st.finReceived = true
+	st.mu.Unlock()
+
+	signal(st.readC)
+	st.maybeRemove()
+}
+
+func (st *Stream) receiveReset(code quic.StreamErrorCode) {
+	st.mu.Lock()
+	if st.readErr == nil {
+		st.readErr = &quic.StreamError{StreamID: st.StreamID(), ErrorCode: code, Remote: true}
+		st.buf.Reset()
+	}
+	st.finReceived = true
+	st.mu.Unlock()
+
+	signal(st.readC)
+	st.maybeRemove()
+}
+
+// The peer no longer reads, so the write direction is reset with its code.
+func (st *Stream) receiveStopSending(code quic.StreamErrorCode) {
+	st.mu.Lock()
+	if st.finSent || st.resetSent {
+		st.mu.Unlock()
+		return
+	}
+	st.resetSent = true
+	st.writeErr = &quic.StreamError{StreamID: st.StreamID(), ErrorCode: code, Remote: true}
+	st.mu.Unlock()
+
+	st.cancel()
+	signal(st.writeC)
+	st.session.queue(frame{typ: frameReset, stream: st.id, value: uint64(code)})
+	st.maybeRemove()
+}
+
+func (st *Stream) receiveWindow(n uint64) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+
+	signal(st.writeC)
+}
+
+// Fails both directions when the session is closed.
+func (st *Stream) closeWithError(err error) {
+	st.mu.Lock()
+	if st.readErr == nil && !st.finReceived {
+		st.readErr = err
+	}
+	if !st.finSent && !st.resetSent {
+		st.writeErr = err
+	}
+	st.mu.Unlock()
+
+	st.cancel()
+	signal(st.readC)
+	signal(st.writeC)
+}
+
+// Forgets the stream once both directions are done, later frames for it
+// are dropped.
+func (st *Stream) maybeRemove() {
+	st.mu.Lock()
+	done := (st.finReceived || st.readErr != nil) && (st.finSent || st.resetSent)
+	st.mu.Unlock()
+
+	if done {
+		st.session.remove(st.id)
+	}
+}
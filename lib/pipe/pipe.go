@@ -0,0 +1,208 @@
+package pipe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// End is one side of a pipe.
+type End interface {
+	io.Reader
+	io.Writer
+	// Closes the write direction, so the peer reads EOF while data may
+	// still flow the other way.
+	CloseWrite() error
+	// Resets both directions, so the peer sees an error instead of EOF.
+	Abort(err error)
+	// Releases the end once both directions are done.
+	Close() error
+}
+
+type Side int
+
+const (
+	SideA Side = iota
+	SideB
+)
+
+// Result of a pipe run.
+type Result struct {
+	// Bytes read from a and written to b.
+	AToB int64
+	// Bytes read from b and written to a.
+	BToA int64
+	// Side whose read ended first, by EOF or error.
+	First Side
+	// First error other than EOF, nil if both sides closed cleanly.
+	Err error
+}
+
+// Run copies data both ways between a and b until both directions are
+// done. EOF on one side is passed on as CloseWrite of the other, and an
+// error in either direction aborts both ends. Failing to write to a side
+// that already sent EOF means it is fully closed, which is not an error.
+// onData, if set, is called whenever data is written.
+func Run(a, b End, onData func()) Result {
+	type half struct {
+		side Side
+		n    int64
+		err  error
+	}
+
+	// Set once a side was read to EOF.
+	var eofA, eofB atomic.Bool
+
+	var abortOnce sync.Once
+	abort := func(err error) {
+		abortOnce.Do(func() {
+			a.Abort(err)
+			b.Abort(err)
+		})
+	}
+
+	doneC := make(chan half, 2)
+	go func() {
+		n, err := copyHalf(b, a, &eofA, &eofB, onData)
+		doneC <- half{side: SideA, n: n, err: err}
+	}()
+	go func() {
+		n, err := copyHalf(a, b, &eofB, &eofA, onData)
+		doneC <- half{side: SideB, n: n, err: err}
+	}()
+
+	var result Result
+	for i := 0; i < 2; i++ {
+		h := <-doneC
+		if i == 0 {
+			result.First = h.side
+		}
+		if h.side == SideA {
+			result.AToB = h.n
+		} else {
+			result.BToA = h.n
+		}
+		if h.err != nil {
+			if result.Err == nil {
+				result.Err = h.err
+			}
+			abort(h.err)
+		}
+	}
+
+	a.Close()
+	b.Close()
+	return result
+}
+
+const bufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+func copyHalf(dst, src End, srcEOF, dstEOF *atomic.Bool, onData func()) (int64, error) {
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	buf := *bufp
+
+	var written int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if nw > 0 && onData != nil {
+				onData()
+			}
+			if werr != nil {
+				if dstEOF.Load() {
+					return written, nil
+				}
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if errors.Is(rerr, io.EOF) {
+			srcEOF.Store(true)
+			return written, dst.CloseWrite()
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Wrappers of a connection, such as hijacked HTTP connections, may hide
+// the methods needed for half-close and abort.
+type unwrapper interface {
+	UnsafeConn() net.Conn
+}
+
+type conn struct {
+	io.ReadWriteCloser
+	// Set when CloseWrite had to close the whole connection.
+	closed atomic.Bool
+}
+
+// Conn adapts a connection to a pipe end. Connections without CloseWrite
+// are closed fully when the peer is done writing.
+func Conn(c io.ReadWriteCloser) End {
+	return &conn{ReadWriteCloser: c}
+}
+
+func (c *conn) raw() io.Closer {
+	if u, ok := c.ReadWriteCloser.(unwrapper); ok {
+		return u.UnsafeConn()
+	}
+	return c.ReadWriteCloser
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if err != nil && c.closed.Load() {
+		// Reads fail after the fallback close, which ends this side as
+		// if it had sent EOF.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.raw().(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	c.closed.Store(true)
+	return c.Close()
+}
+
+func (c *conn) Abort(error) {
+	raw := c.raw()
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	if d, ok := raw.(deadliner); ok {
+		d.SetDeadline(time.Now())
+	}
+	raw.Close()
+}
+
+func (c *conn) Close() error {
+	return c.raw().Close()
+}
@@ -0,0 +1,129 @@
+package pipe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns both sides of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	acceptC := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptC <- conn
+	}()
+
+	dialed, err := net.Dial("tcp4", ln.Addr().String())
+	assert.NoError(t, err)
+	accepted := <-acceptC
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestRunHalfClose(t *testing.T) {
+	client, userConn := tcpPair(t)
+	destConn, server := tcpPair(t)
+
+	// Server answers only once the client is done sending.
+	go func() {
+		request, _ := io.ReadAll(server)
+		server.Write(append([]byte("re: "), request...))
+		server.Close()
+	}()
+
+	resultC := make(chan Result, 1)
+	go func() {
+		resultC <- Run(Conn(userConn), Conn(destConn), nil)
+	}()
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+
+	response, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "re: request", string(response))
+
+	result := <-resultC
+	assert.NoError(t, result.Err)
+	assert.Equal(t, SideA, result.First)
+	assert.Equal(t, int64(7), result.AToB)
+	assert.Equal(t, int64(11), result.BToA)
+}
+
+type fakeEnd struct {
+	readErr error
+	abortC  chan error
+	closed  chan struct{}
+}
+
+func newFakeEnd(readErr error) *fakeEnd {
+	return &fakeEnd{
+		readErr: readErr,
+		abortC:  make(chan error, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (f *fakeEnd) Read(p []byte) (int, error) {
+	if f.readErr != nil {
+		return 0, f.readErr
+	}
+	<-f.closed
+	return 0, errors.New("aborted")
+}
+
+func (f *fakeEnd) Write(p []byte) (int, error) { return len(p), nil }
+func (f *fakeEnd) CloseWrite() error           { return nil }
+func (f *fakeEnd) Close() error                { return nil }
+
+func (f *fakeEnd) Abort(err error) {
+	f.abortC <- err
+	close(f.closed)
+}
+
+func TestRunPropagatesReset(t *testing.T) {
+	reset := errors.New("reset")
+	a, b := newFakeEnd(nil), newFakeEnd(reset)
+
+	result := Run(a, b, nil)
+	assert.ErrorIs(t, result.Err, reset)
+	assert.Equal(t, SideB, result.First)
+	assert.ErrorIs(t, <-a.abortC, reset)
+	assert.ErrorIs(t, <-b.abortC, reset)
+}
+
+func TestRunWithoutCloseWrite(t *testing.T) {
+	client, userConn := net.Pipe()
+	destConn, server := tcpPair(t)
+
+	go func() {
+		server.Write([]byte("bye"))
+		server.Close()
+	}()
+
+	resultC := make(chan Result, 1)
+	go func() {
+		resultC <- Run(Conn(userConn), Conn(destConn), nil)
+	}()
+
+	// The user side is closed fully once the destination is done.
+	response, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(response))
+
+	select {
+	case result := <-resultC:
+		assert.NoError(t, result.Err)
+		assert.Equal(t, SideB, result.First)
+	case <-time.After(time.Second):
+		t.Fatal("pipe did not finish")
+	}
+}
@@ -3,7 +3,9 @@ package proto
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type MessageType byte
@@ -17,7 +19,16 @@ const (
 	MsgRelayHello   = MessageType(0x01)
 	MsgRelayConfig  = MessageType(0x02)
 	MsgGatewayProxy = MessageType(0x03)
+	MsgDrain        = MessageType(0x04)
+	MsgRelayAuth    = MessageType(0x05)
+	MsgCapacity     = MessageType(0x06)
+	MsgRegions      = MessageType(0x07)
 
+	// Like MsgError, for sessions the edge denied or whose destination
+	// it could not reach, which say nothing about the edge.
+	MsgDestinationError = MessageType(0xFB)
+	// Like MsgError, for failures that may succeed on another edge.
+	MsgRetry   = MessageType(0xFC)
 	MsgPing    = MessageType(0xFD)
 	MsgSuccess = MessageType(0xFE)
 	MsgError   = MessageType(0xFF)
@@ -27,10 +38,32 @@ const (
 
 var ErrorMessageTypeUnknown = errors.New("Unknown message type")
 var ErrorMessageTypeNotMap = errors.New("Invalid message type for map")
+var ErrorMessageTypeUnexpected = errors.New("Wrong protocol message")
+
+// RetryError is the error of a retry message. The session failed for a
+// reason that may not apply to another edge, such as the edge being full.
+type RetryError struct {
+	Reason string
+}
+
+func (e *RetryError) Error() string {
+	return e.Reason
+}
+
+// DestinationError is the error of a destination error message. The edge
+// works, but denied the session or could not reach its destination.
+type DestinationError struct {
+	Reason string
+}
+
+func (e *DestinationError) Error() string {
+	return e.Reason
+}
 
 func (m MessageType) Validate() error {
 	switch m {
-	case MsgRelayHello, MsgRelayConfig, MsgGatewayProxy, MsgSuccess, MsgError, MsgPing:
+	case MsgRelayHello, MsgRelayConfig, MsgGatewayProxy, MsgDrain, MsgRelayAuth, MsgCapacity,
+		MsgRegions, MsgDestinationError, MsgRetry, MsgSuccess, MsgError, MsgPing:
 		return nil
 	default:
 		return ErrorMessageTypeUnknown
@@ -61,11 +94,18 @@ func (m *Message) MarshalString(mt MessageType, body string) error {
 	return mt.Validate()
 }
 
+// Escapes the separators of map messages in keys and values, so that no
+// value can add fields of its own.
+var (
+	mapEscaper   = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D", "\n", "%0A")
+	mapUnescaper = strings.NewReplacer("%25", "%", "%3B", ";", "%3D", "=", "%0A", "\n")
+)
+
 func (m *Message) MarshalMap(mt MessageType, data map[string]string) error {
 	// Convert map to string format: key=value;key2=value2;...
 	var parts []string
 	for key, value := range data {
-		parts = append(parts, fmt.Sprintf("%s=%s", key, value))
+		parts = append(parts, fmt.Sprintf("%s=%s", mapEscaper.Replace(key), mapEscaper.Replace(value)))
 	}
 	body := strings.Join(parts, ";")
 
@@ -83,7 +123,7 @@ func (m Message) UnmarshalMap() (MessageType, map[string]string, error) {
 	for _, part := range parts {
 		kv := strings.SplitN(part, "=", 2)
 		if len(kv) == 2 {
-			data[kv[0]] = kv[1]
+			data[mapUnescaper.Replace(kv[0])] = mapUnescaper.Replace(kv[1])
 		}
 	}
 
@@ -115,19 +155,210 @@ func NewMsgRelayHello(regions map[string]string) Message {
 	return m
 }
 
+// Credentials of a dialer, sent before the hello. The name must not contain
+// ":" and neither may contain a newline.
+func NewMsgRelayAuth(name, secret string) Message {
+	m, _ := newMessageString(MsgRelayAuth, name+":"+secret)
+	return m
+}
+
+func (m Message) UnmarshalRelayAuth() (string, string, error) {
+	mt, body, err := m.UnmarshalString()
+	if err != nil {
+		return "", "", err
+	}
+
+	if MsgRelayAuth != mt {
+		return "", "", ErrorMessageTypeUnexpected
+	}
+
+	name, secret, _ := strings.Cut(body, ":")
+	return name, secret, nil
+}
+
+// Replaces the regions announced with the hello, no regions withdraw the
+// dialer from all of them.
+func NewMsgRegions(regions map[string]string) Message {
+	m, _ := newMessageMap(MsgRegions, regions)
+	return m
+}
+
 func NewMsgRelayConfig(id string) Message {
 	m, _ := newMessageString(MsgRelayConfig, id)
 	return m
 }
 
-func NewMsgGatewayProxy(destination, region string) Message {
-	m, _ := newMessageMap(MsgGatewayProxy, map[string]string{
-		"destination": destination,
-		"region":      region,
+type ResolveMode string
+
+const (
+	// Edge resolves the destination however it is configured to.
+	ResolveDefault = ResolveMode("")
+	// Destination must only be resolved by the edge's own upstream
+	// resolvers, without falling back to anything outside the edge region.
+	ResolveRemote = ResolveMode("remote")
+)
+
+type GatewayProxy struct {
+	Destination string
+	Region      string
+	Resolve     ResolveMode
+	// IDs of the relays the request passed through, in order.
+	Path []string
+	// Trace id of the session, generated by the gateway.
+	SessionID string
+	// Span of the previous hop, parent of the spans of the next one.
+	SpanID string
+	// Max duration of the session, every hop closes it once it is over.
+	MaxDuration time.Duration
+}
+
+func NewMsgGatewayProxy(p GatewayProxy) Message {
+	data := map[string]string{
+		"destination": p.Destination,
+		"region":      p.Region,
+	}
+	if p.Resolve != ResolveDefault {
+		data["resolve"] = string(p.Resolve)
+	}
+	if len(p.Path) > 0 {
+		data["path"] = strings.Join(p.Path, ",")
+	}
+	if p.SessionID != "" {
+		data["session"] = p.SessionID
+	}
+	if p.SpanID != "" {
+		data["span"] = p.SpanID
+	}
+	if p.MaxDuration > 0 {
+		data["maxDuration"] = p.MaxDuration.String()
+	}
+
+	m, _ := newMessageMap(MsgGatewayProxy, data)
+	return m
+}
+
+func (m Message) UnmarshalGatewayProxy() (GatewayProxy, error) {
+	mt, data, err := m.UnmarshalMap()
+	if err != nil {
+		return GatewayProxy{}, err
+	}
+
+	if MsgGatewayProxy != mt {
+		return GatewayProxy{}, ErrorMessageTypeUnexpected
+	}
+
+	proxy := GatewayProxy{
+		Destination: data["destination"],
+		Region:      data["region"],
+		Resolve:     ResolveMode(data["resolve"]),
+		SessionID:   data["session"],
+		SpanID:      data["span"],
+	}
+	if path := data["path"]; path != "" {
+		proxy.Path = strings.Split(path, ",")
+	}
+	if maxDuration := data["maxDuration"]; maxDuration != "" {
+		if proxy.MaxDuration, err = time.ParseDuration(maxDuration); err != nil {
+			return GatewayProxy{}, err
+		}
+	}
+
+	return proxy, nil
+}
+
+// Reported back to the gateway once the edge connected to the destination.
+type ProxyResult struct {
+	EdgeID string
+	ExitIP string
+}
+
+func NewMsgProxySuccess(r ProxyResult) Message {
+	data := make(map[string]string)
+	if r.EdgeID != "" {
+		data["edge"] = r.EdgeID
+	}
+	if r.ExitIP != "" {
+		data["exit"] = r.ExitIP
+	}
+
+	m, _ := newMessageMap(MsgSuccess, data)
+	return m
+}
+
+// Returns the proxy result of a success message, or the error carried by
+// an error message.
+func (m Message) UnmarshalProxyResult() (ProxyResult, error) {
+	mt, body, err := m.UnmarshalString()
+	if err != nil {
+		return ProxyResult{}, err
+	}
+
+	switch mt {
+	case MsgSuccess:
+		_, data, err := m.UnmarshalMap()
+		if err != nil {
+			return ProxyResult{}, err
+		}
+		return ProxyResult{EdgeID: data["edge"], ExitIP: data["exit"]}, nil
+	case MsgError:
+		return ProxyResult{}, errors.New(body)
+	case MsgRetry:
+		return ProxyResult{}, &RetryError{Reason: body}
+	case MsgDestinationError:
+		return ProxyResult{}, &DestinationError{Reason: body}
+	default:
+		return ProxyResult{}, ErrorMessageTypeUnexpected
+	}
+}
+
+// Remaining capacity of an edge, advertised to its relay whenever it
+// changes.
+type Capacity struct {
+	// False while the edge rejects new sessions.
+	Available bool
+	// New sessions the edge accepts, -1 if unlimited.
+	Sessions int
+	// Unused bandwidth in bytes per second, -1 if unlimited.
+	Bandwidth int64
+}
+
+func NewMsgCapacity(c Capacity) Message {
+	m, _ := newMessageMap(MsgCapacity, map[string]string{
+		"available": strconv.FormatBool(c.Available),
+		"sessions":  strconv.Itoa(c.Sessions),
+		"bandwidth": strconv.FormatInt(c.Bandwidth, 10),
 	})
 	return m
 }
 
+func (m Message) UnmarshalCapacity() (Capacity, error) {
+	mt, data, err := m.UnmarshalMap()
+	if err != nil {
+		return Capacity{}, err
+	}
+
+	if MsgCapacity != mt {
+		return Capacity{}, ErrorMessageTypeUnexpected
+	}
+
+	var c Capacity
+	if c.Available, err = strconv.ParseBool(data["available"]); err != nil {
+		return Capacity{}, err
+	}
+	if c.Sessions, err = strconv.Atoi(data["sessions"]); err != nil {
+		return Capacity{}, err
+	}
+	if c.Bandwidth, err = strconv.ParseInt(data["bandwidth"], 10, 64); err != nil {
+		return Capacity{}, err
+	}
+	return c, nil
+}
+
+func NewMsgDrain() Message {
+	m, _ := newMessageString(MsgDrain, "")
+	return m
+}
+
 func NewMsgSuccess() Message {
 	m, _ := newMessageString(MsgSuccess, "")
 	return m
@@ -138,6 +369,16 @@ func NewMsgError(err string) Message {
 	return m
 }
 
+func NewMsgRetry(reason string) Message {
+	m, _ := newMessageString(MsgRetry, reason)
+	return m
+}
+
+func NewMsgDestinationError(reason string) Message {
+	m, _ := newMessageString(MsgDestinationError, reason)
+	return m
+}
+
 func NewMsgPing(id string) Message {
 	m, _ := newMessageString(MsgPing, id)
 	return m
@@ -0,0 +1,22 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatewayProxyEscapesFields(t *testing.T) {
+	proxy := GatewayProxy{
+		Destination: "x;region=blue;maxDuration=10000h;y=%3B:443",
+		Region:      "red",
+		MaxDuration: time.Minute,
+	}
+
+	got, err := NewMsgGatewayProxy(proxy).UnmarshalGatewayProxy()
+	assert.NoError(t, err)
+	assert.Equal(t, proxy.Destination, got.Destination)
+	assert.Equal(t, "red", got.Region)
+	assert.Equal(t, time.Minute, got.MaxDuration)
+}
@@ -0,0 +1,52 @@
+package quic
+
+import (
+	"errors"
+
+	"github.com/bacv/kingip/lib/mux"
+	"github.com/quic-go/quic-go"
+)
+
+// Application error codes used when closing connections between tiers.
+const (
+	ErrorCodeNone        = quic.ApplicationErrorCode(0x00)
+	ErrorCodeShutdown    = quic.ApplicationErrorCode(0x01)
+	ErrorCodePingTimeout = quic.ApplicationErrorCode(0x02)
+	// The dialer only measured the round trip, see Dialer.Probe.
+	ErrorCodeProbe = quic.ApplicationErrorCode(0x03)
+)
+
+// Stream error codes used when cancelling streams.
+const (
+	StreamErrorCodeNone     = quic.StreamErrorCode(0x00)
+	StreamErrorCodeDraining = quic.StreamErrorCode(0x01)
+	// A hop closed the session because it was idle or too long.
+	StreamErrorCodeTimeout = quic.StreamErrorCode(0x02)
+	// A hop failed to read or write one of the legs of a session.
+	StreamErrorCodeAborted = quic.StreamErrorCode(0x03)
+	// A stream over the limit of a TCP session, see mux.StreamErrorCodeRefused.
+	StreamErrorCodeRefused = mux.StreamErrorCodeRefused
+)
+
+// Cancels both directions of a stream, so the other side sees code instead
+// of a clean EOF.
+func CancelStream(stream quic.Stream, code quic.StreamErrorCode) {
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
+// Returns the code of a stream reset or stop sending from the peer in err.
+func StreamErrorCodeOf(err error) (quic.StreamErrorCode, bool) {
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.ErrorCode, true
+	}
+	return 0, false
+}
+
+// Whether err is the close of a connection the peer only opened to
+// measure the round trip.
+func isProbe(err error) bool {
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == ErrorCodeProbe
+}
@@ -0,0 +1,84 @@
+package quic
+
+import (
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+var (
+	ErrorStreamWindow     = errors.New("Stream receive window is larger than the connection receive window")
+	ErrorKeepAlivePeriod  = errors.New("Keep alive period must be shorter than the max idle timeout")
+	ErrorPingTimeout      = errors.New("Ping timeout must be longer than the ping interval")
+	ErrorMaxStreams       = errors.New("Max incoming streams must be positive")
+	ErrorNegativeDuration = errors.New("Durations must not be negative")
+)
+
+// QUICConfig tunes the connections between tiers. Both sides of a
+// connection apply their own settings.
+type QUICConfig struct {
+	// Max flow control window of a single stream, in bytes.
+	StreamReceiveWindow uint64 `mapstructure:"streamReceiveWindow"`
+	// Max flow control window of all streams of a connection, in bytes.
+	ConnectionReceiveWindow uint64 `mapstructure:"connectionReceiveWindow"`
+	// Closes connections without any network activity for this long.
+	MaxIdleTimeout time.Duration `mapstructure:"maxIdleTimeout"`
+	// Sends QUIC keep alive packets this often, zero disables them.
+	KeepAlivePeriod time.Duration `mapstructure:"keepAlivePeriod"`
+	// Max time to complete the handshake.
+	HandshakeTimeout time.Duration `mapstructure:"handshakeTimeout"`
+	// Max number of concurrent streams the peer may open.
+	MaxIncomingStreams int64 `mapstructure:"maxIncomingStreams"`
+	// Interval of the ping messages the listener sends to dialers.
+	PingInterval time.Duration `mapstructure:"pingInterval"`
+	// Closes connections whose ping got no answer for this long.
+	PingTimeout time.Duration `mapstructure:"pingTimeout"`
+	// Lets dialers send data in their first flight when they reconnect.
+	Allow0RTT bool `mapstructure:"allow0RTT"`
+}
+
+func DefaultQUICConfig() QUICConfig {
+	return QUICConfig{
+		StreamReceiveWindow:     6 << 20,
+		ConnectionReceiveWindow: 15 << 20,
+		MaxIdleTimeout:          30 * time.Second,
+		HandshakeTimeout:        5 * time.Second,
+		MaxIncomingStreams:      100_000,
+		PingInterval:            time.Second,
+		PingTimeout:             5 * time.Second,
+	}
+}
+
+func (c QUICConfig) Validate() error {
+	if c.MaxIdleTimeout < 0 || c.KeepAlivePeriod < 0 || c.HandshakeTimeout < 0 || c.PingInterval < 0 || c.PingTimeout < 0 {
+		return ErrorNegativeDuration
+	}
+	if c.StreamReceiveWindow > c.ConnectionReceiveWindow {
+		return ErrorStreamWindow
+	}
+	if c.KeepAlivePeriod > 0 && c.KeepAlivePeriod >= c.MaxIdleTimeout {
+		return ErrorKeepAlivePeriod
+	}
+	if c.PingTimeout <= c.PingInterval {
+		return ErrorPingTimeout
+	}
+	if c.MaxIncomingStreams <= 0 {
+		return ErrorMaxStreams
+	}
+	return nil
+}
+
+func (c QUICConfig) quicConfig() *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow:     min(c.StreamReceiveWindow, 512<<10),
+		MaxStreamReceiveWindow:         c.StreamReceiveWindow,
+		InitialConnectionReceiveWindow: min(c.ConnectionReceiveWindow, 768<<10),
+		MaxConnectionReceiveWindow:     c.ConnectionReceiveWindow,
+		MaxIdleTimeout:                 c.MaxIdleTimeout,
+		KeepAlivePeriod:                c.KeepAlivePeriod,
+		HandshakeIdleTimeout:           c.HandshakeTimeout,
+		MaxIncomingStreams:             c.MaxIncomingStreams,
+		Allow0RTT:                      c.Allow0RTT,
+	}
+}
@@ -0,0 +1,52 @@
+package quic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQUICConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultQUICConfig().Validate())
+
+	config := DefaultQUICConfig()
+	config.StreamReceiveWindow = config.ConnectionReceiveWindow + 1
+	assert.ErrorIs(t, config.Validate(), ErrorStreamWindow)
+
+	config = DefaultQUICConfig()
+	config.KeepAlivePeriod = config.MaxIdleTimeout
+	assert.ErrorIs(t, config.Validate(), ErrorKeepAlivePeriod)
+
+	config = DefaultQUICConfig()
+	config.PingTimeout = config.PingInterval
+	assert.ErrorIs(t, config.Validate(), ErrorPingTimeout)
+
+	config = DefaultQUICConfig()
+	config.MaxIncomingStreams = 0
+	assert.ErrorIs(t, config.Validate(), ErrorMaxStreams)
+
+	config = DefaultQUICConfig()
+	config.HandshakeTimeout = -time.Second
+	assert.ErrorIs(t, config.Validate(), ErrorNegativeDuration)
+}
+
+func TestQUICConfigWindows(t *testing.T) {
+	config := DefaultQUICConfig()
+	config.StreamReceiveWindow = 64 << 10
+	config.ConnectionReceiveWindow = 128 << 10
+
+	// Initial windows never exceed the configured max.
+	quicConfig := config.quicConfig()
+	assert.Equal(t, uint64(64<<10), quicConfig.InitialStreamReceiveWindow)
+	assert.Equal(t, uint64(128<<10), quicConfig.InitialConnectionReceiveWindow)
+}
+
+func TestZeroQUICConfigUsesDefaults(t *testing.T) {
+	listener := NewListener(context.Background(), ListenerConfig{Addr: "127.0.0.1:0"}, nil, nil, nil, nil, nil, nil)
+	assert.Equal(t, DefaultQUICConfig(), listener.config.QUIC)
+
+	dialer := NewDialer(DialerConfig{Addr: "127.0.0.1:0"}, nil, nil)
+	assert.Equal(t, DefaultQUICConfig(), dialer.config.QUIC)
+}
@@ -0,0 +1,100 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/bacv/kingip/lib/mux"
+	"github.com/quic-go/quic-go"
+)
+
+var ErrorNetwork = errors.New("Network must be one of auto, quic, tcp or websocket")
+
+// Conn is a connection between tiers, carried either by QUIC or by a
+// stream multiplexer over TLS, directly on TCP or inside a WebSocket.
+type Conn interface {
+	OpenStream() (quic.Stream, error)
+	AcceptStream(context.Context) (quic.Stream, error)
+	CloseWithError(quic.ApplicationErrorCode, string) error
+	Context() context.Context
+	RemoteAddr() net.Addr
+}
+
+var (
+	_ Conn = quic.Connection(nil)
+	_ Conn = (*mux.Session)(nil)
+)
+
+// Network selects what carries the connections between tiers.
+type Network string
+
+const (
+	// Dialers try QUIC first and fall back to TCP, listeners accept both.
+	NetworkAuto Network = ""
+	NetworkQUIC Network = "quic"
+	NetworkTCP  Network = "tcp"
+	// Dialers tunnel through a WebSocket over HTTPS, for networks that only
+	// let HTTPS out. Listeners accept it on their TCP port with every
+	// network but quic.
+	NetworkWebSocket Network = "websocket"
+)
+
+func (n Network) Validate() error {
+	switch n {
+	case NetworkAuto, "auto", NetworkQUIC, NetworkTCP, NetworkWebSocket:
+		return nil
+	}
+	return ErrorNetwork
+}
+
+func (n Network) quic() bool {
+	return n == NetworkAuto || n == "auto" || n == NetworkQUIC
+}
+
+func (n Network) tcp() bool {
+	return n != NetworkQUIC
+}
+
+// Streams over TCP share the flow control and stream limits of QUIC.
+func (c QUICConfig) muxConfig() mux.Config {
+	return mux.Config{
+		StreamReceiveWindow: uint32(min(c.StreamReceiveWindow, math.MaxUint32)),
+		MaxIncomingStreams:  int(c.MaxIncomingStreams),
+	}
+}
+
+// Zero uses the QUIC default.
+func (c QUICConfig) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout == 0 {
+		return 5 * time.Second
+	}
+	return c.HandshakeTimeout
+}
+
+func dialTCP(ctx context.Context, addr string, tlsConfig *tls.Config, config QUICConfig) (Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.handshakeTimeout())
+	defer cancel()
+
+	dialer := tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return mux.New(conn, true, config.muxConfig()), nil
+}
+
+func handshakeTCP(ctx context.Context, conn net.Conn, tlsConfig *tls.Config, config QUICConfig) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.handshakeTimeout())
+	defer cancel()
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
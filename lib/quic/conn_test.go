@@ -0,0 +1,230 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Registers dialers with a listener and returns their connections.
+func listen(t *testing.T, config ListenerConfig) <-chan Conn {
+	connC, _ := listenPeers(t, config)
+	return connC
+}
+
+// Like listen, also returning what the listener knows about the dialers.
+func listenPeers(t *testing.T, config ListenerConfig) (<-chan Conn, <-chan *Peer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	connC := make(chan Conn, 1)
+	peerC := make(chan *Peer, 1)
+	listener := NewListener(ctx, config, logging.Discard(),
+		func(conn Conn, peer *Peer) (uint64, <-chan error, error) {
+			connC <- conn
+			peerC <- peer
+			return 1, make(chan error), nil
+		},
+		func(uint64, map[string]string) error { return nil },
+		func(uint64) {},
+		nil,
+		func(uint64) {},
+	)
+	go listener.Listen()
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", config.Addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+	return connC, peerC
+}
+
+func echo(stream quic.Stream) error {
+	defer stream.Close()
+	_, err := io.Copy(stream, stream)
+	return err
+}
+
+// Waits for the dialer to register and checks that a stream opened by the
+// listener reaches its handler.
+func testEcho(t *testing.T, connC <-chan Conn) {
+	var conn Conn
+	select {
+	case conn = <-connC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialer did not connect")
+	}
+
+	stream, err := conn.OpenStream()
+	assert.NoError(t, err)
+	stream.Write([]byte("hello"))
+	stream.Close()
+
+	response, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(response))
+}
+
+func dial(t *testing.T, config DialerConfig) *Dialer {
+	dialer := NewDialer(config, logging.Discard(), echo)
+	go dialer.Dial(context.Background())
+	t.Cleanup(func() { dialer.Shutdown(context.Background()) })
+	return dialer
+}
+
+func TestDialerFallback(t *testing.T) {
+	addr := freeAddr(t)
+	config := DefaultQUICConfig()
+	config.HandshakeTimeout = 200 * time.Millisecond
+
+	// Nothing answers QUIC, so the dialer has to fall back to TCP.
+	connC := listen(t, ListenerConfig{Addr: addr, Network: NetworkTCP, QUIC: config})
+	dial(t, DialerConfig{Addr: addr, QUIC: config})
+	testEcho(t, connC)
+}
+
+// Serves CONNECT requests and counts them.
+func connectProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		count.Add(1)
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+
+	proxyURL, _ := url.Parse(server.URL)
+	return proxyURL, &count
+}
+
+func TestDialerWebSocket(t *testing.T) {
+	addr := freeAddr(t)
+	proxyURL, connects := connectProxy(t)
+
+	connC := listen(t, ListenerConfig{Addr: addr})
+	dial(t, DialerConfig{
+		Addr:    addr,
+		Network: NetworkWebSocket,
+		Proxy:   http.ProxyURL(proxyURL),
+	})
+	testEcho(t, connC)
+	assert.Equal(t, int32(1), connects.Load())
+
+	// Other HTTPS requests find nothing.
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addr + "/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDialerCredentials(t *testing.T) {
+	addr := freeAddr(t)
+	connC, peerC := listenPeers(t, ListenerConfig{
+		Addr:    addr,
+		Network: NetworkTCP,
+		Authenticate: func(name, secret string) error {
+			if name != "edge" || secret != "s3cr:et" {
+				return errors.New("Invalid credentials")
+			}
+			return nil
+		},
+	})
+
+	for _, creds := range []*Credentials{nil, {Name: "edge", Secret: "wrong"}} {
+		dialer := NewDialer(DialerConfig{Addr: addr, Network: NetworkTCP, Credentials: creds}, logging.Discard(), echo)
+		assert.Error(t, dialer.Dial(context.Background()))
+	}
+
+	registered := make(chan string, 1)
+	dialer := dial(t, DialerConfig{
+		Addr:        addr,
+		Network:     NetworkTCP,
+		Credentials: &Credentials{Name: "edge", Secret: "s3cr:et"},
+		OnRegister:  func(id string) { registered <- id },
+	})
+	testEcho(t, connC)
+	assert.Equal(t, "1", <-registered)
+
+	peer := <-peerC
+	assert.Equal(t, "edge", peer.Name)
+	assert.WithinDuration(t, time.Now(), peer.ConnectedAt, 5*time.Second)
+	assert.Greater(t, peer.RTT(), time.Duration(0))
+
+	status := dialer.Status()
+	assert.True(t, status.Connected)
+	assert.Equal(t, "1", status.ConnID)
+	assert.Equal(t, addr, status.Addr)
+}
+
+func TestDialerProbe(t *testing.T) {
+	for _, network := range []Network{NetworkQUIC, NetworkTCP} {
+		addr := freeAddr(t)
+		connC := listen(t, ListenerConfig{Addr: addr})
+
+		dialer := NewDialer(DialerConfig{Addr: addr, Network: network}, logging.Discard(), echo)
+		rtt, err := dialer.Probe(context.Background())
+		assert.NoError(t, err)
+		assert.Greater(t, rtt, time.Duration(0))
+
+		// Nothing is registered for a probe.
+		select {
+		case <-connC:
+			t.Fatalf("probe over %s registered", network)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	dialer := NewDialer(DialerConfig{Addr: freeAddr(t), Network: NetworkTCP}, logging.Discard(), echo)
+	_, err := dialer.Probe(context.Background())
+	assert.Error(t, err)
+}
+
+func TestNetworkValidate(t *testing.T) {
+	assert.NoError(t, NetworkAuto.Validate())
+	assert.NoError(t, Network("auto").Validate())
+	assert.NoError(t, NetworkTCP.Validate())
+	assert.ErrorIs(t, Network("udp").Validate(), ErrorNetwork)
+}
@@ -2,10 +2,15 @@ package quic
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
+	"github.com/bacv/kingip/lib/logging"
 	proto "github.com/bacv/kingip/lib/proto"
 	"github.com/bacv/kingip/lib/transport"
 	"github.com/quic-go/quic-go"
@@ -13,61 +18,343 @@ import (
 
 type DialerStreamHandleFunc func(quic.Stream) error
 
+// Credentials a dialer authenticates with, the name must not contain ":".
+type Credentials struct {
+	Name   string
+	Secret string
+}
+
 type DialerConfig struct {
 	Addr    string
 	Regions map[string]string
+	// With NetworkAuto, TCP is tried when no QUIC handshake completes
+	// within the handshake timeout.
+	Network Network
+	// Returns the HTTP proxy for WebSocket conns, nil uses the proxy set in
+	// the environment.
+	Proxy func(*http.Request) (*url.URL, error)
+	// Sent to the listener before the hello if set.
+	Credentials *Credentials
+	// Called with the id the listener assigned once registered, may be nil.
+	OnRegister func(id string)
+	// The zero value uses DefaultQUICConfig. Pings from the listener are
+	// awaited for PingTimeout, which must be longer than the listener's
+	// ping interval.
+	QUIC QUICConfig
+}
+
+// DialerStatus is the state of the conn of a dialer.
+type DialerStatus struct {
+	Addr string
+	// Whether the dialer is registered with the listener, which assigned
+	// it ConnID at RegisteredAt.
+	Connected    bool
+	ConnID       string
+	RegisteredAt time.Time
+	Draining     bool
 }
 
 type Dialer struct {
 	config        DialerConfig
+	logger        *slog.Logger
 	streamHandler DialerStreamHandleFunc
+	tlsConfig     *tls.Config
+
+	conn         Conn
+	connID       string
+	registeredAt time.Time
+	streams      sync.WaitGroup
+	draining     bool
+	regions      map[string]string
+	capacity     *proto.Capacity
+	mu           sync.Mutex
+	// Keeps region and capacity updates in order.
+	notifyMu sync.Mutex
 }
 
 func NewDialer(
 	config DialerConfig,
+	logger *slog.Logger,
 	streamHandler DialerStreamHandleFunc,
 ) *Dialer {
+	if config.QUIC == (QUICConfig{}) {
+		config.QUIC = DefaultQUICConfig()
+	}
+	if config.Proxy == nil {
+		config.Proxy = http.ProxyFromEnvironment
+	}
+
+	tlsConfig := TlsClientConfig.Clone()
+	if config.QUIC.Allow0RTT {
+		// Resuming a session from an earlier connection is what allows
+		// sending 0-RTT data on redial.
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+
 	return &Dialer{
 		config:        config,
+		logger:        logging.OrDefault(logger).With(logging.KeyRemote, config.Addr),
 		streamHandler: streamHandler,
+		tlsConfig:     tlsConfig,
+		regions:       config.Regions,
 	}
 }
 
+// Connects to the listener and handles its streams until the connection
+// is closed. Returns nil if the connection was closed by Shutdown.
 func (s *Dialer) Dial(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	conn, err := quic.DialAddrEarly(
-		ctx, s.config.Addr,
-		TlsClientConfig.Clone(),
-		&quic.Config{
-			MaxIncomingStreams: 100_000,
-		},
-	)
+	conn, err := s.dial(ctx)
 	if err != nil {
 		return err
 	}
 
+	if !s.setConn(conn) {
+		conn.CloseWithError(ErrorCodeShutdown, "shutdown")
+		return nil
+	}
+
 	configStream, err := conn.OpenStream()
 	if err != nil {
 		return err
 	}
 
-	transport, err := SyncTransport(
+	if creds := s.config.Credentials; creds != nil {
+		configStream, err = SyncTransport(configStream, successHandler, proto.NewMsgRelayAuth(creds.Name, creds.Secret))
+		if err != nil {
+			configStream.Close()
+			conn.CloseWithError(ErrorCodeNone, "")
+			return err
+		}
+	}
+
+	_, err = SyncTransport(
 		configStream,
 		s.handleConfig,
-		proto.NewMsgRelayHello(s.config.Regions),
+		proto.NewMsgRelayHello(s.getRegions()),
 	)
-	transport.Close()
+	configStream.Close()
 
 	if err != nil {
+		conn.CloseWithError(ErrorCodeNone, "")
 		return err
 	}
 
 	pingStream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		return err
+	}
 	go s.pong(pingStream, cancel)
 
+	// A new listener starts from the last advertised capacity.
+	if capacity := s.getCapacity(); capacity != nil {
+		go s.sendCapacity(conn, *capacity)
+	}
+
 	// Listen for new streams comming from the server.
-	return s.listenStreams(ctx, conn)
+	err = s.listenStreams(ctx, conn)
+	if s.isDraining() {
+		return nil
+	}
+	// Nothing closes a TCP connection whose pings stopped on its own.
+	conn.CloseWithError(ErrorCodeNone, "")
+	return err
+}
+
+func (s *Dialer) dial(ctx context.Context) (Conn, error) {
+	if s.config.Network == NetworkWebSocket {
+		return dialWebSocket(ctx, s.config.Addr, s.config.Proxy, s.tlsConfig, s.config.QUIC)
+	}
+	if !s.config.Network.quic() {
+		return dialTCP(ctx, s.config.Addr, s.tlsConfig, s.config.QUIC)
+	}
+
+	conn, err := quic.DialAddrEarly(
+		ctx, s.config.Addr,
+		s.tlsConfig,
+		s.config.QUIC.quicConfig(),
+	)
+	if err == nil || !s.config.Network.tcp() || ctx.Err() != nil {
+		return conn, err
+	}
+
+	s.logger.Warn("QUIC dial failed, falling back to TCP", logging.Err(err))
+	return dialTCP(ctx, s.config.Addr, s.tlsConfig, s.config.QUIC)
+}
+
+// Connects to the listener without registering and returns how long the
+// handshake took, which is a round trip or two depending on the network.
+// The listener ignores the connection.
+func (s *Dialer) Probe(ctx context.Context) (time.Duration, error) {
+	started := time.Now()
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(started)
+	conn.CloseWithError(ErrorCodeProbe, "probe")
+	return rtt, nil
+}
+
+// Notifies the listener that this node is draining, so it stops routing
+// new streams here, waits for active streams until ctx is done and closes
+// the connection.
+func (s *Dialer) Shutdown(ctx context.Context) error {
+	conn := s.drain()
+	if conn == nil {
+		return nil
+	}
+
+	if err := s.notify(conn, proto.NewMsgDrain()); err != nil {
+		s.logger.Warn("Failed to send drain notice", logging.Err(err))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.streams.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Warn("Drain deadline reached, closing active streams")
+	}
+
+	return conn.CloseWithError(ErrorCodeShutdown, "shutdown")
+}
+
+// Replaces the regions this node serves, on the current conn and in the
+// hello of later ones. No regions keep the conn open but take the node out
+// of every region.
+func (s *Dialer) SetRegions(regions map[string]string) error {
+	s.mu.Lock()
+	s.regions = regions
+	conn, draining := s.conn, s.draining
+	s.mu.Unlock()
+
+	if conn == nil || draining {
+		return nil
+	}
+
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	// Whichever update came last is sent.
+	return s.notify(conn, proto.NewMsgRegions(s.getRegions()))
+}
+
+func (s *Dialer) getRegions() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.regions
+}
+
+// Advertises the capacity of this node to the listener, now and after
+// every reconnect.
+func (s *Dialer) SetCapacity(capacity proto.Capacity) error {
+	s.mu.Lock()
+	s.capacity = &capacity
+	conn, draining := s.conn, s.draining
+	s.mu.Unlock()
+
+	if conn == nil || draining {
+		return nil
+	}
+	return s.sendCapacity(conn, capacity)
+}
+
+func (s *Dialer) sendCapacity(conn Conn, capacity proto.Capacity) error {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	// An update sent meanwhile is newer than this one.
+	if current := s.getCapacity(); current != nil && *current != capacity {
+		return nil
+	}
+	return s.notify(conn, proto.NewMsgCapacity(capacity))
+}
+
+func (s *Dialer) getCapacity() *proto.Capacity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.capacity
+}
+
+func (s *Dialer) setConn(conn Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.conn = conn
+	s.connID = ""
+	return true
+}
+
+func (s *Dialer) setRegistered(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connID = id
+	s.registeredAt = time.Now()
+}
+
+func (s *Dialer) Status() DialerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return DialerStatus{
+		Addr:         s.config.Addr,
+		Connected:    s.connID != "" && s.conn.Context().Err() == nil,
+		ConnID:       s.connID,
+		RegisteredAt: s.registeredAt,
+		Draining:     s.draining,
+	}
+}
+
+func (s *Dialer) drain() Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = true
+	return s.conn
+}
+
+func (s *Dialer) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.draining
+}
+
+// Streams can only be added before draining starts, so that waiting for
+// them in Shutdown is not racing with new ones.
+func (s *Dialer) trackStream() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.streams.Add(1)
+	return true
+}
+
+func (s *Dialer) notify(conn Conn, msg proto.Message) error {
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = SyncTransport(stream, successHandler, msg)
+	return err
 }
 
 func (s *Dialer) handleConfig(w transport.ResponseWriter, r proto.Message) error {
@@ -76,41 +363,56 @@ func (s *Dialer) handleConfig(w transport.ResponseWriter, r proto.Message) error
 		return err
 	}
 
+	if proto.MsgError == mt {
+		return errors.New(id)
+	}
 	if proto.MsgRelayConfig != mt {
-		errors.New("Wrong protocol message")
+		return errors.New("Wrong protocol message")
 	}
 
-	log.Println("Got id from stream: ", id)
+	s.logger.Info("Registered with listener", logging.KeyConn, id)
+	s.setRegistered(id)
+	if s.config.OnRegister != nil {
+		s.config.OnRegister(id)
+	}
 	return nil
 }
 
-func (s *Dialer) listenStreams(ctx context.Context, conn quic.Connection) error {
+func (s *Dialer) listenStreams(ctx context.Context, conn Conn) error {
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
 			return err
 		}
 
+		if !s.trackStream() {
+			stream.CancelRead(StreamErrorCodeDraining)
+			stream.CancelWrite(StreamErrorCodeDraining)
+			continue
+		}
+
 		go func() {
+			defer s.streams.Done()
 			if err := s.streamHandler(stream); err != nil {
-				log.Print(err)
+				s.logger.Debug("Stream closed with error", logging.Err(err))
 			}
 		}()
 	}
 }
 
 func (s *Dialer) pong(pingStream quic.Stream, cancel context.CancelFunc) error {
-	pingStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	t := transport.NewTransport(pingStream, pingHandler)
+	pingStream.SetReadDeadline(time.Now().Add(s.config.QUIC.PingTimeout))
 
-	if _, err := SyncTransport(pingStream, pingHandler, nil); err != nil {
+	if err := t.Sync(); err != nil {
 		return err
 	}
 
 	go func() {
 		defer cancel()
 		for {
-			pingStream.SetReadDeadline(time.Now().Add(5 * time.Second))
-			if _, err := SyncTransport(pingStream, pingHandler, nil); err != nil {
+			pingStream.SetReadDeadline(time.Now().Add(s.config.QUIC.PingTimeout))
+			if err := t.Sync(); err != nil {
 				return
 			}
 		}
@@ -129,6 +431,22 @@ func pingHandler(w transport.ResponseWriter, r proto.Message) error {
 		return errors.New("Wrong protocol message")
 	}
 
-	w.Write(proto.NewMsgPing(id))
+	return w.Write(proto.NewMsgPing(id))
+}
+
+func successHandler(w transport.ResponseWriter, r proto.Message) error {
+	mt, body, err := r.UnmarshalString()
+	if err != nil {
+		return err
+	}
+
+	if proto.MsgError == mt {
+		return errors.New(body)
+	}
+
+	if proto.MsgSuccess != mt {
+		return errors.New("Wrong protocol message")
+	}
+
 	return nil
 }
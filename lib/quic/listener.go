@@ -2,169 +2,535 @@ package quic
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/mux"
 	proto "github.com/bacv/kingip/lib/proto"
 	"github.com/bacv/kingip/lib/transport"
 	"github.com/quic-go/quic-go"
 )
 
-type ListenerRegisterHandleFunc func(quic.Connection) (uint64, <-chan error, error)
+var ErrorUnauthenticated = errors.New("Credentials required")
+
+type ListenerRegisterHandleFunc func(Conn, *Peer) (uint64, <-chan error, error)
 type ListenerRegionsHandleFunc func(uint64, map[string]string) error
+type ListenerDrainHandleFunc func(uint64)
+type ListenerCapacityHandleFunc func(uint64, proto.Capacity)
 type ListenerCloseHandleFunc func(uint64)
 
+// Peer is what a listener knows about the dialer of a conn.
+type Peer struct {
+	// Name the dialer authenticated with, empty if it sent no credentials.
+	Name        string
+	ConnectedAt time.Time
+	rtt         atomic.Int64
+}
+
+// Returns the round trip time of the last ping.
+func (p *Peer) RTT() time.Duration {
+	return time.Duration(p.rtt.Load())
+}
+
 type ListenerConfig struct {
-	Addr string
+	// Listens on this address for both QUIC over UDP and TCP. TLS conns on
+	// TCP that do not negotiate the KingIP protocol are served as HTTPS,
+	// with a WebSocket at WebSocketPath.
+	Addr    string
+	Network Network
+	// The zero value uses DefaultQUICConfig.
+	QUIC QUICConfig
+	// Checks the credentials of dialers, nil accepts any dialer.
+	Authenticate func(name, secret string) error
 }
 
 type Listener struct {
+	ctx             context.Context
 	config          ListenerConfig
+	logger          *slog.Logger
 	registerHandler ListenerRegisterHandleFunc
 	regionsHandler  ListenerRegionsHandleFunc
+	drainHandler    ListenerDrainHandleFunc
+	capacityHandler ListenerCapacityHandleFunc
 	closeHandler    ListenerCloseHandleFunc
+
+	tlsConfig   *tls.Config
+	transport   *quic.Transport
+	listener    acceptor
+	tcpListener net.Listener
+	httpConns   *connListener
+	conns       map[Conn]struct{}
+	stopped     bool
+	mu          sync.Mutex
 }
 
 func NewListener(
 	ctx context.Context,
 	config ListenerConfig,
+	logger *slog.Logger,
 	registerHandler ListenerRegisterHandleFunc,
 	regionsHandler ListenerRegionsHandleFunc,
+	drainHandler ListenerDrainHandleFunc,
+	// May be nil for listeners whose dialers advertise no capacity.
+	capacityHandler ListenerCapacityHandleFunc,
 	closeHandler ListenerCloseHandleFunc,
 ) *Listener {
+	if config.QUIC == (QUICConfig{}) {
+		config.QUIC = DefaultQUICConfig()
+	}
+	// HTTPS clients and proxies get the WebSocket endpoint.
+	tlsConfig := GenerateTLSConfig()
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "http/1.1")
+
 	return &Listener{
+		ctx:             ctx,
 		config:          config,
+		logger:          logging.OrDefault(logger).With(logging.KeyAddr, config.Addr),
 		registerHandler: registerHandler,
 		regionsHandler:  regionsHandler,
+		drainHandler:    drainHandler,
+		capacityHandler: capacityHandler,
 		closeHandler:    closeHandler,
+		tlsConfig:       tlsConfig,
+		conns:           make(map[Conn]struct{}),
 	}
 }
 
+// Accepts connections until the listener is stopped or its context is done.
 func (s *Listener) Listen() error {
-	listener, err := quic.ListenAddr(s.config.Addr, GenerateTLSConfig(), &quic.Config{
-		MaxIncomingStreams: 100_000,
-	})
+	listener, tcpListener, err := s.listen()
 	if err != nil {
 		return err
 	}
+
+	// Accepting over TCP is not interrupted by the context.
+	stop := context.AfterFunc(s.ctx, s.Stop)
+	defer stop()
+
+	if listener == nil {
+		return s.serveTCP(tcpListener)
+	}
+	if tcpListener != nil {
+		go s.serveTCP(tcpListener)
+	}
+
 	for {
-		conn, err := listener.Accept(context.Background())
+		conn, err := listener.Accept(s.ctx)
 		if err != nil {
-			log.Println("Unable to accept conn: ", err)
+			if errors.Is(err, quic.ErrServerClosed) || s.ctx.Err() != nil {
+				return nil
+			}
+			s.logger.Warn("Unable to accept conn", logging.Err(err))
 			continue
 		}
 
+		s.track(conn)
 		go s.acceptConn(conn)
 	}
 }
 
-func (s *Listener) acceptConn(conn quic.Connection) {
+// Stops accepting new connections, established ones are not affected.
+func (s *Listener) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+		s.httpConns.Close()
+	}
+}
+
+// Stops the listener and closes all established connections.
+func (s *Listener) Close() error {
+	s.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.CloseWithError(ErrorCodeShutdown, "shutdown")
+	}
+	if s.transport != nil {
+		return s.transport.Close()
+	}
+	return nil
+}
+
+// Accepts connections from a listener that may hand them out before the
+// handshake is complete.
+type acceptor interface {
+	Accept(context.Context) (quic.Connection, error)
+	Close() error
+}
+
+type earlyListener struct {
+	*quic.EarlyListener
+}
+
+func (l earlyListener) Accept(ctx context.Context) (quic.Connection, error) {
+	return l.EarlyListener.Accept(ctx)
+}
+
+func (s *Listener) listen() (acceptor, net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil, nil, quic.ErrServerClosed
+	}
+
+	if s.config.Network.tcp() {
+		ln, err := net.Listen("tcp", s.config.Addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.tcpListener = ln
+		s.httpConns = newConnListener(ln.Addr())
+	}
+	if !s.config.Network.quic() {
+		return nil, s.tcpListener, nil
+	}
+
+	listener, err := s.listenQUIC()
+	if err != nil {
+		if s.tcpListener != nil {
+			s.tcpListener.Close()
+			s.httpConns.Close()
+		}
+		return nil, nil, err
+	}
+	return listener, s.tcpListener, nil
+}
+
+func (s *Listener) listenQUIC() (acceptor, error) {
+	addr, err := net.ResolveUDPAddr("udp", s.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listening on our own transport lets established connections outlive
+	// the listener, so they can be drained after it stops.
+	s.transport = &quic.Transport{Conn: udpConn}
+	// 0-RTT data is only accepted by an early listener.
+	if s.config.QUIC.Allow0RTT {
+		var ln *quic.EarlyListener
+		ln, err = s.transport.ListenEarly(s.tlsConfig, s.config.QUIC.quicConfig())
+		if err == nil {
+			s.listener = earlyListener{ln}
+		}
+	} else {
+		s.listener, err = s.transport.Listen(s.tlsConfig, s.config.QUIC.quicConfig())
+	}
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	return s.listener, nil
+}
+
+// Accepts connections over TCP with TLS from dialers that can not reach
+// the listener over QUIC.
+func (s *Listener) serveTCP(ln net.Listener) error {
+	go s.serveHTTP()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.logger.Warn("Unable to accept TCP conn", logging.Err(err))
+			continue
+		}
+
+		go func() {
+			tlsConn, err := handshakeTCP(s.ctx, conn, s.tlsConfig, s.config.QUIC)
+			if err != nil {
+				s.logger.Debug("TLS handshake failed", logging.KeyRemote, conn.RemoteAddr().String(), logging.Err(err))
+				return
+			}
+			if tlsConn.ConnectionState().NegotiatedProtocol != proto.KingIP {
+				s.httpConns.push(tlsConn)
+				return
+			}
+
+			s.serveMux(tlsConn)
+		}()
+	}
+}
+
+// Serves WebSocket conns of dialers that can only reach the listener over
+// HTTPS, possibly through a proxy.
+func (s *Listener) serveHTTP() {
+	server := &http.Server{
+		Handler:           webSocketHandler(s.serveMux),
+		ReadHeaderTimeout: s.config.QUIC.handshakeTimeout(),
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelDebug),
+	}
+	server.Serve(s.httpConns)
+}
+
+// Handles a multiplexed conn until it is closed.
+func (s *Listener) serveMux(conn net.Conn) {
+	session := mux.New(conn, false, s.config.QUIC.muxConfig())
+	s.track(session)
+	s.acceptConn(session)
+}
+
+func (s *Listener) track(conn Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Listener) untrack(conn Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *Listener) acceptConn(conn Conn) {
+	defer s.untrack(conn)
+	logger := s.logger.With(logging.KeyRemote, conn.RemoteAddr().String())
+
 	pingStream, err := conn.OpenStream()
 	if err != nil {
-		log.Println("Failed to open ping stream: ", err)
+		logger.Warn("Failed to open ping stream", logging.Err(err))
+		conn.CloseWithError(ErrorCodeNone, "")
 		return
 	}
 
-	id, stopC, err := s.handleConn(conn)
+	peer := &Peer{ConnectedAt: time.Now()}
+	id, stopC, err := s.handleConn(logger, conn, peer)
+	if isProbe(err) {
+		logger.Debug("Probed by dialer")
+		return
+	}
 	if err != nil {
-		log.Println("Failed to handle conn: ", err)
+		logger.Warn("Failed to handle conn", logging.Err(err))
+		conn.CloseWithError(ErrorCodeNone, "")
 		return
 	}
+	logger = logger.With(logging.KeyConn, fmt.Sprint(id))
 
-	pingC, err := s.ping(id, pingStream)
+	pingC, err := s.ping(id, pingStream, peer)
 	if err != nil {
-		log.Println("Failed to spawn ping", err)
+		logger.Warn("Failed to spawn ping", logging.Err(err))
+		s.closeHandler(id)
+		conn.CloseWithError(ErrorCodePingTimeout, "ping failed")
 		return
 	}
 
+	go s.acceptStreams(logger, id, conn)
+
 	select {
+	case <-conn.Context().Done():
+		logger.Info("Conn closed", logging.Err(context.Cause(conn.Context())))
 	case <-pingC:
-		log.Println("Ping timeout")
+		logger.Warn("Ping timeout")
+		conn.CloseWithError(ErrorCodePingTimeout, "ping timeout")
 	case err := <-stopC:
 		if err != nil {
-			log.Println("Relay closed with err: ", err)
+			logger.Warn("Conn stopped", logging.Err(err))
 		}
+		conn.CloseWithError(ErrorCodeNone, "")
 	}
 
 	s.closeHandler(id)
 }
 
-func (s *Listener) handleConn(conn quic.Connection) (uint64, <-chan error, error) {
+// Handles control messages on streams opened by the dialer.
+func (s *Listener) acceptStreams(logger *slog.Logger, id uint64, conn Conn) {
 	for {
-		helloStream, err := conn.AcceptStream(context.Background())
-		defer helloStream.Close()
-
+		stream, err := conn.AcceptStream(conn.Context())
 		if err != nil {
-			return 0, nil, err
+			return
 		}
 
-		id, stopC, err := s.registerHandler(conn)
-		if err != nil {
-			return 0, nil, err
-		}
+		go func() {
+			defer stream.Close()
+
+			_, err := SyncTransport(stream, func(w transport.ResponseWriter, r proto.Message) error {
+				mt, err := r.Type()
+				if err != nil {
+					return err
+				}
+
+				switch mt {
+				case proto.MsgDrain:
+					logger.Info("Draining conn")
+					s.drainHandler(id)
+				case proto.MsgRegions:
+					_, regions, err := r.UnmarshalMap()
+					if err != nil {
+						w.Write(proto.NewMsgError(err.Error()))
+						return err
+					}
+					logger.Info("Regions changed", logging.KeyRegions, regions)
+					if err := s.regionsHandler(id, regions); err != nil {
+						w.Write(proto.NewMsgError(err.Error()))
+						return err
+					}
+				case proto.MsgCapacity:
+					capacity, err := r.UnmarshalCapacity()
+					if err != nil {
+						w.Write(proto.NewMsgError(err.Error()))
+						return err
+					}
+					logger.Debug("Capacity changed", "available", capacity.Available, "sessions", capacity.Sessions, "bandwidth", capacity.Bandwidth)
+					if s.capacityHandler != nil {
+						s.capacityHandler(id, capacity)
+					}
+				default:
+					w.Write(proto.NewMsgError("Wrong protocol message"))
+					return errors.New("Wrong protocol message")
+				}
+
+				return w.Write(proto.NewMsgSuccess())
+			}, nil)
+			if err != nil && err != io.EOF {
+				logger.Warn("Failed to handle control stream", logging.Err(err))
+			}
+		}()
+	}
+}
 
-		// Receive first stream from dialer.
-		if err := s.handleHelloStream(id, helloStream); err != nil && err != io.EOF {
-			return 0, nil, err
-		}
+func (s *Listener) handleConn(logger *slog.Logger, conn Conn, peer *Peer) (uint64, <-chan error, error) {
+	helloStream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer helloStream.Close()
 
-		// Wait until handler finishes.
-		return id, stopC, nil
+	// Nothing is registered for a dialer that fails to authenticate.
+	t := transport.NewTransport(helloStream, nil)
+	hello, err := s.authenticate(t, peer)
+	if err != nil {
+		// Closing the conn right away could drop the error before the
+		// dialer reads it, so wait for the dialer to hang up.
+		helloStream.Close()
+		helloStream.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(io.Discard, helloStream)
+		return 0, nil, err
 	}
+
+	id, stopC, err := s.registerHandler(conn, peer)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := s.handleHello(logger.With(logging.KeyConn, fmt.Sprint(id)), id, t, hello); err != nil {
+		s.closeHandler(id)
+		return 0, nil, err
+	}
+
+	// Wait until handler finishes.
+	return id, stopC, nil
 }
 
-func (s *Listener) handleHelloStream(id uint64, stream quic.Stream) error {
-	handleHello := func(w transport.ResponseWriter, r proto.Message) error {
-		mt, regions, err := r.UnmarshalMap()
-		if err != nil {
-			return err
-		}
+// Reads the first message of a dialer, which carries its credentials if it
+// has any, and returns the hello that follows. The name of the dialer is
+// set on peer.
+func (s *Listener) authenticate(t *transport.Transport, peer *Peer) (proto.Message, error) {
+	msg, err := t.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
 
-		if proto.MsgRelayHello != mt {
-			log.Println("Wrong protocol message")
+	mt, err := msg.Type()
+	if err != nil {
+		return nil, err
+	}
+	if mt != proto.MsgRelayAuth {
+		if s.config.Authenticate != nil {
+			t.Write(proto.NewMsgError(ErrorUnauthenticated.Error()))
+			return nil, ErrorUnauthenticated
 		}
+		return msg, nil
+	}
 
-		s.regionsHandler(id, regions)
-		log.Println("Got id with regions: ", regions)
-		w.Write(proto.NewMsgRelayConfig(fmt.Sprint(id)))
-		return nil
+	name, secret, err := msg.UnmarshalRelayAuth()
+	if err == nil && s.config.Authenticate != nil {
+		err = s.config.Authenticate(name, secret)
+	}
+	if err != nil {
+		t.Write(proto.NewMsgError(err.Error()))
+		return nil, err
 	}
 
-	_, err := SyncTransport(
-		stream,
-		handleHello,
-		nil,
-	)
+	if err := t.Write(proto.NewMsgSuccess()); err != nil {
+		return nil, err
+	}
+	peer.Name = name
+	return t.ReadMessage()
+}
 
+func (s *Listener) handleHello(logger *slog.Logger, id uint64, w transport.ResponseWriter, r proto.Message) error {
+	mt, regions, err := r.UnmarshalMap()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if proto.MsgRelayHello != mt {
+		logger.Warn("Wrong protocol message", "type", mt)
+	}
+
+	s.regionsHandler(id, regions)
+	logger.Info("Registered conn", logging.KeyRegions, regions)
+	return w.Write(proto.NewMsgRelayConfig(fmt.Sprint(id)))
 }
 
-func (s *Listener) ping(id uint64, pingStream quic.Stream) (<-chan struct{}, error) {
+func (s *Listener) ping(id uint64, pingStream quic.Stream, peer *Peer) (<-chan struct{}, error) {
 	stopC := make(chan struct{})
-	pingStream.SetReadDeadline(time.Now().Add(time.Second))
+	t := transport.NewTransport(pingStream, pongHandler)
+	exchange := func() error {
+		start := time.Now()
+		if err := t.Write(proto.NewMsgPing(fmt.Sprint(id))); err != nil {
+			return err
+		}
+		if err := t.Sync(); err != nil {
+			return err
+		}
+		peer.rtt.Store(int64(time.Since(start)))
+		return nil
+	}
+	pingStream.SetReadDeadline(time.Now().Add(s.config.QUIC.PingTimeout))
 
 	// First ping needs to be sent right away to "claim" this stream.
-	if _, err := SyncTransport(pingStream, pingHandler, proto.NewMsgPing(fmt.Sprint(id))); err != nil {
+	if err := exchange(); err != nil {
 		return nil, err
 	}
 
 	go func() {
 		defer close(stopC)
-		ticker := time.NewTicker(time.Second)
+		ticker := time.NewTicker(s.config.QUIC.PingInterval)
 		defer ticker.Stop()
 
 		for {
 			<-ticker.C
 
-			pingStream.SetReadDeadline(time.Now().Add(5 * time.Second))
-			if _, err := SyncTransport(pingStream, pongHandler, proto.NewMsgPing(fmt.Sprint(id))); err != nil {
+			pingStream.SetReadDeadline(time.Now().Add(s.config.QUIC.PingTimeout))
+			if err := exchange(); err != nil {
 				return
 			}
 		}
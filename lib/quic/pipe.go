@@ -0,0 +1,36 @@
+package quic
+
+import (
+	"github.com/bacv/kingip/lib/pipe"
+	"github.com/quic-go/quic-go"
+)
+
+type streamEnd struct {
+	quic.Stream
+}
+
+// StreamEnd adapts a stream to a pipe end. Aborting passes on the code of a
+// stream error, so resets keep their meaning across hops.
+func StreamEnd(stream quic.Stream) pipe.End {
+	return &streamEnd{Stream: stream}
+}
+
+// Closing a stream only closes its write direction.
+func (s *streamEnd) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *streamEnd) Abort(err error) {
+	code, ok := StreamErrorCodeOf(err)
+	if !ok {
+		code = StreamErrorCodeAborted
+	}
+	CancelStream(s.Stream, code)
+}
+
+// Stops the peer from sending more data, which is a no-op once EOF was
+// read.
+func (s *streamEnd) Close() error {
+	s.Stream.CancelRead(StreamErrorCodeNone)
+	return s.Stream.Close()
+}
@@ -1,16 +1,45 @@
 package quic
 
 import (
+	"bytes"
+	"io"
+
 	proto "github.com/bacv/kingip/lib/proto"
 	"github.com/bacv/kingip/lib/transport"
 	"github.com/quic-go/quic-go"
 )
 
-// Sends message, handles response and abandons the connection.
-func SyncTransport(stream quic.Stream, handler transport.HandleFunc, msg proto.Message) (*transport.Transport, error) {
-	transport := transport.NewTransport(stream, handler)
-	defer transport.Abandon()
+// Sends message, handles response and abandons the connection. The
+// returned stream reads any bytes that followed the response first.
+func SyncTransport(stream quic.Stream, handler transport.HandleFunc, msg proto.Message) (quic.Stream, error) {
+	t := transport.NewTransport(stream, handler)
+
+	if len(msg) > 0 {
+		if err := t.Write(msg); err != nil {
+			return AbandonTransport(stream, t), err
+		}
+	}
+	err := t.Sync()
+	return AbandonTransport(stream, t), err
+}
+
+// Abandons t and returns its stream for raw data copying.
+func AbandonTransport(stream quic.Stream, t *transport.Transport) quic.Stream {
+	leftover := t.Abandon()
+	if len(leftover) == 0 {
+		return stream
+	}
+	return &bufferedStream{
+		Stream: stream,
+		reader: io.MultiReader(bytes.NewReader(leftover), stream),
+	}
+}
+
+type bufferedStream struct {
+	quic.Stream
+	reader io.Reader
+}
 
-	transport.Write(msg)
-	return transport, transport.Sync()
+func (s *bufferedStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
 }
@@ -0,0 +1,213 @@
+package quic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/mux"
+	"golang.org/x/net/websocket"
+)
+
+// Path of the WebSocket that carries connections between tiers over HTTPS.
+const WebSocketPath = "/kingip"
+
+var ErrorProxyScheme = errors.New("Only http proxies are supported")
+
+// Reports the address of the peer instead of the WebSocket origin or
+// location.
+type webSocketConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c webSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Returns a handler that upgrades requests to WebSocket conns and passes
+// them to serve until it returns.
+func webSocketHandler(serve func(net.Conn)) http.Handler {
+	server := websocket.Server{
+		// Edges are no browsers, there is no origin to check.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			remote, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			if err != nil {
+				return
+			}
+			serve(webSocketConn{Conn: ws, remote: remote})
+		},
+	}
+
+	handler := http.NewServeMux()
+	handler.Handle(WebSocketPath, server)
+	return handler
+}
+
+// Connects to the WebSocket of the listener at addr over HTTPS, through the
+// HTTP proxy returned by proxy if there is one.
+func dialWebSocket(
+	ctx context.Context,
+	addr string,
+	proxy func(*http.Request) (*url.URL, error),
+	tlsConfig *tls.Config,
+	config QUICConfig,
+) (Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.handshakeTimeout())
+	defer cancel()
+
+	conn, err := dialProxy(ctx, addr, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	if host, _, err := net.SplitHostPort(addr); err == nil && tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	location := url.URL{Scheme: "wss", Host: addr, Path: WebSocketPath}
+	wsConfig, err := websocket.NewConfig(location.String(), "https://"+addr)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	// The WebSocket handshake only respects deadlines.
+	deadline, _ := ctx.Deadline()
+	tlsConn.SetDeadline(deadline)
+	ws, err := websocket.NewClient(wsConfig, tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	ws.PayloadType = websocket.BinaryFrame
+	return mux.New(webSocketConn{Conn: ws, remote: tlsConn.RemoteAddr()}, true, config.muxConfig()), nil
+}
+
+// Connects to addr, tunneling through an HTTP proxy with CONNECT if proxy
+// returns one for it.
+func dialProxy(ctx context.Context, addr string, proxy func(*http.Request) (*url.URL, error)) (net.Conn, error) {
+	var dialer net.Dialer
+
+	proxyURL, err := proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	if proxyURL.Scheme != "http" {
+		return nil, ErrorProxyScheme
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := connect(conn, addr, proxyURL.User); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func connect(conn net.Conn, addr string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Proxy refused to connect: %s", resp.Status)
+	}
+	// The listener waits for the TLS handshake, so nothing may follow.
+	if br.Buffered() > 0 {
+		return errors.New("Proxy sent data after the CONNECT response")
+	}
+	return nil
+}
+
+// Hands conns accepted elsewhere to an http.Server.
+type connListener struct {
+	addr   net.Addr
+	connC  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		connC:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.connC <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connC:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
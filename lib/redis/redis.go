@@ -0,0 +1,392 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrorNil      = errors.New("Redis nil reply")
+	ErrorProtocol = errors.New("Invalid Redis protocol data")
+	ErrorClosed   = errors.New("Redis client closed")
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Status is a simple string reply, such as OK.
+type Status string
+
+type Config struct {
+	Addr     string
+	Password string
+	DB       int
+	// Bounds dialing and every round trip without a context deadline.
+	Timeout time.Duration
+	// Idle connections kept for reuse.
+	MaxIdle int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:    "127.0.0.1:6379",
+		Timeout: 5 * time.Second,
+		MaxIdle: 8,
+	}
+}
+
+// Client sends commands to a server speaking the Redis protocol (RESP2)
+// over a pool of connections.
+type Client struct {
+	config Config
+	idle   []*conn
+	closed bool
+	mu     sync.Mutex
+}
+
+type conn struct {
+	net.Conn
+	rd *bufio.Reader
+	wr *bufio.Writer
+}
+
+func NewClient(config Config) *Client {
+	defaults := DefaultConfig()
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = defaults.MaxIdle
+	}
+	return &Client{config: config}
+}
+
+// Sends a command and returns its reply, which is nil, int64, string,
+// Status or []any. Error replies are returned as the error.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Sends commands in one round trip on one connection, which also keeps a
+// MULTI ... EXEC transaction together. Error replies are returned among
+// the replies.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	cn, pooled, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.roundTrip(ctx, cn, cmds)
+	if err != nil && pooled && isClosedByServer(err) {
+		// The server closed the idle connection, likely along with the
+		// others, before the commands reached it: retry on a new one.
+		cn.Close()
+		c.dropIdle()
+		if cn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+		replies, err = c.roundTrip(ctx, cn, cmds)
+	}
+	if err != nil {
+		// The connection may hold a partial reply.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+func isClosedByServer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func (c *Client) roundTrip(ctx context.Context, cn *conn, cmds [][]string) ([]any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.config.Timeout)
+	}
+	cn.SetDeadline(deadline)
+
+	for _, cmd := range cmds {
+		args := make([]any, len(cmd))
+		for i, arg := range cmd {
+			args[i] = arg
+		}
+		if err := WriteValue(cn.wr, args); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.wr.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := ReadValue(cn.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// Closes idle connections, those in use are closed when returned.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.closeIdle()
+	return nil
+}
+
+func (c *Client) dropIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeIdle()
+}
+
+func (c *Client) closeIdle() {
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+}
+
+// Returns an idle connection if any, reporting it as pooled, or a new one.
+func (c *Client) get(ctx context.Context) (*conn, bool, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, ErrorClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, true, nil
+	}
+	c.mu.Unlock()
+
+	cn, err := c.dial(ctx)
+	return cn, false, err
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || len(c.idle) >= c.config.MaxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Connects and selects the configured database, authenticating first if
+// a password is set.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.config.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, rd: bufio.NewReader(nc), wr: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.config.Password != "" {
+		setup = append(setup, []string{"AUTH", c.config.Password})
+	}
+	if c.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.config.DB)})
+	}
+	if len(setup) == 0 {
+		return cn, nil
+	}
+
+	replies, err := c.roundTrip(ctx, cn, setup)
+	if err == nil {
+		for _, reply := range replies {
+			if replyErr, ok := reply.(Error); ok {
+				err = replyErr
+				break
+			}
+		}
+	}
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Returns an integer reply.
+func Int(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply := reply.(type) {
+	case int64:
+		return reply, nil
+	case Error:
+		return 0, reply
+	case nil:
+		return 0, ErrorNil
+	}
+	return 0, fmt.Errorf("%w: unexpected %T reply", ErrorProtocol, reply)
+}
+
+// Returns a float sent as a bulk string, such as by INCRBYFLOAT.
+func Float(reply any, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply := reply.(type) {
+	case string:
+		return strconv.ParseFloat(reply, 64)
+	case int64:
+		return float64(reply), nil
+	case Error:
+		return 0, reply
+	case nil:
+		return 0, ErrorNil
+	}
+	return 0, fmt.Errorf("%w: unexpected %T reply", ErrorProtocol, reply)
+}
+
+// Returns an array of bulk strings, nil elements are returned as "".
+func Strings(reply any, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch reply := reply.(type) {
+	case []any:
+		values := make([]string, len(reply))
+		for i, v := range reply {
+			switch v := v.(type) {
+			case string:
+				values[i] = v
+			case int64:
+				values[i] = strconv.FormatInt(v, 10)
+			case nil:
+			default:
+				return nil, fmt.Errorf("%w: unexpected %T element", ErrorProtocol, v)
+			}
+		}
+		return values, nil
+	case Error:
+		return nil, reply
+	case nil:
+		return nil, ErrorNil
+	}
+	return nil, fmt.Errorf("%w: unexpected %T reply", ErrorProtocol, reply)
+}
+
+// Reads one value, see Client.Do for the types it may have.
+func ReadValue(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrorProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return Status(line), nil
+	case '-':
+		return Error(line), nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, ErrorProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrorProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[n:]) != "\r\n" {
+			return nil, ErrorProtocol
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrorProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = ReadValue(rd); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, ErrorProtocol
+}
+
+// Writes a value, strings are written as bulk strings.
+func WriteValue(wr *bufio.Writer, v any) error {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		_, err = wr.WriteString("$-1\r\n")
+	case Status:
+		_, err = fmt.Fprintf(wr, "+%s\r\n", v)
+	case Error:
+		_, err = fmt.Fprintf(wr, "-%s\r\n", v)
+	case int64:
+		_, err = fmt.Fprintf(wr, ":%d\r\n", v)
+	case int:
+		_, err = fmt.Fprintf(wr, ":%d\r\n", v)
+	case string:
+		_, err = fmt.Fprintf(wr, "$%d\r\n%s\r\n", len(v), v)
+	case []any:
+		if _, err = fmt.Fprintf(wr, "*%d\r\n", len(v)); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err := WriteValue(wr, elem); err != nil {
+				return err
+			}
+		}
+	default:
+		err = fmt.Errorf("Unsupported Redis value %T", v)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	values := []any{
+		nil,
+		Status("OK"),
+		Error("ERR wrong"),
+		int64(-42),
+		"",
+		"line\r\nbreak",
+		[]any{"a", int64(1), nil, []any{Status("QUEUED")}},
+	}
+
+	var buf bytes.Buffer
+	wr := bufio.NewWriter(&buf)
+	for _, v := range values {
+		assert.NoError(t, WriteValue(wr, v))
+	}
+	wr.Flush()
+
+	rd := bufio.NewReader(&buf)
+	for _, v := range values {
+		read, err := ReadValue(rd)
+		assert.NoError(t, err)
+		assert.Equal(t, v, read)
+	}
+}
+
+func TestReadValueInvalid(t *testing.T) {
+	for _, data := range []string{"?x\r\n", ":1x\r\n", "$3\r\nabcd\r\n", "+OK\n"} {
+		_, err := ReadValue(bufio.NewReader(strings.NewReader(data)))
+		assert.ErrorIs(t, err, ErrorProtocol, data)
+	}
+}
+
+// Answers every command with its arguments joined by spaces, and fails
+// commands named FAIL.
+func serveJoin(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd, wr := bufio.NewReader(conn), bufio.NewWriter(conn)
+				for {
+					value, err := ReadValue(rd)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range value.([]any) {
+						args = append(args, arg.(string))
+					}
+					var reply any = strings.Join(args, " ")
+					switch args[0] {
+					case "FAIL":
+						reply = Error("ERR failed")
+					case "AUTH":
+						reply = Status("OK")
+					}
+					WriteValue(wr, reply)
+					wr.Flush()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	client := NewClient(Config{Addr: serveJoin(t), Password: "secret"})
+	defer client.Close()
+
+	reply, err := client.Do(context.Background(), "ECHO", "hello world")
+	assert.NoError(t, err)
+	assert.Equal(t, "ECHO hello world", reply)
+
+	_, err = client.Do(context.Background(), "FAIL")
+	assert.Equal(t, Error("ERR failed"), err)
+
+	replies, err := client.Pipeline(context.Background(), []string{"A"}, []string{"FAIL"}, []string{"B", "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"A", Error("ERR failed"), "B 1"}, replies)
+
+	client.Close()
+	_, err = client.Do(context.Background(), "PING")
+	assert.ErrorIs(t, err, ErrorClosed)
+}
+
+func TestReplyHelpers(t *testing.T) {
+	n, err := Int(int64(3), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	_, err = Int(nil, nil)
+	assert.ErrorIs(t, err, ErrorNil)
+
+	f, err := Float("1.5", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, f)
+
+	_, err = Float(Error("ERR"), nil)
+	assert.Equal(t, Error("ERR"), err)
+
+	values, err := Strings([]any{"a", nil, int64(2)}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "", "2"}, values)
+}
@@ -0,0 +1,450 @@
+// Package redistest provides an in-process server speaking the Redis
+// protocol, for tests of code that uses a Redis store.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/redis"
+)
+
+var (
+	errorWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errorSyntax    = redis.Error("ERR syntax error")
+	errorNotInt    = redis.Error("ERR value is not an integer or out of range")
+	errorNotFloat  = redis.Error("ERR value is not a valid float")
+)
+
+type entry struct {
+	str     *string
+	hash    map[string]string
+	expires time.Time
+}
+
+// Server keeps strings and hashes in memory and supports the commands used
+// in this module. Keys expire on a clock that only moves with FastForward.
+type Server struct {
+	// Required with AUTH if set.
+	Password string
+
+	ln    net.Listener
+	data  map[string]*entry
+	now   time.Time
+	conns map[net.Conn]struct{}
+	down  bool
+	mu    sync.Mutex
+}
+
+// Starts a server on a local port, which is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		ln:    ln,
+		data:  make(map[string]*entry),
+		now:   time.Now(),
+		conns: make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Moves the clock of the server, expiring keys whose TTL passed.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = s.now.Add(d)
+}
+
+// Makes the server drop its connections and refuse commands, as if it
+// was unreachable, until it is set up again.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.down = down
+	if down {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+}
+
+// Returns a string value, false if the key is missing.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil || e.str == nil {
+		return "", false
+	}
+	return *e.str, true
+}
+
+// Returns a copy of a hash, nil if the key is missing.
+func (s *Server) Hash(key string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil || e.hash == nil {
+		return nil
+	}
+	hash := make(map[string]string, len(e.hash))
+	for field, value := range e.hash {
+		hash[field] = value
+	}
+	return hash
+}
+
+func (s *Server) Close() {
+	s.ln.Close()
+	s.SetDown(true)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.down {
+			conn.Close()
+		} else {
+			s.conns[conn] = struct{}{}
+			go s.handle(conn)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	rd, wr := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authed := false
+	var queue [][]string
+	inMulti := false
+
+	for {
+		value, err := redis.ReadValue(rd)
+		if err != nil {
+			return
+		}
+		args, ok := commandArgs(value)
+		if !ok {
+			return
+		}
+		name := strings.ToUpper(args[0])
+
+		var reply any
+		switch {
+		case name == "AUTH":
+			if len(args) == 2 && args[1] == s.Password {
+				authed = true
+				reply = redis.Status("OK")
+			} else {
+				reply = redis.Error("WRONGPASS invalid password")
+			}
+		case s.Password != "" && !authed:
+			reply = redis.Error("NOAUTH Authentication required")
+		case name == "MULTI":
+			inMulti, queue = true, nil
+			reply = redis.Status("OK")
+		case name == "DISCARD":
+			inMulti, queue = false, nil
+			reply = redis.Status("OK")
+		case name == "EXEC":
+			if !inMulti {
+				reply = redis.Error("ERR EXEC without MULTI")
+				break
+			}
+			reply = s.exec(queue...)
+			inMulti, queue = false, nil
+		case inMulti:
+			queue = append(queue, args)
+			reply = redis.Status("QUEUED")
+		default:
+			reply = s.exec(args)[0]
+		}
+
+		if err := redis.WriteValue(wr, reply); err != nil {
+			return
+		}
+		if rd.Buffered() == 0 {
+			if err := wr.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func commandArgs(value any) ([]string, bool) {
+	values, ok := value.([]any)
+	if !ok || len(values) == 0 {
+		return nil, false
+	}
+	args := make([]string, len(values))
+	for i, v := range values {
+		if args[i], ok = v.(string); !ok {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// Runs commands atomically.
+func (s *Server) exec(cmds ...[]string) []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replies := make([]any, len(cmds))
+	for i, args := range cmds {
+		if s.down {
+			replies[i] = redis.Error("ERR server down")
+			continue
+		}
+		replies[i] = s.run(strings.ToUpper(args[0]), args[1:])
+	}
+	return replies
+}
+
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !s.now.Before(e.expires) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+func (s *Server) run(name string, args []string) any {
+	switch name {
+	case "PING":
+		return redis.Status("PONG")
+	case "SELECT":
+		return redis.Status("OK")
+	case "GET":
+		if len(args) != 1 {
+			return errorSyntax
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return nil
+		}
+		if e.str == nil {
+			return errorWrongType
+		}
+		return *e.str
+	case "SET":
+		return s.set(args)
+	case "DEL", "EXISTS":
+		var n int64
+		for _, key := range args {
+			if s.lookup(key) != nil {
+				n++
+				if name == "DEL" {
+					delete(s.data, key)
+				}
+			}
+		}
+		return n
+	case "MGET":
+		values := make([]any, len(args))
+		for i, key := range args {
+			if e := s.lookup(key); e != nil && e.str != nil {
+				values[i] = *e.str
+			}
+		}
+		return values
+	case "INCRBYFLOAT":
+		return s.incrByFloat(args)
+	case "PEXPIRE":
+		if len(args) != 2 {
+			return errorSyntax
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errorNotInt
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return int64(0)
+		}
+		e.expires = s.now.Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	case "HINCRBY":
+		return s.hincrBy(args)
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errorSyntax
+		}
+		hash, ok := s.hash(args[0], true)
+		if !ok {
+			return errorWrongType
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return added
+	case "HDEL":
+		if len(args) < 2 {
+			return errorSyntax
+		}
+		hash, ok := s.hash(args[0], false)
+		if !ok {
+			return errorWrongType
+		}
+		if hash == nil {
+			return int64(0)
+		}
+		var removed int64
+		for _, field := range args[1:] {
+			if _, ok := hash[field]; ok {
+				delete(hash, field)
+				removed++
+			}
+		}
+		if len(hash) == 0 {
+			delete(s.data, args[0])
+		}
+		return removed
+	case "HGETALL":
+		if len(args) != 1 {
+			return errorSyntax
+		}
+		hash, ok := s.hash(args[0], false)
+		if !ok {
+			return errorWrongType
+		}
+		values := make([]any, 0, 2*len(hash))
+		for field, value := range hash {
+			values = append(values, field, value)
+		}
+		return values
+	}
+	return redis.Error(fmt.Sprintf("ERR unknown command '%s'", name))
+}
+
+// SET key value [PX ms | EX s]
+func (s *Server) set(args []string) any {
+	if len(args) != 2 && len(args) != 4 {
+		return errorSyntax
+	}
+
+	e := &entry{str: &args[1]}
+	if len(args) == 4 {
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return errorNotInt
+		}
+		switch strings.ToUpper(args[2]) {
+		case "PX":
+			e.expires = s.now.Add(time.Duration(n) * time.Millisecond)
+		case "EX":
+			e.expires = s.now.Add(time.Duration(n) * time.Second)
+		default:
+			return errorSyntax
+		}
+	}
+	s.data[args[0]] = e
+	return redis.Status("OK")
+}
+
+func (s *Server) incrByFloat(args []string) any {
+	if len(args) != 2 {
+		return errorSyntax
+	}
+	incr, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return errorNotFloat
+	}
+
+	e := s.lookup(args[0])
+	if e == nil {
+		e = &entry{str: new(string)}
+		s.data[args[0]] = e
+	}
+	if e.str == nil {
+		return errorWrongType
+	}
+
+	var value float64
+	if *e.str != "" {
+		if value, err = strconv.ParseFloat(*e.str, 64); err != nil {
+			return errorNotFloat
+		}
+	}
+	result := strconv.FormatFloat(value+incr, 'f', -1, 64)
+	e.str = &result
+	return result
+}
+
+func (s *Server) hincrBy(args []string) any {
+	if len(args) != 3 {
+		return errorSyntax
+	}
+	incr, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorNotInt
+	}
+	hash, ok := s.hash(args[0], true)
+	if !ok {
+		return errorWrongType
+	}
+
+	var value int64
+	if current, ok := hash[args[1]]; ok {
+		if value, err = strconv.ParseInt(current, 10, 64); err != nil {
+			return errorNotInt
+		}
+	}
+	value += incr
+	hash[args[1]] = strconv.FormatInt(value, 10)
+	return value
+}
+
+// Returns the hash at key, creating it if create is set. A missing key
+// without create is a nil hash, a key of another type is not ok.
+func (s *Server) hash(key string, create bool) (map[string]string, bool) {
+	e := s.lookup(key)
+	if e == nil {
+		if !create {
+			return nil, true
+		}
+		e = &entry{hash: make(map[string]string)}
+		s.data[key] = e
+	}
+	return e.hash, e.hash != nil
+}
@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrorInvalidID = errors.New("Invalid trace or span id")
+
+// TraceID identifies a proxy session across the gateway, relays and edge.
+type TraceID [16]byte
+
+func NewTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func ParseTraceID(s string) (TraceID, error) {
+	var id TraceID
+	if err := parseHex(id[:], s); err != nil {
+		return TraceID{}, err
+	}
+	return id, nil
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type SpanID [8]byte
+
+func NewSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+func ParseSpanID(s string) (SpanID, error) {
+	var id SpanID
+	if err := parseHex(id[:], s); err != nil {
+		return SpanID{}, err
+	}
+	return id, nil
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func parseHex(dst []byte, s string) error {
+	if hex.DecodedLen(len(s)) != len(dst) {
+		return ErrorInvalidID
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return ErrorInvalidID
+	}
+	return nil
+}
+
+// Span is a single timed phase of a session. Spans of a nil tracer still
+// get ids, so they can be passed on to the next hop, but are never
+// exported.
+type Span struct {
+	tracer *Tracer
+	data   spanData
+	ended  bool
+	mu     sync.Mutex
+}
+
+type spanData struct {
+	name    string
+	traceID TraceID
+	spanID  SpanID
+	parent  SpanID
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     error
+}
+
+func (s *Span) TraceID() TraceID {
+	return s.data.traceID
+}
+
+func (s *Span) SpanID() SpanID {
+	return s.data.spanID
+}
+
+func (s *Span) SetAttr(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data.attrs == nil {
+		s.data.attrs = make(map[string]string)
+	}
+	s.data.attrs[key] = value
+}
+
+// Ends the span and queues it for export, a non nil err marks the span as
+// failed. Only the first call has any effect.
+func (s *Span) End(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.data.end = time.Now()
+	s.data.err = err
+
+	s.tracer.export(s.data)
+}
@@ -0,0 +1,79 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIDs(t *testing.T) {
+	traceID := NewTraceID()
+	parsed, err := ParseTraceID(traceID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, traceID, parsed)
+
+	spanID := NewSpanID()
+	parsedSpan, err := ParseSpanID(spanID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, spanID, parsedSpan)
+
+	_, err = ParseTraceID(spanID.String())
+	assert.ErrorIs(t, err, ErrorInvalidID)
+	_, err = ParseSpanID("zzzzzzzzzzzzzzzz")
+	assert.ErrorIs(t, err, ErrorInvalidID)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	assert.Nil(t, NewTracer(DefaultConfig("test")))
+
+	span := tracer.Start("setup", NewTraceID(), SpanID{})
+	assert.True(t, span.SpanID().IsValid())
+	span.End(nil)
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+}
+
+func TestTracerExportsOTLP(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests <- req
+	}))
+	defer server.Close()
+
+	config := DefaultConfig("gateway")
+	config.Endpoint = server.URL
+	tracer := NewTracer(config)
+
+	traceID := NewTraceID()
+	root := tracer.Start("session", traceID, SpanID{})
+	child := tracer.Start("dial", traceID, root.SpanID())
+	child.SetAttr("destination", "example.com:443")
+	child.End(errors.New("refused"))
+	root.End(nil)
+
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	req := <-requests
+	assert.Len(t, req.ResourceSpans, 1)
+	assert.Equal(t, attribute("service.name", "gateway"), req.ResourceSpans[0].Resource.Attributes[0])
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "dial", spans[0].Name)
+	assert.Equal(t, traceID.String(), spans[0].TraceID)
+	assert.Equal(t, root.SpanID().String(), spans[0].ParentSpanID)
+	assert.Equal(t, []otlpAttribute{attribute("destination", "example.com:443")}, spans[0].Attributes)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "refused"}, spans[0].Status)
+
+	assert.Equal(t, "session", spans[1].Name)
+	assert.Empty(t, spans[1].ParentSpanID)
+	assert.Equal(t, otlpStatusOk, spans[1].Status.Code)
+}
@@ -0,0 +1,273 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+)
+
+type Config struct {
+	// OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces. Spans
+	// are not exported if empty.
+	Endpoint string
+	// Reported as the service.name resource attribute.
+	Service       string
+	BatchSize     int
+	QueueSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+func DefaultConfig(service string) Config {
+	return Config{
+		Service:       service,
+		BatchSize:     512,
+		QueueSize:     4096,
+		FlushInterval: 5 * time.Second,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Tracer exports ended spans in batches to an OTLP/HTTP collector using
+// the JSON encoding. A nil tracer is valid and exports nothing.
+type Tracer struct {
+	config Config
+	client *http.Client
+
+	spansC chan spanData
+	stopC  chan struct{}
+	doneC  chan struct{}
+}
+
+// Returns nil if no endpoint is configured.
+func NewTracer(config Config) *Tracer {
+	if config.Endpoint == "" {
+		return nil
+	}
+
+	defaults := DefaultConfig(config.Service)
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaults.FlushInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+
+	t := &Tracer{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		spansC: make(chan spanData, config.QueueSize),
+		stopC:  make(chan struct{}),
+		doneC:  make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+// Starts a span of the given trace, parent may be the zero id for the root
+// span. A new trace is started if traceID is the zero id.
+func (t *Tracer) Start(name string, traceID TraceID, parent SpanID) *Span {
+	if !traceID.IsValid() {
+		traceID = NewTraceID()
+	}
+	return &Span{
+		tracer: t,
+		data: spanData{
+			name:    name,
+			traceID: traceID,
+			spanID:  NewSpanID(),
+			parent:  parent,
+			start:   time.Now(),
+		},
+	}
+}
+
+// Flushes queued spans and stops exporting.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	close(t.stopC)
+	select {
+	case <-t.doneC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) export(span spanData) {
+	if t == nil {
+		return
+	}
+
+	// Spans are dropped rather than blocking sessions on a slow collector.
+	select {
+	case t.spansC <- span:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.doneC)
+
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []spanData
+	for {
+		select {
+		case span := <-t.spansC:
+			batch = append(batch, span)
+			if len(batch) >= t.config.BatchSize {
+				t.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.flush(batch)
+			batch = nil
+		case <-t.stopC:
+			for {
+				select {
+				case span := <-t.spansC:
+					batch = append(batch, span)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) flush(batch []spanData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		slog.Warn("Failed to encode spans", logging.Err(err))
+		return
+	}
+
+	resp, err := t.client.Post(t.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to export spans", logging.Err(err))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("Failed to export spans", "status", resp.Status)
+	}
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest, ids are hex encoded and
+// 64 bit integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+func (t *Tracer) encode(batch []spanData) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, data := range batch {
+		span := otlpSpan{
+			TraceID:           data.traceID.String(),
+			SpanID:            data.spanID.String(),
+			Name:              data.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(data.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(data.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if data.parent.IsValid() {
+			span.ParentSpanID = data.parent.String()
+		}
+		for key, value := range data.attrs {
+			span.Attributes = append(span.Attributes, attribute(key, value))
+		}
+		if data.err != nil {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: data.err.Error()}
+		}
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			attribute("service.name", t.config.Service),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/bacv/kingip"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func attribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"sync"
@@ -27,57 +28,85 @@ type ResponseWriter interface {
 
 type HandleFunc func(ResponseWriter, proto.Message) error
 
+// Transport exchanges newline framed messages over a connection. All
+// messages are read through one buffered reader, so bytes that arrive
+// together with a message are kept for the next read or handed off when
+// the transport is abandoned.
 type Transport struct {
-	conn      Conn
-	stopC     chan struct{}
-	handler   HandleFunc
-	closeOnce sync.Once
-	closed    bool
-	mu        sync.RWMutex
+	conn    Conn
+	reader  *bufio.Reader
+	handler HandleFunc
+	closed  bool
+	mu      sync.RWMutex
+	writeMu sync.Mutex
 }
 
 func NewTransport(conn Conn, handler HandleFunc) *Transport {
 	return &Transport{
 		conn:    conn,
+		reader:  bufio.NewReader(conn),
 		handler: handler,
-		stopC:   make(chan struct{}),
 	}
 }
 
-func (t *Transport) Spawn() error {
+// Handles messages until reading fails, the handler returns an error or
+// ctx is done. Closes the transport and the connection when it returns.
+func (t *Transport) Spawn(ctx context.Context) error {
 	defer t.Close()
-	errC := make(chan error)
 
-	go func() {
-		t.read(errC)
-	}()
+	// Closing the connection is the only way to interrupt a pending read.
+	stop := context.AfterFunc(ctx, t.Close)
+	defer stop()
 
-	err := <-errC
-	return err
+	for {
+		if err := t.Sync(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
 }
 
+// Reads one message and handles it.
 func (t *Transport) Sync() error {
-	bytes, err := bufio.NewReader(t.conn).ReadBytes(proto.ByteLF)
+	msg, err := t.ReadMessage()
 	if err != nil {
 		return err
 	}
 
-	return t.handler(t, proto.Message(bytes))
+	return t.handler(t, msg)
+}
+
+// Reads one message without handling it.
+func (t *Transport) ReadMessage() (proto.Message, error) {
+	bytes, err := t.reader.ReadBytes(proto.ByteLF)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Message(bytes), nil
 }
 
 // Closes transport **AND** underlying connection.
 func (t *Transport) Close() {
-	t.closeOnce.Do(func() {
-		t.close()
-	})
+	t.close()
 	t.conn.Close()
 }
 
-// Abandons connection and closes the transport.
-func (t *Transport) Abandon() {
-	t.closeOnce.Do(func() {
-		t.close()
-	})
+// Abandons the connection to its next user and closes the transport.
+// Returns the bytes that were read past the last message, which the next
+// user has to consume before reading from the connection. Must not be
+// called while a read is in progress.
+func (t *Transport) Abandon() []byte {
+	t.close()
+
+	n := t.reader.Buffered()
+	if n == 0 {
+		return nil
+	}
+	leftover, _ := t.reader.Peek(n)
+	return append([]byte(nil), leftover...)
 }
 
 func (t *Transport) close() {
@@ -85,7 +114,6 @@ func (t *Transport) close() {
 	defer t.mu.Unlock()
 
 	t.closed = true
-	close(t.stopC)
 }
 
 func (t *Transport) Write(msg proto.Message) error {
@@ -93,12 +121,11 @@ func (t *Transport) Write(msg proto.Message) error {
 		return ErrorWriteToClosed
 	}
 
-	t.conn.Write(msg)
-	return nil
-}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
 
-func (t *Transport) Read(p []byte) (n int, err error) {
-	return t.conn.Read(p)
+	_, err := t.conn.Write(msg)
+	return err
 }
 
 func (t *Transport) IsClosed() bool {
@@ -107,21 +134,3 @@ func (t *Transport) IsClosed() bool {
 
 	return t.closed
 }
-
-func (t *Transport) read(errC chan<- error) {
-	for {
-		select {
-		case <-t.stopC:
-			return
-		default:
-			bytes, err := bufio.NewReader(t.conn).ReadBytes(proto.ByteLF)
-
-			if err != nil {
-				errC <- err
-				return
-			}
-
-			t.handler(t, proto.Message(bytes))
-		}
-	}
-}
@@ -1,8 +1,10 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -19,7 +21,7 @@ func TestTransportWriteToClosed(t *testing.T) {
 	})
 
 	go func() {
-		transport.Spawn()
+		transport.Spawn(context.Background())
 	}()
 
 	transport.Close()
@@ -84,11 +86,11 @@ func TestTransportHandler(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		tA.Spawn()
+		tA.Spawn(context.Background())
 	}()
 
 	go func() {
-		tB.Spawn()
+		tB.Spawn(context.Background())
 	}()
 
 	go func() {
@@ -112,3 +114,56 @@ func TestTransportHandler(t *testing.T) {
 	assert.NoError(t, cErr)
 	assert.Equal(t, expected, result, fmt.Sprintf("result should be %s, got %s", expected, result))
 }
+
+func TestTransportKeepsBufferedMessages(t *testing.T) {
+	connA, connB := net.Pipe()
+	defer connB.Close()
+
+	var got []string
+	transport := NewTransport(connA, func(w ResponseWriter, r proto.Message) error {
+		_, body, err := r.UnmarshalString()
+		got = append(got, body)
+		return err
+	})
+
+	// Both messages and the raw data arrive in a single read.
+	go connB.Write(append(append(proto.NewMsgPing("1"), proto.NewMsgPing("2")...), "raw"...))
+
+	assert.NoError(t, transport.Sync())
+	assert.NoError(t, transport.Sync())
+	assert.Equal(t, []string{"1", "2"}, got)
+	assert.Equal(t, []byte("raw"), transport.Abandon())
+	assert.True(t, transport.IsClosed())
+}
+
+func TestTransportWriteError(t *testing.T) {
+	connA, connB := net.Pipe()
+	connB.Close()
+
+	transport := NewTransport(connA, nil)
+	assert.ErrorIs(t, transport.Write(proto.NewMsgPing("1")), io.ErrClosedPipe)
+}
+
+func TestTransportSpawnCancel(t *testing.T) {
+	connA, connB := net.Pipe()
+	defer connB.Close()
+
+	transport := NewTransport(connA, func(w ResponseWriter, r proto.Message) error {
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		errC <- transport.Spawn(ctx)
+	}()
+
+	cancel()
+	select {
+	case err := <-errC:
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.True(t, transport.IsClosed())
+	case <-time.After(time.Second):
+		t.Fatal("transport did not stop")
+	}
+}
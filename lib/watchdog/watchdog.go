@@ -0,0 +1,126 @@
+package watchdog
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrorIdleTimeout = errors.New("Idle timeout")
+	ErrorMaxDuration = errors.New("Max session duration")
+)
+
+// Watchdog calls its expire func once, when no bytes were transferred for
+// the idle timeout or the max duration has passed since it started. Zero
+// durations disable the respective timeout.
+type Watchdog struct {
+	idle     time.Duration
+	deadline time.Time
+	expire   func(error)
+
+	last  atomic.Int64
+	err   error
+	stopC chan struct{}
+	once  sync.Once
+	mu    sync.Mutex
+}
+
+func Start(idle, max time.Duration, expire func(error)) *Watchdog {
+	now := time.Now()
+	w := &Watchdog{
+		idle:   idle,
+		expire: expire,
+		stopC:  make(chan struct{}),
+	}
+	if max > 0 {
+		w.deadline = now.Add(max)
+	}
+	w.last.Store(now.UnixNano())
+
+	if idle > 0 || max > 0 {
+		go w.run()
+	}
+	return w
+}
+
+// Records activity, which resets the idle timeout.
+func (w *Watchdog) Touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// Stops the watchdog without calling expire.
+func (w *Watchdog) Stop() {
+	w.once.Do(func() { close(w.stopC) })
+}
+
+// Returns the timeout that expired, or nil.
+func (w *Watchdog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+func (w *Watchdog) run() {
+	timer := time.NewTimer(w.next(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.stopC:
+			return
+		case now := <-timer.C:
+			if err := w.check(now); err != nil {
+				w.mu.Lock()
+				w.err = err
+				w.mu.Unlock()
+
+				w.Stop()
+				w.expire(err)
+				return
+			}
+			timer.Reset(w.next(now))
+		}
+	}
+}
+
+func (w *Watchdog) check(now time.Time) error {
+	if !w.deadline.IsZero() && !now.Before(w.deadline) {
+		return ErrorMaxDuration
+	}
+	if w.idle > 0 && now.Sub(time.Unix(0, w.last.Load())) >= w.idle {
+		return ErrorIdleTimeout
+	}
+	return nil
+}
+
+// Time until the earliest timeout could expire.
+func (w *Watchdog) next(now time.Time) time.Duration {
+	var wait time.Duration = -1
+	if w.idle > 0 {
+		wait = time.Unix(0, w.last.Load()).Add(w.idle).Sub(now)
+	}
+	if !w.deadline.IsZero() {
+		if untilDeadline := w.deadline.Sub(now); wait < 0 || untilDeadline < wait {
+			wait = untilDeadline
+		}
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// Shortest returns the shortest of the non zero durations, or zero if all
+// of them are zero.
+func Shortest(durations ...time.Duration) time.Duration {
+	var shortest time.Duration
+	for _, d := range durations {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	return shortest
+}
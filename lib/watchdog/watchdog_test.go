@@ -0,0 +1,65 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchdogIdleTimeout(t *testing.T) {
+	expired := make(chan error, 1)
+	w := Start(50*time.Millisecond, 0, func(err error) { expired <- err })
+
+	// Activity keeps the watchdog from expiring.
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		w.Touch()
+	}
+	assert.Empty(t, expired)
+
+	select {
+	case err := <-expired:
+		assert.ErrorIs(t, err, ErrorIdleTimeout)
+		assert.ErrorIs(t, w.Err(), ErrorIdleTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not expire")
+	}
+}
+
+func TestWatchdogMaxDuration(t *testing.T) {
+	expired := make(chan error, 1)
+	w := Start(time.Hour, 50*time.Millisecond, func(err error) { expired <- err })
+	defer w.Stop()
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case err := <-expired:
+			assert.ErrorIs(t, err, ErrorMaxDuration)
+			return
+		case <-deadline:
+			t.Fatal("watchdog did not expire")
+		default:
+			w.Touch()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestWatchdogStop(t *testing.T) {
+	expired := make(chan error, 1)
+	w := Start(10*time.Millisecond, 10*time.Millisecond, func(err error) { expired <- err })
+	w.Stop()
+	w.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, expired)
+	assert.NoError(t, w.Err())
+}
+
+func TestShortest(t *testing.T) {
+	assert.Equal(t, time.Duration(0), Shortest())
+	assert.Equal(t, time.Duration(0), Shortest(0, 0))
+	assert.Equal(t, time.Second, Shortest(0, time.Minute, time.Second))
+}
@@ -0,0 +1,537 @@
+// Package edge embeds an edge node in other programs. A node connects to
+// one or more relays, keeps reconnecting until it is stopped and proxies
+// the sessions the relays route to it. The relays may be discovered and
+// picked by round trip time, see Options.MaxRelays. Nodes share no state,
+// so a program may run several of them.
+//
+//	node, err := edge.Start(ctx, edge.Options{
+//		Relays:  []string{"relay.example.com:5555"},
+//		Regions: []string{"red"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer node.Stop()
+package edge
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/proto"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/svc"
+	svc_edge "github.com/bacv/kingip/svc/edge"
+)
+
+// How often the limits in effect and the bandwidth in use are checked.
+const capacityInterval = time.Second
+
+var (
+	ErrorNoRelays  = errors.New("At least one relay or a discovery URL is required")
+	ErrorNoRegions = errors.New("At least one region is required")
+	ErrorBackoff   = errors.New("Min backoff must not exceed max backoff")
+)
+
+type (
+	Credentials = quic_kingip.Credentials
+	Network     = quic_kingip.Network
+	// Limits the regions and destinations of sessions, empty allow lists
+	// allow everything.
+	ACL       = svc.UserPolicy
+	Region    = svc.Region
+	PortRange = svc.PortRange
+
+	ScheduleWindow = svc_edge.ScheduleWindow
+	HealthConfig   = svc_edge.HealthConfig
+	// Remaining capacity of the node, see Options.MaxSessions.
+	Capacity = proto.Capacity
+	// Error of sessions rejected because the node is full.
+	CapacityError = svc_edge.CapacityError
+
+	HealthStats   = svc_edge.HealthStats
+	SessionStats  = svc_edge.SessionStats
+	DialerStats   = svc_edge.DialerStats
+	ResolverStats = svc_edge.ResolverStats
+)
+
+type Options struct {
+	// Addresses of the relays to serve, the node connects to all of them
+	// unless MaxRelays is set. Replaced at runtime by Node.SetRelays.
+	Relays []string
+	// URL of a JSON list of relays, fetched at start and every
+	// RefreshInterval, whose relays are used next to Relays:
+	//
+	//	[{"addr": "relay-1.example.com:5555", "regions": ["red", "blue"]}]
+	//
+	// Relays listing regions are only used if they serve one of Regions.
+	DiscoveryURL string
+	// Max relays connected at once, zero connects to all of them. With a
+	// limit, the relays with the lowest measured round trip are used, and
+	// a lost connection moves to another relay instead of being retried.
+	MaxRelays int
+	// How often the discovery URL is fetched and round trips to the relays
+	// are measured, zero uses 1m.
+	RefreshInterval time.Duration
+	// Regions the node serves sessions for.
+	Regions []string
+	// Name the regions are registered with, defaults to the host name.
+	Hostname string
+	// Sent to the relays if set, for relays that require them.
+	Credentials *Credentials
+	// What carries the relay connections, see quic.Network.
+	Network Network
+	// Max concurrent sessions, zero means unlimited. Sessions over the
+	// limits are rejected, and relays stop routing to the node while it is
+	// full.
+	MaxSessions int
+	// Max bytes per second across all sessions in both directions, zero
+	// means unlimited.
+	MaxBandwidth int64
+	// Limits for certain times of day, replacing MaxSessions and
+	// MaxBandwidth while a window is open.
+	Schedule []ScheduleWindow
+	ACL      ACL
+	// Self-checks of the uplink. While they fail, or too few sessions
+	// reach their destination, the node withdraws from its regions. Nil
+	// uses the defaults of svc/edge, which probe no targets.
+	Health *HealthConfig
+	// Called whenever the connection to a relay changes state. Calls for
+	// different relays may run concurrently, so it must not block.
+	// Relays the node stops using are reported as stopped.
+	OnStatus func(RelayStatus)
+	// Nil uses slog.Default.
+	Logger *slog.Logger
+	// Max time Stop waits for active sessions, zero waits 30s.
+	DrainTimeout time.Duration
+	// Delay before reconnecting to a relay, doubled after each failed
+	// attempt up to MaxBackoff. Zero values use 1s and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// The zero value uses quic.DefaultQUICConfig.
+	QUIC quic_kingip.QUICConfig
+	// Settings of the sessions, nil uses edge.DefaultConfig of svc/edge.
+	// The limits, ACL and health checks above take precedence over the
+	// ones here.
+	Edge *svc_edge.Config
+}
+
+type Status int
+
+const (
+	StatusConnecting Status = iota
+	StatusConnected
+	// The connection failed or was lost, the node reconnects after a
+	// backoff.
+	StatusDisconnected
+	// The node stopped, or stopped using the relay.
+	StatusStopped
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusConnecting:
+		return "connecting"
+	case StatusConnected:
+		return "connected"
+	case StatusDisconnected:
+		return "disconnected"
+	case StatusStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// State of the connection to a relay.
+type RelayStatus struct {
+	Addr   string
+	Status Status
+	// Id the relay assigned to the connection, set while connected.
+	ConnID string
+	// Why the last connection ended, nil if it was not lost.
+	Err error
+	// When the status last changed.
+	Since time.Time
+	// Last measured round trip, zero until measured. Only measured with
+	// MaxRelays set.
+	RTT time.Duration
+}
+
+type Stats struct {
+	// Relays in use, by address.
+	Relays   []RelayStatus
+	Capacity Capacity
+	Health   HealthStats
+	Sessions SessionStats
+	Dialer   DialerStats
+	Resolver ResolverStats
+}
+
+// Node is a running edge, it keeps serving until Stop is called or the
+// context passed to Start is done.
+type Node struct {
+	options  Options
+	regions  map[string]string
+	interval time.Duration
+	logger   *slog.Logger
+	edge     *svc_edge.Edge
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping atomic.Bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	done     chan struct{}
+	refreshC chan struct{}
+
+	// Addresses set by Options.Relays or SetRelays, and found by
+	// discovery.
+	static     []string
+	discovered []string
+	candidates map[string]*candidate
+	// Relays in use, by address.
+	relays map[string]*relay
+	// What new relay connections start from, nil capacity until known.
+	announced map[string]string
+	capacity  *Capacity
+	mu        sync.Mutex
+}
+
+// Validates the options and starts connecting to the relays in the
+// background. Connection failures are retried, reported through OnStatus
+// and never returned.
+func Start(ctx context.Context, options Options) (*Node, error) {
+	options, err := withDefaults(options)
+	if err != nil {
+		return nil, err
+	}
+
+	config := svc_edge.DefaultConfig()
+	if options.Edge != nil {
+		config = *options.Edge
+	}
+	config.MaxSessions = options.MaxSessions
+	config.MaxBandwidth = options.MaxBandwidth
+	config.Schedule = options.Schedule
+	config.ACL = options.ACL
+	if options.Health != nil {
+		config.Health = *options.Health
+	}
+	if config.Health.Interval <= 0 {
+		config.Health.Interval = svc_edge.DefaultHealthConfig().Interval
+	}
+
+	logger := logging.OrDefault(options.Logger)
+	edge, err := svc_edge.NewEdge(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make(map[string]string, len(options.Regions))
+	for _, region := range options.Regions {
+		regions[region] = options.Hostname
+	}
+
+	n := &Node{
+		options:    options,
+		regions:    regions,
+		interval:   config.Health.Interval,
+		logger:     logger,
+		edge:       edge,
+		client:     &http.Client{Timeout: discoveryTimeout},
+		done:       make(chan struct{}),
+		refreshC:   make(chan struct{}, 1),
+		static:     append([]string(nil), options.Relays...),
+		candidates: make(map[string]*candidate),
+		relays:     make(map[string]*relay),
+		announced:  regions,
+	}
+	// Relay connections outlive ctx while they drain.
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	// Without discovery or round trips to wait for, the relays are
+	// connected right away.
+	if options.DiscoveryURL == "" && options.MaxRelays <= 0 {
+		n.mu.Lock()
+		n.rebalance()
+		n.mu.Unlock()
+	}
+
+	n.wg.Add(3)
+	go n.refresh()
+	go n.advertise()
+	go n.monitor()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-n.done:
+		}
+	}()
+	return n, nil
+}
+
+func withDefaults(options Options) (Options, error) {
+	if len(options.Relays) == 0 && options.DiscoveryURL == "" {
+		return options, ErrorNoRelays
+	}
+	if len(options.Regions) == 0 {
+		return options, ErrorNoRegions
+	}
+	if err := options.Network.Validate(); err != nil {
+		return options, err
+	}
+
+	if options.QUIC == (quic_kingip.QUICConfig{}) {
+		options.QUIC = quic_kingip.DefaultQUICConfig()
+	}
+	if err := options.QUIC.Validate(); err != nil {
+		return options, err
+	}
+
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+	}
+	if options.Hostname == "" {
+		options.Hostname = "edge"
+	}
+	if options.DrainTimeout <= 0 {
+		options.DrainTimeout = 30 * time.Second
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = time.Minute
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = time.Second
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = max(30*time.Second, options.MinBackoff)
+	}
+	if options.MinBackoff > options.MaxBackoff {
+		return options, ErrorBackoff
+	}
+	return options, nil
+}
+
+// Drains the relay connections, waiting up to DrainTimeout for active
+// sessions, and returns once everything is closed. Safe to call more than
+// once.
+func (n *Node) Stop() error {
+	var err error
+	n.stopOnce.Do(func() {
+		n.stopping.Store(true)
+		n.logger.Info("Stopping, draining relay connections")
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.options.DrainTimeout)
+		defer cancel()
+
+		relays := n.active()
+		var wg sync.WaitGroup
+		errs := make([]error, len(relays))
+		for i, r := range relays {
+			wg.Add(1)
+			go func(i int, r *relay) {
+				defer wg.Done()
+				errs[i] = r.dialer.Shutdown(ctx)
+			}(i, r)
+		}
+		wg.Wait()
+
+		n.cancel()
+		n.wg.Wait()
+		close(n.done)
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+// Done once the node is stopped.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+func (n *Node) Stats() Stats {
+	stats := Stats{
+		Capacity: n.edge.Capacity(),
+		Health:   n.edge.HealthStats(),
+		Sessions: n.edge.SessionStats(),
+		Dialer:   n.edge.DialerStats(),
+		Resolver: n.edge.ResolverStats(),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, r := range n.relays {
+		status := r.getStatus()
+		if c := n.candidates[r.addr]; c != nil {
+			status.RTT = c.rtt
+		}
+		stats.Relays = append(stats.Relays, status)
+	}
+	sort.Slice(stats.Relays, func(i, j int) bool { return stats.Relays[i].Addr < stats.Relays[j].Addr })
+	return stats
+}
+
+// Keeps a relay connected until the node stops or stops using it.
+func (n *Node) run(r *relay) {
+	defer n.wg.Done()
+	defer n.setStatus(r, StatusStopped, "", nil)
+
+	backoff := n.options.MinBackoff
+	for {
+		n.setStatus(r, StatusConnecting, "", nil)
+		started := time.Now()
+		err := r.dialer.Dial(r.ctx)
+		if n.stopping.Load() || r.stopped.Load() {
+			return
+		}
+
+		if err == nil {
+			err = errors.New("Relay closed the connection")
+		}
+		n.setStatus(r, StatusDisconnected, "", err)
+		n.logger.Warn("Relay connection lost", logging.KeyRelay, r.addr, logging.Err(err))
+
+		if n.replace(r) {
+			return
+		}
+
+		// A connection that lasted resets the backoff.
+		if time.Since(started) > n.options.MaxBackoff {
+			backoff = n.options.MinBackoff
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff = min(2*backoff, n.options.MaxBackoff)
+	}
+}
+
+// Tells the relays the remaining capacity whenever it changes.
+func (n *Node) advertise() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(capacityInterval)
+	defer ticker.Stop()
+
+	var last Capacity
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.edge.CapacityChanged():
+		case <-n.ctx.Done():
+			return
+		}
+
+		capacity := n.edge.Capacity()
+		if capacity == last {
+			continue
+		}
+		last = capacity
+
+		n.mu.Lock()
+		n.capacity = &capacity
+		n.mu.Unlock()
+		for _, r := range n.active() {
+			go func(r *relay) {
+				if err := r.dialer.SetCapacity(capacity); err != nil {
+					n.logger.Debug("Failed to advertise capacity", logging.KeyRelay, r.addr, logging.Err(err))
+				}
+			}(r)
+		}
+	}
+}
+
+// Runs the health checks, withdrawing the regions from the relays while
+// the node is unhealthy.
+func (n *Node) monitor() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ticker.C:
+			n.edge.CheckHealth(n.ctx)
+		case <-n.edge.HealthChanged():
+		case <-n.ctx.Done():
+			return
+		}
+
+		stats := n.edge.HealthStats()
+		if stats.Healthy == healthy {
+			continue
+		}
+		healthy = stats.Healthy
+
+		regions := n.regions
+		if healthy {
+			n.logger.Info("Healthy again, announcing regions")
+		} else {
+			n.logger.Warn("Unhealthy, withdrawing regions", "success_rate", stats.SuccessRate, "probe_ok", stats.ProbeOK)
+			regions = map[string]string{}
+		}
+
+		n.mu.Lock()
+		n.announced = regions
+		n.mu.Unlock()
+		for _, r := range n.active() {
+			go func(r *relay) {
+				if err := r.dialer.SetRegions(regions); err != nil {
+					n.logger.Debug("Failed to update regions", logging.KeyRelay, r.addr, logging.Err(err))
+				}
+			}(r)
+		}
+	}
+}
+
+func (n *Node) setStatus(r *relay, status Status, connID string, err error) {
+	s := r.setStatus(status, connID, err)
+	if n.options.OnStatus != nil {
+		n.options.OnStatus(s)
+	}
+}
+
+type relay struct {
+	addr    string
+	dialer  *quic_kingip.Dialer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped atomic.Bool
+	status  RelayStatus
+	mu      sync.Mutex
+}
+
+func (r *relay) setStatus(status Status, connID string, err error) RelayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Status = status
+	r.status.ConnID = connID
+	r.status.Err = err
+	r.status.Since = time.Now()
+	return r.status
+}
+
+func (r *relay) getStatus() RelayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
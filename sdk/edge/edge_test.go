@@ -0,0 +1,282 @@
+package edge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/proto"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/transport"
+	svc_edge "github.com/bacv/kingip/svc/edge"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a relay side listener that requires credentials and returns its
+// address and the connections of registered nodes. Advertised capacity is
+// passed to onCapacity if set.
+func listen(t *testing.T, onCapacity quic_kingip.ListenerCapacityHandleFunc) (string, <-chan quic_kingip.Conn) {
+	return listenRegions(t, func(uint64, map[string]string) error { return nil }, onCapacity)
+}
+
+func listenRegions(
+	t *testing.T,
+	onRegions quic_kingip.ListenerRegionsHandleFunc,
+	onCapacity quic_kingip.ListenerCapacityHandleFunc,
+) (string, <-chan quic_kingip.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connC := make(chan quic_kingip.Conn, 1)
+	listener := quic_kingip.NewListener(ctx, quic_kingip.ListenerConfig{
+		Addr:    addr,
+		Network: quic_kingip.NetworkTCP,
+		Authenticate: func(name, secret string) error {
+			if name != "edge" || secret != "secret" {
+				return errors.New("Invalid credentials")
+			}
+			return nil
+		},
+	}, logging.Discard(),
+		func(conn quic_kingip.Conn, _ *quic_kingip.Peer) (uint64, <-chan error, error) {
+			connC <- conn
+			return 1, make(chan error), nil
+		},
+		onRegions,
+		func(uint64) {},
+		onCapacity,
+		func(uint64) {},
+	)
+	go listener.Listen()
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+	return addr, connC
+}
+
+// Serves a destination that echoes what it receives.
+func serveEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Proxies a message to destination through the node behind conn.
+func proxy(t *testing.T, conn quic_kingip.Conn, destination, region string) ([]byte, error) {
+	stream, err := conn.OpenStream()
+	assert.NoError(t, err)
+	stream, err = quic_kingip.SyncTransport(stream, func(w transport.ResponseWriter, r proto.Message) error {
+		_, err := r.UnmarshalProxyResult()
+		return err
+	}, proto.NewMsgGatewayProxy(proto.GatewayProxy{Destination: destination, Region: region}))
+	if err != nil {
+		return nil, err
+	}
+
+	stream.Write([]byte("hello"))
+	stream.Close()
+	return io.ReadAll(stream)
+}
+
+func TestStartValidation(t *testing.T) {
+	_, err := Start(context.Background(), Options{Regions: []string{"red"}})
+	assert.ErrorIs(t, err, ErrorNoRelays)
+	_, err = Start(context.Background(), Options{Relays: []string{"127.0.0.1:1"}})
+	assert.ErrorIs(t, err, ErrorNoRegions)
+	_, err = Start(context.Background(), Options{
+		Relays:  []string{"127.0.0.1:1"},
+		Regions: []string{"red"},
+		Network: "udp",
+	})
+	assert.ErrorIs(t, err, quic_kingip.ErrorNetwork)
+}
+
+func TestNode(t *testing.T) {
+	addr, connC := listen(t, nil)
+	destination := serveEcho(t)
+
+	statusC := make(chan RelayStatus, 256)
+	node, err := Start(context.Background(), Options{
+		Relays:      []string{addr},
+		Regions:     []string{"red"},
+		Hostname:    "test",
+		Credentials: &Credentials{Name: "edge", Secret: "secret"},
+		Network:     quic_kingip.NetworkTCP,
+		ACL:         ACL{DeniedRegions: []Region{"blue"}},
+		OnStatus:    func(s RelayStatus) { statusC <- s },
+		Logger:      logging.Discard(),
+		MinBackoff:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	var conn quic_kingip.Conn
+	select {
+	case conn = <-connC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not connect")
+	}
+	assert.Eventually(t, func() bool {
+		return node.Stats().Relays[0].Status == StatusConnected
+	}, time.Second, 10*time.Millisecond)
+
+	response, err := proxy(t, conn, destination, "red")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(response))
+
+	_, err = proxy(t, conn, destination, "blue")
+	assert.Error(t, err)
+
+	stats := node.Stats()
+	assert.Equal(t, uint64(2), stats.Sessions.Total)
+	assert.Equal(t, uint64(1), stats.Sessions.Failures)
+	assert.Equal(t, uint64(5), stats.Sessions.BytesUp)
+
+	assert.NoError(t, node.Stop())
+	assert.NoError(t, node.Stop())
+	assert.Equal(t, StatusStopped, node.Stats().Relays[0].Status)
+
+	var statuses []Status
+	for len(statusC) > 0 {
+		statuses = append(statuses, (<-statusC).Status)
+	}
+	// Attempts before the listener was up may fail first.
+	assert.Equal(t, []Status{StatusConnecting, StatusConnected, StatusStopped}, statuses[len(statuses)-3:])
+}
+
+func TestNodeCapacity(t *testing.T) {
+	capacityC := make(chan proto.Capacity, 16)
+	addr, connC := listen(t, func(_ uint64, c proto.Capacity) { capacityC <- c })
+
+	node, err := Start(context.Background(), Options{
+		Relays:      []string{addr},
+		Regions:     []string{"red"},
+		Credentials: &Credentials{Name: "edge", Secret: "secret"},
+		Network:     quic_kingip.NetworkTCP,
+		MaxSessions: 1,
+		Logger:      logging.Discard(),
+		MinBackoff:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { node.Stop() })
+	conn := <-connC
+
+	// A session that stays open takes the only slot.
+	stream, err := conn.OpenStream()
+	assert.NoError(t, err)
+	_, err = quic_kingip.SyncTransport(stream, func(w transport.ResponseWriter, r proto.Message) error {
+		_, err := r.UnmarshalProxyResult()
+		return err
+	}, proto.NewMsgGatewayProxy(proto.GatewayProxy{Destination: serveEcho(t), Region: "red"}))
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	assert.Eventually(t, func() bool {
+		select {
+		case c := <-capacityC:
+			return c == Capacity{Available: false, Sessions: 0, Bandwidth: -1}
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var retryErr *proto.RetryError
+	_, err = proxy(t, conn, serveEcho(t), "red")
+	assert.ErrorAs(t, err, &retryErr)
+	assert.Equal(t, uint64(1), node.Stats().Sessions.Rejected)
+}
+
+func TestNodeHealth(t *testing.T) {
+	regionsC := make(chan map[string]string, 16)
+	addr, connC := listenRegions(t, func(_ uint64, regions map[string]string) error {
+		regionsC <- regions
+		return nil
+	}, nil)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	targetAddr := target.Addr().String()
+	target.Close()
+
+	health := svc_edge.DefaultHealthConfig()
+	health.Targets = []string{targetAddr}
+	health.Interval = 20 * time.Millisecond
+	node, err := Start(context.Background(), Options{
+		Relays:      []string{addr},
+		Regions:     []string{"red"},
+		Credentials: &Credentials{Name: "edge", Secret: "secret"},
+		Network:     quic_kingip.NetworkTCP,
+		Hostname:    "edge",
+		Health:      &health,
+		Logger:      logging.Discard(),
+		MinBackoff:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { node.Stop() })
+	<-connC
+
+	// The failed probe withdraws the region, before or after the hello.
+	for regions := range regionsC {
+		if len(regions) == 0 {
+			break
+		}
+	}
+	assert.False(t, node.Stats().Health.Healthy)
+
+	target, err = net.Listen("tcp", targetAddr)
+	assert.NoError(t, err)
+	defer target.Close()
+	assert.Equal(t, map[string]string{"red": "edge"}, <-regionsC)
+}
+
+func TestNodeReconnect(t *testing.T) {
+	addr, connC := listen(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	node, err := Start(ctx, Options{
+		Relays:      []string{addr},
+		Regions:     []string{"red"},
+		Credentials: &Credentials{Name: "edge", Secret: "secret"},
+		Network:     quic_kingip.NetworkTCP,
+		Logger:      logging.Discard(),
+		MinBackoff:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	// The relay dropping the connection is no reason to give up.
+	conn := <-connC
+	conn.CloseWithError(0, "")
+	select {
+	case <-connC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not reconnect")
+	}
+
+	cancel()
+	select {
+	case <-node.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not stop with its context")
+	}
+}
@@ -0,0 +1,388 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+)
+
+const (
+	// Max time to fetch the discovery URL.
+	discoveryTimeout = 10 * time.Second
+	// Max time to measure the round trip to a relay.
+	probeTimeout = 10 * time.Second
+)
+
+// RelayInfo is an entry of the list served at Options.DiscoveryURL.
+type RelayInfo struct {
+	Addr string `json:"addr"`
+	// Regions the relay serves, empty means every region.
+	Regions []string `json:"regions,omitempty"`
+}
+
+// A relay the node may connect to.
+type candidate struct {
+	addr string
+	// Last measured round trip, zero until measured.
+	rtt time.Duration
+	// Set if the last measurement failed.
+	err error
+	// A relay whose connection was lost is not picked again until then.
+	failedUntil time.Time
+}
+
+func (c *candidate) healthy(now time.Time) bool {
+	return c.err == nil && !c.failedUntil.After(now)
+}
+
+// Replaces the relays set by Options.Relays. Relays no longer listed or
+// discovered are drained and disconnected.
+func (n *Node) SetRelays(addrs []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.static = append([]string(nil), addrs...)
+	n.rebalance()
+}
+
+// Fetches the discovery URL and measures the round trips now rather than
+// at the next RefreshInterval.
+func (n *Node) Refresh() {
+	select {
+	case n.refreshC <- struct{}{}:
+	default:
+	}
+}
+
+// Discovers relays and measures round trips every RefreshInterval, then
+// picks the relays to use.
+func (n *Node) refresh() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.options.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if n.options.DiscoveryURL != "" {
+			n.discover()
+		}
+		// Without a limit every relay is used, whatever its round trip.
+		if n.options.MaxRelays > 0 {
+			n.probe()
+		}
+
+		n.mu.Lock()
+		n.rebalance()
+		n.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-n.refreshC:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// Fetches the relays from the discovery URL, keeping those found last if
+// that fails.
+func (n *Node) discover() {
+	relays, err := fetchRelays(n.ctx, n.client, n.options.DiscoveryURL)
+	if err != nil {
+		if n.ctx.Err() == nil {
+			n.logger.Warn("Relay discovery failed", logging.Err(err))
+		}
+		return
+	}
+
+	var addrs []string
+	for _, info := range relays {
+		if info.Addr != "" && n.serves(info) {
+			addrs = append(addrs, info.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		n.logger.Warn("Discovered no relays for the regions", "relays", len(relays))
+	}
+
+	n.mu.Lock()
+	n.discovered = addrs
+	n.mu.Unlock()
+}
+
+// Whether the relay serves one of the regions of the node.
+func (n *Node) serves(info RelayInfo) bool {
+	if len(info.Regions) == 0 {
+		return true
+	}
+	for _, region := range info.Regions {
+		if _, ok := n.regions[region]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Measures the round trips to all relays the node may connect to.
+func (n *Node) probe() {
+	n.mu.Lock()
+	var addrs []string
+	for addr := range n.updateCandidates() {
+		addrs = append(addrs, addr)
+	}
+	n.mu.Unlock()
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	var (
+		wg      sync.WaitGroup
+		results = make([]result, len(addrs))
+	)
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(n.ctx, probeTimeout)
+			defer cancel()
+			dialer := quic_kingip.NewDialer(quic_kingip.DialerConfig{
+				Addr:    addr,
+				Network: n.options.Network,
+				QUIC:    n.options.QUIC,
+			}, n.logger, nil)
+			rtt, err := dialer.Probe(ctx)
+			if err != nil && n.ctx.Err() == nil {
+				n.logger.Debug("Relay probe failed", logging.KeyRelay, addr, logging.Err(err))
+			}
+			results[i] = result{rtt, err}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	if n.ctx.Err() != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, addr := range addrs {
+		if c := n.candidates[addr]; c != nil {
+			c.rtt, c.err = results[i].rtt, results[i].err
+		}
+	}
+}
+
+// Disconnects the relays that are no longer known, and connects to the
+// best ones until MaxRelays are in use. A relay at least twice as close
+// as the farthest one in use takes its place. The caller holds n.mu.
+func (n *Node) rebalance() {
+	if n.stopping.Load() {
+		return
+	}
+
+	known := n.updateCandidates()
+	for addr, r := range n.relays {
+		if !known[addr] {
+			n.logger.Info("Relay removed, disconnecting", logging.KeyRelay, addr)
+			n.drop(r)
+		}
+	}
+
+	limit := len(known)
+	if n.options.MaxRelays > 0 {
+		limit = min(limit, n.options.MaxRelays)
+	}
+
+	now := time.Now()
+	spares := n.spares(now)
+	if len(n.relays) == limit && len(spares) > 0 {
+		best := spares[0]
+		if farthest := n.farthest(); farthest != nil && best.healthy(now) && best.rtt > 0 && 2*best.rtt <= farthest.rtt {
+			n.logger.Info("Moving to a closer relay", logging.KeyRelay, farthest.addr, "next", best.addr, "rtt", farthest.rtt, "next_rtt", best.rtt)
+			n.drop(n.relays[farthest.addr])
+		}
+	}
+
+	for _, c := range spares {
+		if len(n.relays) >= limit {
+			break
+		}
+		n.start(c.addr)
+	}
+}
+
+// Makes the candidates match the relays set and discovered, keeping what
+// is known about those that remain, and returns their addresses. The
+// caller holds n.mu.
+func (n *Node) updateCandidates() map[string]bool {
+	known := make(map[string]bool, len(n.static)+len(n.discovered))
+	for _, addr := range n.static {
+		known[addr] = true
+	}
+	for _, addr := range n.discovered {
+		known[addr] = true
+	}
+	for addr := range n.candidates {
+		if !known[addr] {
+			delete(n.candidates, addr)
+		}
+	}
+	for addr := range known {
+		if _, ok := n.candidates[addr]; !ok {
+			n.candidates[addr] = &candidate{addr: addr}
+		}
+	}
+	return known
+}
+
+// Moves from a relay whose connection was lost to the best unused one,
+// if there is one that works. Returns false if the node should keep
+// reconnecting to the relay instead.
+func (n *Node) replace(r *relay) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopping.Load() || r.stopped.Load() {
+		return false
+	}
+
+	now := time.Now()
+	if c := n.candidates[r.addr]; c != nil {
+		c.failedUntil = now.Add(n.options.MaxBackoff)
+	}
+	spares := n.spares(now)
+	if len(spares) == 0 || !spares[0].healthy(now) {
+		return false
+	}
+
+	n.logger.Info("Moving to another relay", logging.KeyRelay, r.addr, "next", spares[0].addr)
+	delete(n.relays, r.addr)
+	r.stopped.Store(true)
+	r.cancel()
+	n.rebalance()
+	return true
+}
+
+// Returns the relays not in use, healthy ones first, then by round trip
+// with unmeasured ones last. The caller holds n.mu.
+func (n *Node) spares(now time.Time) []*candidate {
+	var spares []*candidate
+	for addr, c := range n.candidates {
+		if _, ok := n.relays[addr]; !ok {
+			spares = append(spares, c)
+		}
+	}
+	sort.Slice(spares, func(i, j int) bool {
+		a, b := spares[i], spares[j]
+		if a.healthy(now) != b.healthy(now) {
+			return a.healthy(now)
+		}
+		if (a.rtt == 0) != (b.rtt == 0) {
+			return b.rtt == 0
+		}
+		if a.rtt != b.rtt {
+			return a.rtt < b.rtt
+		}
+		return a.addr < b.addr
+	})
+	return spares
+}
+
+// Returns the relay in use with the longest measured round trip, nil if
+// none is measured. The caller holds n.mu.
+func (n *Node) farthest() *candidate {
+	var farthest *candidate
+	for addr := range n.relays {
+		c := n.candidates[addr]
+		if c != nil && c.rtt > 0 && (farthest == nil || c.rtt > farthest.rtt) {
+			farthest = c
+		}
+	}
+	return farthest
+}
+
+// Starts connecting to the relay at addr. The caller holds n.mu.
+func (n *Node) start(addr string) {
+	r := &relay{addr: addr, status: RelayStatus{Addr: addr, Status: StatusConnecting, Since: time.Now()}}
+	r.ctx, r.cancel = context.WithCancel(n.ctx)
+	r.dialer = quic_kingip.NewDialer(quic_kingip.DialerConfig{
+		Addr:        addr,
+		Regions:     n.announced,
+		Network:     n.options.Network,
+		Credentials: n.options.Credentials,
+		OnRegister: func(id string) {
+			n.setStatus(r, StatusConnected, id, nil)
+		},
+		QUIC: n.options.QUIC,
+	}, n.logger, n.edge.RelayHandle)
+	// Sent once connected.
+	if n.capacity != nil {
+		r.dialer.SetCapacity(*n.capacity)
+	}
+	n.relays[addr] = r
+
+	n.wg.Add(1)
+	go n.run(r)
+}
+
+// Stops using the relay, draining its connection in the background. The
+// caller holds n.mu.
+func (n *Node) drop(r *relay) {
+	delete(n.relays, r.addr)
+	r.stopped.Store(true)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.options.DrainTimeout)
+		defer cancel()
+		if err := r.dialer.Shutdown(ctx); err != nil {
+			n.logger.Warn("Failed to drain relay connection", logging.KeyRelay, r.addr, logging.Err(err))
+		}
+		r.cancel()
+	}()
+}
+
+// Returns the relays in use.
+func (n *Node) active() []*relay {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	relays := make([]*relay, 0, len(n.relays))
+	for _, r := range n.relays {
+		relays = append(relays, r)
+	}
+	return relays
+}
+
+func fetchRelays(ctx context.Context, client *http.Client, url string) ([]RelayInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s from %s", resp.Status, url)
+	}
+	var relays []RelayInfo
+	if err := json.NewDecoder(resp.Body).Decode(&relays); err != nil {
+		return nil, err
+	}
+	return relays, nil
+}
@@ -0,0 +1,141 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/stretchr/testify/assert"
+)
+
+// Waits until the listener at addr accepts conns, so that probes succeed.
+func waitListening(t *testing.T, addr string) {
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func relayAddrs(node *Node) []string {
+	var addrs []string
+	for _, status := range node.Stats().Relays {
+		addrs = append(addrs, status.Addr)
+	}
+	return addrs
+}
+
+func TestNodeMaxRelays(t *testing.T) {
+	addrA, connA := listen(t, nil)
+	addrB, connB := listen(t, nil)
+	waitListening(t, addrA)
+	waitListening(t, addrB)
+
+	node, err := Start(context.Background(), Options{
+		Relays:      []string{addrA, addrB, "127.0.0.1:1"},
+		Regions:     []string{"red"},
+		Credentials: &Credentials{Name: "edge", Secret: "secret"},
+		Network:     quic_kingip.NetworkTCP,
+		MaxRelays:   1,
+		Logger:      logging.Discard(),
+		MinBackoff:  10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { node.Stop() })
+
+	// Only one of the relays that answer the probe is used.
+	var conn quic_kingip.Conn
+	var other <-chan quic_kingip.Conn
+	select {
+	case conn = <-connA:
+		other = connB
+	case conn = <-connB:
+		other = connA
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not connect")
+	}
+	assert.Eventually(t, func() bool {
+		relays := node.Stats().Relays
+		return len(relays) == 1 && relays[0].Status == StatusConnected && relays[0].RTT > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// A lost connection moves to the other relay.
+	conn.CloseWithError(0, "")
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not move to the other relay")
+	}
+	assert.Eventually(t, func() bool {
+		relays := node.Stats().Relays
+		return len(relays) == 1 && relays[0].Status == StatusConnected
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNodeDiscovery(t *testing.T) {
+	addrA, connA := listen(t, nil)
+	addrB, connB := listen(t, nil)
+
+	var (
+		relays = []RelayInfo{{Addr: addrA, Regions: []string{"red"}}, {Addr: addrB, Regions: []string{"blue"}}}
+		mu     sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(relays)
+	}))
+	t.Cleanup(server.Close)
+
+	node, err := Start(context.Background(), Options{
+		DiscoveryURL: server.URL,
+		Regions:      []string{"red"},
+		Credentials:  &Credentials{Name: "edge", Secret: "secret"},
+		Network:      quic_kingip.NetworkTCP,
+		Logger:       logging.Discard(),
+		MinBackoff:   10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { node.Stop() })
+
+	// The relay of another region is left out.
+	select {
+	case <-connA:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not connect to the discovered relay")
+	}
+	assert.Equal(t, []string{addrA}, relayAddrs(node))
+
+	mu.Lock()
+	relays = []RelayInfo{{Addr: addrB}}
+	mu.Unlock()
+	node.Refresh()
+	select {
+	case <-connB:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not connect to the rediscovered relay")
+	}
+	assert.Eventually(t, func() bool {
+		addrs := relayAddrs(node)
+		return len(addrs) == 1 && addrs[0] == addrB
+	}, time.Second, 10*time.Millisecond)
+
+	// Relays set at runtime are used next to the discovered ones.
+	node.SetRelays([]string{addrA})
+	select {
+	case <-connA:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not connect to the relay set at runtime")
+	}
+	assert.ElementsMatch(t, []string{addrA, addrB}, relayAddrs(node))
+}
@@ -0,0 +1,376 @@
+// Package cluster keeps track of the gateways serving the same users.
+// Gateways gossip their membership over HTTP, and relays discover the
+// gateways to connect to from any of them or from DNS SRV records.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+)
+
+var (
+	ErrorNoID      = errors.New("Gateway id is required")
+	ErrorNoAddr    = errors.New("Advertised cluster address is required")
+	ErrorNoSecret  = errors.New("Cluster secret is required")
+	ErrorNoMembers = errors.New("No gateway could be discovered")
+)
+
+// Member is a gateway of the cluster.
+type Member struct {
+	ID string `json:"id"`
+	// Where relays connect to the gateway.
+	RelayAddr string `json:"relay_addr"`
+	// Where the gateway serves the cluster API.
+	Addr string `json:"addr"`
+	// Increased by the gateway every gossip round, members whose
+	// heartbeat stops increasing are dropped.
+	Heartbeat uint64 `json:"heartbeat"`
+	// Set by a gateway that is shutting down.
+	Left bool `json:"left,omitempty"`
+}
+
+type Config struct {
+	// This gateway, with the addresses it is reachable at by other
+	// gateways and relays.
+	Self Member
+	// Cluster API addresses of gateways to join through, host:port or
+	// URLs. Any single live one is enough.
+	Seeds []string
+	// Shared by the gateways of the cluster and the relays discovering
+	// them. Requests to the cluster API without it are rejected.
+	Secret string
+	// How often the member list is exchanged with a random member.
+	GossipInterval time.Duration
+	// Members whose heartbeat did not increase for this long are dropped.
+	DeadTimeout time.Duration
+	// Nil uses a client with a timeout of GossipInterval.
+	Client *http.Client
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Self:           Member{ID: fmt.Sprintf("%016x", rand.Uint64())},
+		GossipInterval: time.Second,
+		DeadTimeout:    10 * time.Second,
+	}
+}
+
+// Cluster is the membership view of one gateway.
+type Cluster struct {
+	config Config
+	logger *slog.Logger
+	now    func() time.Time
+
+	self    Member
+	members map[string]*member
+	mu      sync.Mutex
+}
+
+type member struct {
+	Member
+	// When the heartbeat last increased.
+	updated time.Time
+}
+
+func New(config Config, logger *slog.Logger) (*Cluster, error) {
+	defaults := DefaultConfig()
+	if config.Self.ID == "" {
+		return nil, ErrorNoID
+	}
+	if config.Self.Addr == "" {
+		return nil, ErrorNoAddr
+	}
+	if config.Secret == "" {
+		return nil, ErrorNoSecret
+	}
+	if config.GossipInterval <= 0 {
+		config.GossipInterval = defaults.GossipInterval
+	}
+	if config.DeadTimeout <= 0 {
+		config.DeadTimeout = defaults.DeadTimeout
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: config.GossipInterval}
+	}
+
+	// Starting at the time keeps the heartbeat increasing across restarts.
+	self := config.Self
+	self.Heartbeat, self.Left = uint64(time.Now().UnixMilli()), false
+	return &Cluster{
+		config:  config,
+		logger:  logging.OrDefault(logger).With("gateway", self.ID),
+		now:     time.Now,
+		self:    self,
+		members: make(map[string]*member),
+	}, nil
+}
+
+// Gossips until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		c.gossipRound(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Tells a few members that this gateway is leaving, so relays drop it
+// without waiting for DeadTimeout.
+func (c *Cluster) Leave(ctx context.Context) error {
+	c.mu.Lock()
+	c.self.Heartbeat++
+	c.self.Left = true
+	c.mu.Unlock()
+
+	var errs []error
+	peers := c.peers()
+	for _, addr := range peers[:min(len(peers), 3)] {
+		if _, err := c.push(ctx, addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the live members, this gateway included unless it left, by id.
+func (c *Cluster) Members() []Member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+	var members []Member
+	if !c.self.Left {
+		members = append(members, c.self)
+	}
+	for _, m := range c.members {
+		if !m.Left && !c.dead(m) {
+			members = append(members, m.Member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// Serves the cluster API, to requests that carry the secret as a bearer
+// token:
+//
+//	GET  /members  live members
+//	POST /gossip   merges the posted members, replies with this view
+func (c *Cluster) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", c.handleMembers)
+	mux.HandleFunc("/gossip", c.handleGossip)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, c.config.Secret) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (c *Cluster) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.Members())
+}
+
+func (c *Cluster) handleGossip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var members []Member
+	if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.merge(members)
+	writeJSON(w, c.gossipView())
+}
+
+// Exchanges the member list with a random member or seed.
+func (c *Cluster) gossipRound(ctx context.Context) {
+	c.mu.Lock()
+	c.self.Heartbeat++
+	c.mu.Unlock()
+
+	peers := c.peers()
+	if len(peers) == 0 {
+		return
+	}
+	addr := peers[0]
+	members, err := c.push(ctx, addr)
+	if err != nil {
+		c.logger.Debug("Gossip failed", logging.KeyRemote, addr, logging.Err(err))
+		return
+	}
+	c.merge(members)
+}
+
+// Posts the view of this gateway to the cluster API at addr.
+func (c *Cluster) push(ctx context.Context, addr string) ([]Member, error) {
+	body, err := json.Marshal(c.gossipView())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL(addr, "/gossip"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setSecret(req, c.config.Secret)
+
+	var members []Member
+	if err := do(c.config.Client, req, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Returns members to gossip, which includes those that left so that the
+// others learn about it, but not the dead ones.
+func (c *Cluster) gossipView() []Member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+	members := []Member{c.self}
+	for _, m := range c.members {
+		if !c.dead(m) {
+			members = append(members, m.Member)
+		}
+	}
+	return members
+}
+
+// Keeps the members with a higher heartbeat than known.
+func (c *Cluster) merge(members []Member) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, m := range members {
+		if m.ID == "" || m.ID == c.self.ID {
+			continue
+		}
+		known, ok := c.members[m.ID]
+		if ok && m.Heartbeat <= known.Heartbeat {
+			continue
+		}
+		if !ok && m.Left {
+			continue
+		}
+		switch {
+		case !ok:
+			c.logger.Info("Gateway joined", "member", m.ID, logging.KeyAddr, m.RelayAddr)
+		case m.Left && !known.Left:
+			c.logger.Info("Gateway left", "member", m.ID, logging.KeyAddr, m.RelayAddr)
+		case c.dead(known) && !m.Left:
+			c.logger.Info("Gateway is back", "member", m.ID, logging.KeyAddr, m.RelayAddr)
+		}
+		c.members[m.ID] = &member{Member: m, updated: now}
+	}
+}
+
+// Forgets members that have been dead or gone for long enough that no
+// member still gossips them. The caller holds c.mu.
+func (c *Cluster) expire() {
+	now := c.now()
+	for id, m := range c.members {
+		if now.Sub(m.updated) <= 2*c.config.DeadTimeout {
+			continue
+		}
+		if !m.Left {
+			c.logger.Info("Gateway is dead", "member", id, logging.KeyAddr, m.RelayAddr)
+		}
+		delete(c.members, id)
+	}
+}
+
+func (c *Cluster) dead(m *member) bool {
+	return c.now().Sub(m.updated) > c.config.DeadTimeout
+}
+
+// Returns the cluster API addresses of the live members and the seeds,
+// other than this gateway, in random order.
+func (c *Cluster) peers() []string {
+	c.mu.Lock()
+	seen := map[string]bool{c.self.Addr: true}
+	var peers []string
+	for _, m := range c.members {
+		if !m.Left && !c.dead(m) && !seen[m.Addr] {
+			seen[m.Addr] = true
+			peers = append(peers, m.Addr)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, seed := range c.config.Seeds {
+		if !seen[seed] {
+			seen[seed] = true
+			peers = append(peers, seed)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers
+}
+
+// Returns the URL of a path of the cluster API at addr, which is either
+// host:port or a URL.
+func apiURL(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+func setSecret(req *http.Request, secret string) {
+	req.Header.Set("Authorization", "Bearer "+secret)
+}
+
+func authorized(r *http.Request, secret string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func do(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s from %s", resp.Status, req.URL)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
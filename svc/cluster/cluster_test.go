@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+type testGateway struct {
+	*Cluster
+	server *httptest.Server
+}
+
+func newTestGateway(t *testing.T, id string, seeds ...string) *testGateway {
+	gw := &testGateway{}
+	gw.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw.Handler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(gw.server.Close)
+
+	config := DefaultConfig()
+	config.Self = Member{ID: id, RelayAddr: id + ":4444", Addr: gw.server.URL}
+	config.Seeds = seeds
+	config.Secret = "secret"
+	c, err := New(config, logging.Discard())
+	assert.NoError(t, err)
+	gw.Cluster = c
+	return gw
+}
+
+func memberIDs(members []Member) []string {
+	var ids []string
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestGossip(t *testing.T) {
+	ctx := context.Background()
+	a := newTestGateway(t, "a")
+	b := newTestGateway(t, "b", a.server.URL)
+	c := newTestGateway(t, "c", a.server.URL)
+
+	b.gossipRound(ctx)
+	c.gossipRound(ctx)
+	assert.Equal(t, []string{"a", "b", "c"}, memberIDs(a.Members()))
+	assert.Equal(t, []string{"a", "b"}, memberIDs(b.Members()))
+
+	// b learns about c from a, which it asks as a member or as the seed.
+	b.gossipRound(ctx)
+	assert.Equal(t, []string{"a", "b", "c"}, memberIDs(b.Members()))
+}
+
+func TestDeadMember(t *testing.T) {
+	ctx := context.Background()
+	a := newTestGateway(t, "a")
+	b := newTestGateway(t, "b", a.server.URL)
+	b.gossipRound(ctx)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	now = now.Add(a.config.DeadTimeout + time.Second)
+	assert.Equal(t, []string{"a"}, memberIDs(a.Members()))
+	assert.Equal(t, []string{"a"}, memberIDs(a.gossipView()))
+
+	// A heartbeat brings it back.
+	b.gossipRound(ctx)
+	assert.Equal(t, []string{"a", "b"}, memberIDs(a.Members()))
+
+	now = now.Add(2*a.config.DeadTimeout + time.Second)
+	a.Members()
+	assert.Empty(t, a.members)
+}
+
+func TestLeave(t *testing.T) {
+	ctx := context.Background()
+	a := newTestGateway(t, "a")
+	b := newTestGateway(t, "b", a.server.URL)
+	c := newTestGateway(t, "c", a.server.URL)
+	b.gossipRound(ctx)
+	c.gossipRound(ctx)
+
+	assert.NoError(t, b.Leave(ctx))
+	assert.Equal(t, []string{"a", "c"}, memberIDs(a.Members()))
+	assert.NotContains(t, memberIDs(b.Members()), "b")
+
+	// Others learn about it through gossip.
+	c.gossipRound(ctx)
+	assert.Equal(t, []string{"a", "c"}, memberIDs(c.Members()))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(Config{Self: Member{Addr: "127.0.0.1:4480"}}, nil)
+	assert.ErrorIs(t, err, ErrorNoID)
+
+	_, err = New(Config{Self: Member{ID: "a"}}, nil)
+	assert.ErrorIs(t, err, ErrorNoAddr)
+
+	_, err = New(Config{Self: Member{ID: "a", Addr: "127.0.0.1:4480"}}, nil)
+	assert.ErrorIs(t, err, ErrorNoSecret)
+}
+
+func TestSecret(t *testing.T) {
+	a := newTestGateway(t, "a")
+
+	// A member posted without the secret is not merged.
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req, err := http.NewRequest(http.MethodPost, a.server.URL+"/gossip", strings.NewReader(`[{"id":"x","relay_addr":"attacker:4444","heartbeat":1}]`))
+		assert.NoError(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	assert.Equal(t, []string{"a"}, memberIDs(a.Members()))
+
+	discovery := NewDiscovery(DiscoveryConfig{Seeds: []string{a.server.URL}, Secret: "wrong"})
+	_, err := discovery.Lookup(context.Background())
+	assert.ErrorIs(t, err, ErrorNoMembers)
+}
+
+func TestDiscovery(t *testing.T) {
+	ctx := context.Background()
+	a := newTestGateway(t, "a")
+	b := newTestGateway(t, "b", a.server.URL)
+	b.gossipRound(ctx)
+
+	discovery := NewDiscovery(DiscoveryConfig{
+		Seeds:  []string{"127.0.0.1:1", a.server.URL},
+		SRV:    "_kingip._udp.example.com",
+		Secret: "secret",
+	})
+	discovery.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		return []*net.SRV{{Target: "c.example.com.", Port: 4444}, {Target: "a", Port: 4444}}, nil
+	}
+
+	addrs, err := discovery.Lookup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:4444", "b:4444", "c.example.com:4444"}, addrs)
+
+	// Members found earlier are asked once the seeds are gone.
+	a.server.Close()
+	discovery.lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	addrs, err = discovery.Lookup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:4444", "b:4444"}, addrs)
+
+	b.server.Close()
+	_, err = discovery.Lookup(ctx)
+	assert.ErrorIs(t, err, ErrorNoMembers)
+}
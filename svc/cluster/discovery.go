@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DiscoveryConfig struct {
+	// Cluster API addresses of gateways, host:port or URLs, asked for the
+	// members in order until one answers.
+	Seeds []string
+	// DNS name whose SRV records point at the relay listeners of gateways,
+	// e.g. _kingip._udp.example.com.
+	SRV string
+	// Secret of the cluster, sent to the seeds.
+	Secret string
+	// Nil uses a client with a 5s timeout.
+	Client *http.Client
+}
+
+// Discovery finds the relay listeners of the gateways of a cluster.
+type Discovery struct {
+	config    DiscoveryConfig
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, error)
+
+	// Cluster API addresses of the members found last, asked when none of
+	// the seeds answers.
+	known []string
+	mu    sync.Mutex
+}
+
+func NewDiscovery(config DiscoveryConfig) *Discovery {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &Discovery{
+		config: config,
+		lookupSRV: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return srvs, err
+		},
+	}
+}
+
+// Returns the relay addresses of the gateways from the seeds and from DNS,
+// sorted. Fails only if every configured source failed.
+func (d *Discovery) Lookup(ctx context.Context) ([]string, error) {
+	var (
+		addrs []string
+		errs  []error
+		found bool
+	)
+	if d.config.SRV != "" {
+		srvAddrs, err := d.lookupDNS(ctx)
+		if err == nil {
+			addrs, found = append(addrs, srvAddrs...), true
+		}
+		errs = append(errs, err)
+	}
+	if len(d.config.Seeds) > 0 {
+		members, err := d.lookupMembers(ctx)
+		if err == nil {
+			found = true
+			for _, m := range members {
+				addrs = append(addrs, m.RelayAddr)
+			}
+		}
+		errs = append(errs, err)
+	}
+	if !found {
+		return nil, errors.Join(append(errs, ErrorNoMembers)...)
+	}
+
+	sort.Strings(addrs)
+	return dedup(addrs), nil
+}
+
+func (d *Discovery) lookupDNS(ctx context.Context) ([]string, error) {
+	srvs, err := d.lookupSRV(ctx, d.config.SRV)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+// Asks the seeds, then the members found last, for the members.
+func (d *Discovery) lookupMembers(ctx context.Context) ([]Member, error) {
+	d.mu.Lock()
+	addrs := dedup(append(append([]string{}, d.config.Seeds...), d.known...))
+	d.mu.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		members, err := d.fetch(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		known := make([]string, 0, len(members))
+		for _, m := range members {
+			known = append(known, m.Addr)
+		}
+		d.mu.Lock()
+		d.known = known
+		d.mu.Unlock()
+		return members, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (d *Discovery) fetch(ctx context.Context, addr string) ([]Member, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL(addr, "/members"), nil)
+	if err != nil {
+		return nil, err
+	}
+	setSecret(req, d.config.Secret)
+	var members []Member
+	if err := do(d.config.Client, req, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Removes repeated addresses, keeping the first of each.
+func dedup(addrs []string) []string {
+	seen := make(map[string]bool, len(addrs))
+	unique := addrs[:0]
+	for _, addr := range addrs {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
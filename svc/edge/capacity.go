@@ -0,0 +1,223 @@
+package edge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/proto"
+)
+
+var ErrorSchedule = errors.New("Schedule windows need a start and an end as HH:MM")
+
+const (
+	LimitSessions  = "sessions"
+	LimitBandwidth = "bandwidth"
+)
+
+// Share of the bandwidth limit in use at which the edge counts as full.
+const bandwidthSaturation = 0.95
+
+// How often the bandwidth in use is measured.
+const sampleInterval = time.Second
+
+// CapacityError rejects a session that would exceed a limit of the edge.
+// Relays retry such sessions on another edge.
+type CapacityError struct {
+	// LimitSessions or LimitBandwidth.
+	Limit string
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("Edge is at its %s limit", e.Limit)
+}
+
+// ScheduleWindow replaces the limits of the edge between two times of day,
+// in local time. A window that ends before it starts spans midnight.
+type ScheduleWindow struct {
+	// Times of day as HH:MM.
+	Start string
+	End   string
+	// Zero means unlimited, like the limits of Config.
+	MaxSessions  int
+	MaxBandwidth int64
+}
+
+type window struct {
+	start, end   time.Duration
+	maxSessions  int
+	maxBandwidth int64
+}
+
+func (w window) contains(now time.Time) bool {
+	y, m, d := now.Date()
+	t := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if w.start <= w.end {
+		return t >= w.start && t < w.end
+	}
+	return t >= w.start || t < w.end
+}
+
+func parseSchedule(schedule []ScheduleWindow) ([]window, error) {
+	var windows []window
+	for _, sw := range schedule {
+		start, err := parseTimeOfDay(sw.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(sw.End)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window{
+			start:        start,
+			end:          end,
+			maxSessions:  sw.MaxSessions,
+			maxBandwidth: sw.MaxBandwidth,
+		})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrorSchedule
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Admits sessions within the limits in effect and measures the bandwidth
+// they use.
+type capacity struct {
+	maxSessions  int
+	maxBandwidth int64
+	windows      []window
+	// Nil if no bandwidth limit is configured.
+	limiter *limiter
+	now     func() time.Time
+
+	active      int
+	sampledAt   time.Time
+	sampleBytes int64
+	rate        int64
+	available   bool
+	// Signalled when the edge becomes full or has room again.
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+func newCapacity(config Config) (*capacity, error) {
+	windows, err := parseSchedule(config.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capacity{
+		maxSessions:  config.MaxSessions,
+		maxBandwidth: config.MaxBandwidth,
+		windows:      windows,
+		now:          time.Now,
+		available:    true,
+		changed:      make(chan struct{}, 1),
+	}
+
+	limited := config.MaxBandwidth > 0
+	for _, w := range windows {
+		limited = limited || w.maxBandwidth > 0
+	}
+	if limited {
+		c.limiter = newLimiter(0)
+	}
+	c.sampledAt = c.now()
+	return c, nil
+}
+
+// Returns the limits in effect at now, from the first window containing
+// it.
+func (c *capacity) limits(now time.Time) (int, int64) {
+	for _, w := range c.windows {
+		if w.contains(now) {
+			return w.maxSessions, w.maxBandwidth
+		}
+	}
+	return c.maxSessions, c.maxBandwidth
+}
+
+// Reserves a session, the returned func releases it.
+func (c *capacity) acquire() (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capacity := c.update()
+	if !capacity.Available {
+		if capacity.Sessions == 0 {
+			return nil, &CapacityError{Limit: LimitSessions}
+		}
+		return nil, &CapacityError{Limit: LimitBandwidth}
+	}
+
+	c.active++
+	c.update()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.active--
+			c.update()
+		})
+	}, nil
+}
+
+func (c *capacity) get() proto.Capacity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.update()
+}
+
+// Applies the limits in effect, measures the bandwidth in use and returns
+// what is left.
+func (c *capacity) update() proto.Capacity {
+	now := c.now()
+	maxSessions, maxBandwidth := c.limits(now)
+
+	capacity := proto.Capacity{Available: true, Sessions: -1, Bandwidth: -1}
+	if maxSessions > 0 {
+		capacity.Sessions = max(maxSessions-c.active, 0)
+		capacity.Available = capacity.Sessions > 0
+	}
+
+	if c.limiter != nil {
+		c.limiter.setRate(maxBandwidth)
+		if elapsed := now.Sub(c.sampledAt); elapsed >= sampleInterval {
+			bytes := c.limiter.bytes.Load()
+			c.rate = int64(float64(bytes-c.sampleBytes) / elapsed.Seconds())
+			c.sampleBytes, c.sampledAt = bytes, now
+		}
+		if maxBandwidth > 0 {
+			capacity.Bandwidth = max(maxBandwidth-c.rate, 0)
+			if float64(c.rate) >= bandwidthSaturation*float64(maxBandwidth) {
+				capacity.Available = false
+			}
+		}
+	}
+
+	if capacity.Available != c.available {
+		c.available = capacity.Available
+		signal(c.changed)
+	}
+	return capacity
+}
+
+// Wakes up whoever waits on c, without blocking if nobody does.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,78 @@
+package edge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestScheduleWindow(t *testing.T) {
+	windows, err := parseSchedule([]ScheduleWindow{
+		{Start: "08:00", End: "18:00"},
+		{Start: "22:30", End: "06:00"},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, windows[0].contains(at(8, 0)))
+	assert.False(t, windows[0].contains(at(18, 0)))
+	assert.True(t, windows[1].contains(at(23, 0)))
+	assert.True(t, windows[1].contains(at(5, 59)))
+	assert.False(t, windows[1].contains(at(22, 0)))
+
+	_, err = parseSchedule([]ScheduleWindow{{Start: "8am", End: "18:00"}})
+	assert.ErrorIs(t, err, ErrorSchedule)
+}
+
+func TestCapacitySessions(t *testing.T) {
+	c, err := newCapacity(Config{
+		MaxSessions: 1,
+		Schedule:    []ScheduleWindow{{Start: "22:00", End: "06:00", MaxSessions: 2}},
+	})
+	assert.NoError(t, err)
+	c.now = func() time.Time { return at(12, 0) }
+
+	release, err := c.acquire()
+	assert.NoError(t, err)
+	assert.Equal(t, proto.Capacity{Available: false, Sessions: 0, Bandwidth: -1}, c.get())
+	assert.Len(t, c.changed, 1)
+
+	_, err = c.acquire()
+	var capacityErr *CapacityError
+	assert.ErrorAs(t, err, &capacityErr)
+	assert.Equal(t, LimitSessions, capacityErr.Limit)
+
+	// The night window allows one more.
+	c.now = func() time.Time { return at(23, 0) }
+	assert.Equal(t, proto.Capacity{Available: true, Sessions: 1, Bandwidth: -1}, c.get())
+
+	release()
+	release()
+	assert.Equal(t, 2, c.get().Sessions)
+}
+
+func TestCapacityBandwidth(t *testing.T) {
+	c, err := newCapacity(Config{MaxBandwidth: 1000})
+	assert.NoError(t, err)
+	now := at(12, 0)
+	c.now = func() time.Time { return now }
+	c.sampledAt = now
+
+	c.limiter.take(500)
+	now = now.Add(time.Second)
+	assert.Equal(t, proto.Capacity{Available: true, Sessions: -1, Bandwidth: 500}, c.get())
+
+	c.limiter.take(990)
+	now = now.Add(time.Second)
+	assert.False(t, c.get().Available)
+
+	_, err = c.acquire()
+	var capacityErr *CapacityError
+	assert.ErrorAs(t, err, &capacityErr)
+	assert.Equal(t, LimitBandwidth, capacityErr.Limit)
+}
@@ -0,0 +1,340 @@
+package edge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrorDialWaitTimeout = errors.New("Timed out waiting for a dial slot")
+	ErrorNoAddresses     = errors.New("No addresses found for destination")
+	ErrorDialLimits      = errors.New("Dial limits per host and in total must be positive")
+)
+
+type DialerConfig struct {
+	// Max number of dials in flight to a single destination host.
+	MaxPerHost int
+	// Max number of dials in flight across all destinations.
+	MaxTotal int
+	// How long a dial may wait for a free slot before giving up.
+	WaitTimeout time.Duration
+	// Timeout of a whole dial, including all the address attempts.
+	DialTimeout time.Duration
+	// Delay before racing the next address family (RFC 8305).
+	FallbackDelay time.Duration
+	KeepAlive     time.Duration
+}
+
+func DefaultDialerConfig() DialerConfig {
+	return DialerConfig{
+		MaxPerHost:    64,
+		MaxTotal:      4096,
+		WaitTimeout:   5 * time.Second,
+		DialTimeout:   10 * time.Second,
+		FallbackDelay: 300 * time.Millisecond,
+		KeepAlive:     30 * time.Second,
+	}
+}
+
+type DialerStats struct {
+	InFlight     int64
+	Waiting      int64
+	Dials        uint64
+	Failures     uint64
+	WaitTimeouts uint64
+	IPv4         uint64
+	IPv6         uint64
+}
+
+type dialerStats struct {
+	inFlight     atomic.Int64
+	waiting      atomic.Int64
+	dials        atomic.Uint64
+	failures     atomic.Uint64
+	waitTimeouts atomic.Uint64
+	ipv4         atomic.Uint64
+	ipv6         atomic.Uint64
+}
+
+type LookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+type hostSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// Dialer creates destination connections for the edge. Proxied TCP
+// connections are never reused, so instead of pooling it limits how many
+// dials can be in flight per destination host and in total.
+type Dialer struct {
+	config DialerConfig
+	lookup LookupFunc
+	total  chan struct{}
+	hosts  map[string]*hostSlots
+	stats  dialerStats
+	mu     sync.Mutex
+}
+
+func NewDialer(config DialerConfig) (*Dialer, error) {
+	// Without slots every dial would wait out WaitTimeout.
+	if config.MaxPerHost <= 0 || config.MaxTotal <= 0 {
+		return nil, ErrorDialLimits
+	}
+
+	return &Dialer{
+		config: config,
+		lookup: systemLookup,
+		total:  make(chan struct{}, config.MaxTotal),
+		hosts:  make(map[string]*hostSlots),
+	}, nil
+}
+
+func (d *Dialer) Dial(ctx context.Context, destination string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DialIPs(ctx, host, port, ips)
+}
+
+// Dials already resolved addresses of the host, limits are still applied
+// per host name.
+func (d *Dialer) DialIPs(ctx context.Context, host, port string, ips []net.IP) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, ErrorNoAddresses
+	}
+
+	release, err := d.acquire(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	d.stats.dials.Add(1)
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.DialTimeout)
+	defer cancel()
+
+	conn, err := d.dialParallel(ctx, interleave(ips), port)
+	if err != nil {
+		d.stats.failures.Add(1)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) Stats() DialerStats {
+	return DialerStats{
+		InFlight:     d.stats.inFlight.Load(),
+		Waiting:      d.stats.waiting.Load(),
+		Dials:        d.stats.dials.Load(),
+		Failures:     d.stats.failures.Load(),
+		WaitTimeouts: d.stats.waitTimeouts.Load(),
+		IPv4:         d.stats.ipv4.Load(),
+		IPv6:         d.stats.ipv6.Load(),
+	}
+}
+
+func (d *Dialer) acquire(ctx context.Context, host string) (func(), error) {
+	d.stats.waiting.Add(1)
+	defer d.stats.waiting.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.WaitTimeout)
+	defer cancel()
+
+	hs := d.refHost(host)
+
+	select {
+	case hs.slots <- struct{}{}:
+	case <-ctx.Done():
+		d.unrefHost(host)
+		return nil, d.waitError(ctx)
+	}
+
+	select {
+	case d.total <- struct{}{}:
+	case <-ctx.Done():
+		<-hs.slots
+		d.unrefHost(host)
+		return nil, d.waitError(ctx)
+	}
+
+	d.stats.inFlight.Add(1)
+	return func() {
+		d.stats.inFlight.Add(-1)
+		<-d.total
+		<-hs.slots
+		d.unrefHost(host)
+	}, nil
+}
+
+func (d *Dialer) waitError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		d.stats.waitTimeouts.Add(1)
+		return ErrorDialWaitTimeout
+	}
+	return ctx.Err()
+}
+
+func (d *Dialer) refHost(host string) *hostSlots {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hs, ok := d.hosts[host]
+	if !ok {
+		hs = &hostSlots{slots: make(chan struct{}, d.config.MaxPerHost)}
+		d.hosts[host] = hs
+	}
+	hs.refs++
+	return hs
+}
+
+func (d *Dialer) unrefHost(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if hs, ok := d.hosts[host]; ok {
+		hs.refs--
+		if hs.refs <= 0 {
+			delete(d.hosts, host)
+		}
+	}
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// Happy eyeballs: addresses are attempted in order, starting the next
+// attempt when the previous one fails or FallbackDelay passes, whichever
+// happens first. The first established connection wins.
+func (d *Dialer) dialParallel(ctx context.Context, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dialer := net.Dialer{KeepAlive: d.config.KeepAlive}
+	results := make(chan dialResult, len(ips))
+
+	start := func(ip net.IP) {
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+	}
+
+	next, pending := 0, 0
+	var firstErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for next < len(ips) || pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				start(ips[next])
+				next++
+				pending++
+				timer.Reset(d.config.FallbackDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				d.countFamily(res.ip)
+				go drainResults(results, pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			go drainResults(results, pending)
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return nil, firstErr
+		}
+	}
+
+	return nil, firstErr
+}
+
+func (d *Dialer) countFamily(ip net.IP) {
+	if ip.To4() != nil {
+		d.stats.ipv4.Add(1)
+	} else {
+		d.stats.ipv6.Add(1)
+	}
+}
+
+// Closes connections of the attempts that lost the race.
+func drainResults(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// Orders addresses by alternating families, preferring the family of the
+// first address, as described in RFC 8305.
+func interleave(ips []net.IP) []net.IP {
+	var primary, secondary []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			ordered = append(ordered, primary[i])
+		}
+		if i < len(secondary) {
+			ordered = append(ordered, secondary[i])
+		}
+	}
+	return ordered
+}
+
+func systemLookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
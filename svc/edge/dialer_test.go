@@ -0,0 +1,94 @@
+package edge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialerPerHostLimit(t *testing.T) {
+	config := DefaultDialerConfig()
+	config.MaxPerHost = 1
+	config.WaitTimeout = 50 * time.Millisecond
+	dialer, err := NewDialer(config)
+	assert.NoError(t, err)
+
+	release, err := dialer.acquire(context.Background(), "example.com")
+	assert.NoError(t, err)
+
+	_, err = dialer.acquire(context.Background(), "example.com")
+	assert.ErrorIs(t, err, ErrorDialWaitTimeout)
+
+	// Other hosts are not affected by the limit.
+	releaseOther, err := dialer.acquire(context.Background(), "example.org")
+	assert.NoError(t, err)
+	releaseOther()
+
+	release()
+	release, err = dialer.acquire(context.Background(), "example.com")
+	assert.NoError(t, err)
+	release()
+
+	assert.Empty(t, dialer.hosts)
+	assert.Equal(t, uint64(1), dialer.Stats().WaitTimeouts)
+}
+
+func TestDialerFallsBackToNextAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	config := DefaultDialerConfig()
+	config.FallbackDelay = time.Second
+	dialer, err := NewDialer(config)
+	assert.NoError(t, err)
+	dialer.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		// Nothing listens on ::1 with this port, so the dialer should
+		// move on to the second address without waiting for the delay.
+		return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial(context.Background(), net.JoinHostPort("test.local", port))
+	assert.NoError(t, err)
+	conn.Close()
+
+	assert.Less(t, time.Since(start), config.FallbackDelay)
+	assert.Equal(t, uint64(1), dialer.Stats().IPv4)
+}
+
+func TestInterleave(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("::1"),
+		net.ParseIP("::2"),
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+	}
+
+	ordered := interleave(ips)
+	assert.Equal(t, "::1", ordered[0].String())
+	assert.Equal(t, "10.0.0.1", ordered[1].String())
+	assert.Equal(t, "::2", ordered[2].String())
+	assert.Equal(t, "10.0.0.2", ordered[3].String())
+}
+
+func TestDialerInvalidLimits(t *testing.T) {
+	for _, limits := range [][2]int{{0, 1}, {1, 0}, {-1, 1}} {
+		config := DefaultDialerConfig()
+		config.MaxPerHost, config.MaxTotal = limits[0], limits[1]
+		_, err := NewDialer(config)
+		assert.ErrorIs(t, err, ErrorDialLimits)
+	}
+}
@@ -1,83 +1,306 @@
 package edge
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
-	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/pipe"
 	"github.com/bacv/kingip/lib/proto"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/trace"
 	"github.com/bacv/kingip/lib/transport"
+	"github.com/bacv/kingip/lib/watchdog"
 	"github.com/bacv/kingip/svc"
 	"github.com/quic-go/quic-go"
 )
 
+type Config struct {
+	Dialer   DialerConfig
+	Resolver ResolverConfig
+	Health   HealthConfig
+	// Closes sessions that transferred no data for this long, zero
+	// disables it.
+	IdleTimeout time.Duration
+	// Caps the max duration requested by the gateway, zero means no cap.
+	MaxDuration time.Duration
+	// Max concurrent sessions, zero means unlimited.
+	MaxSessions int
+	// Max bytes per second across all sessions in both directions, zero
+	// means unlimited.
+	MaxBandwidth int64
+	// Limits for certain times of day, used instead of MaxSessions and
+	// MaxBandwidth while a window is open. The first open window wins.
+	Schedule []ScheduleWindow
+	// Limits the regions and destinations sessions may use, the zero value
+	// allows everything.
+	ACL svc.UserPolicy
+	// Exports spans of proxied sessions, may be nil.
+	Tracer *trace.Tracer
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Dialer:      DefaultDialerConfig(),
+		Resolver:    DefaultResolverConfig(),
+		Health:      DefaultHealthConfig(),
+		IdleTimeout: 5 * time.Minute,
+	}
+}
+
+type SessionStats struct {
+	Active int64
+	Total  uint64
+	// Sessions that were denied or could not reach their destination.
+	Failures uint64
+	// Sessions rejected because the edge was full.
+	Rejected  uint64
+	BytesUp   uint64
+	BytesDown uint64
+}
+
+type sessionStats struct {
+	active    atomic.Int64
+	total     atomic.Uint64
+	failures  atomic.Uint64
+	rejected  atomic.Uint64
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+}
+
 type Edge struct {
-	connPool *ConnPool
+	config   Config
+	logger   *slog.Logger
+	dialer   *Dialer
+	resolver *Resolver
+	capacity *capacity
+	health   *health
+	stats    sessionStats
 }
 
-func NewEdge() *Edge {
-	return &Edge{connPool: NewConnPool(999)}
+func NewEdge(config Config, logger *slog.Logger) (*Edge, error) {
+	dialer, err := NewDialer(config.Dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := NewResolver(config.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := newCapacity(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Edge{
+		config:   config,
+		logger:   logging.OrDefault(logger),
+		dialer:   dialer,
+		resolver: resolver,
+		capacity: capacity,
+		health:   newHealth(config.Health),
+	}, nil
 }
 
 func (r *Edge) RelayHandle(relayStream quic.Stream) error {
 	// Receive proxy destination and region.
-	destination, _, err := getProxyDetails(relayStream)
+	proxy, relayStream, err := getProxyDetails(relayStream)
 	if err != nil {
-		log.Println("Unable to create proxy", err)
+		relayStream.Close()
+		r.logger.Warn("Unable to create proxy", logging.Err(err))
+		return err
 	}
 
-	if err != nil {
-		log.Println("Unable to create proxy", err)
+	logger := r.logger.With(
+		logging.KeySession, proxy.SessionID,
+		logging.KeyRegion, proxy.Region,
+		logging.KeyDestination, proxy.Destination,
+	)
+	traceID, _ := trace.ParseTraceID(proxy.SessionID)
+	parent, _ := trace.ParseSpanID(proxy.SpanID)
+
+	r.stats.total.Add(1)
+	r.stats.active.Add(1)
+	defer r.stats.active.Add(-1)
+
+	if err := r.config.ACL.Check(svc.Region(proxy.Region), svc.Destination(proxy.Destination)); err != nil {
+		r.stats.failures.Add(1)
+		replyProxy(relayStream, proto.NewMsgDestinationError(err.Error()))
+		relayStream.Close()
+		logger.Warn("Session denied", logging.Err(err))
+		return err
 	}
 
-	//destConn, err := net.Dial("tcp", string(destination))
-	destConn, err := r.connPool.Get(string(destination))
+	release, err := r.capacity.acquire()
 	if err != nil {
-		if err != ErrorMaxHostConns {
-			log.Printf("Error connecting to destination [%s]: %v", destination, err)
-			return err
-		}
+		r.stats.rejected.Add(1)
+		replyProxy(relayStream, proto.NewMsgRetry(err.Error()))
+		relayStream.Close()
+		logger.Info("Session rejected", logging.Err(err))
+		return err
+	}
+	defer release()
 
-		<-time.After(50 * time.Millisecond)
-		destConn, err = r.connPool.Get(string(destination))
+	dial := r.config.Tracer.Start("edge.dial", traceID, parent)
+	dial.SetAttr("destination", proxy.Destination)
+	destConn, err := r.connect(context.Background(), proxy, logger)
+	if err == nil {
+		r.health.record(true)
+	} else if uplinkFailure(err) {
+		r.health.record(false)
+	}
+	if err != nil {
+		r.stats.failures.Add(1)
+		dial.End(err)
+		replyProxy(relayStream, connectError(err))
+		relayStream.Close()
+		logger.Warn("Error connecting to destination", logging.Err(err))
+		return err
+	}
+	dial.SetAttr("exit_ip", exitIP(destConn))
+	dial.End(nil)
 
-		if err != nil {
-			log.Printf("Error connecting to destination [%s]: %v", destination, err)
-			return err
-		}
+	if err := replyProxy(relayStream, proto.NewMsgProxySuccess(proto.ProxyResult{
+		ExitIP: exitIP(destConn),
+	})); err != nil {
+		destConn.Close()
+		logger.Warn("Unable to reply to proxy request", logging.Err(err))
+		return err
 	}
 
-	log.Printf("Created connection to [%s]", destination)
+	logger.Info("Created connection", logging.KeyPath, strings.Join(proxy.Path, " > "), "exit_ip", exitIP(destConn))
 
-	go transferData(relayStream, destConn)
-	transferData(destConn, relayStream)
+	transfer := r.config.Tracer.Start("edge.transfer", dial.TraceID(), parent)
+	maxDuration := watchdog.Shortest(r.config.MaxDuration, proxy.MaxDuration)
+	destEnd := pipe.Conn(destConn)
+	timeout := watchdog.Start(r.config.IdleTimeout, maxDuration, func(err error) {
+		logger.Info("Closing session", logging.Err(err))
+		quic_kingip.CancelStream(relayStream, quic_kingip.StreamErrorCodeTimeout)
+		destEnd.Abort(err)
+	})
+
+	res := pipe.Run(
+		r.capacity.limiter.limit(quic_kingip.StreamEnd(relayStream)),
+		r.capacity.limiter.limit(destEnd),
+		timeout.Touch,
+	)
+	timeout.Stop()
+	r.stats.bytesUp.Add(uint64(res.AToB))
+	r.stats.bytesDown.Add(uint64(res.BToA))
+	if res.Err != nil {
+		logger.Debug("Transfer failed", logging.Err(res.Err))
+	}
+	transfer.SetAttr("bytes_up", strconv.FormatInt(res.AToB, 10))
+	transfer.SetAttr("bytes_down", strconv.FormatInt(res.BToA, 10))
+	transfer.End(errors.Join(timeout.Err(), res.Err))
 
 	return nil
 }
 
-func getProxyDetails(stream quic.Stream) (svc.Destination, svc.Region, error) {
-	t := transport.NewTransport(stream, nil)
-	defer t.Abandon()
-	bufReader := bufio.NewReader(t)
-	bytes, err := bufReader.ReadSlice(proto.ByteLF)
+func (r *Edge) connect(ctx context.Context, proxy proto.GatewayProxy, logger *slog.Logger) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(proxy.Destination)
+	if err != nil {
+		return nil, err
+	}
 
-	mt, proxy, err := proto.Message(bytes).UnmarshalMap()
+	res, err := r.resolver.Resolve(ctx, host, proxy.Resolve == proto.ResolveRemote)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	if proto.MsgGatewayProxy != mt {
-		return "", "", errors.New("Wrong protocol message")
+	if !res.Cached && res.Upstream != "" {
+		logger.Debug("Resolved destination", "upstream", res.Upstream, "duration", res.Duration)
 	}
 
-	t.Write(proto.NewMsgSuccess())
-	return svc.Destination(proxy["destination"]), svc.Region(proxy["region"]), nil
+	return r.dialer.DialIPs(ctx, host, port, res.IPs)
 }
 
-func transferData(dst svc.Conn, src svc.Conn) {
-	defer dst.Close()
-	defer src.Close()
-	io.Copy(dst, src)
+// Replies to a session that could not connect. Only failures of the
+// uplink count against the edge on its relay.
+func connectError(err error) proto.Message {
+	if uplinkFailure(err) {
+		return proto.NewMsgError(err.Error())
+	}
+	return proto.NewMsgDestinationError(err.Error())
+}
+
+func (r *Edge) SessionStats() SessionStats {
+	return SessionStats{
+		Active:    r.stats.active.Load(),
+		Total:     r.stats.total.Load(),
+		Failures:  r.stats.failures.Load(),
+		Rejected:  r.stats.rejected.Load(),
+		BytesUp:   r.stats.bytesUp.Load(),
+		BytesDown: r.stats.bytesDown.Load(),
+	}
+}
+
+// Returns what is left of the limits in effect, to be advertised to
+// relays.
+func (r *Edge) Capacity() proto.Capacity {
+	return r.capacity.get()
+}
+
+// Signalled when the edge becomes full or has room again. Limits that
+// change with the schedule and the bandwidth in use are only noticed when
+// Capacity is called, which should happen about every second.
+func (r *Edge) CapacityChanged() <-chan struct{} {
+	return r.capacity.changed
+}
+
+// Probes the health check targets and returns whether the edge is healthy.
+// Meant to be called every Health.Interval.
+func (r *Edge) CheckHealth(ctx context.Context) bool {
+	return r.health.check(ctx)
+}
+
+// Signalled when the edge becomes unhealthy or healthy again, unhealthy
+// edges should withdraw their regions.
+func (r *Edge) HealthChanged() <-chan struct{} {
+	return r.health.changed
+}
+
+func (r *Edge) HealthStats() HealthStats {
+	return r.health.stats()
+}
+
+func (r *Edge) DialerStats() DialerStats {
+	return r.dialer.Stats()
+}
+
+func (r *Edge) ResolverStats() ResolverStats {
+	return r.resolver.Stats()
+}
+
+// Reads the proxy request and returns the stream to copy the session
+// data from, which starts with any bytes sent right after the request.
+func getProxyDetails(stream quic.Stream) (proto.GatewayProxy, quic.Stream, error) {
+	t := transport.NewTransport(stream, nil)
+	msg, err := t.ReadMessage()
+	stream = quic_kingip.AbandonTransport(stream, t)
+	if err != nil {
+		return proto.GatewayProxy{}, stream, err
+	}
+
+	proxy, err := msg.UnmarshalGatewayProxy()
+	return proxy, stream, err
+}
+
+func replyProxy(stream quic.Stream, msg proto.Message) error {
+	return transport.NewTransport(stream, nil).Write(msg)
+}
+
+func exitIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
 }
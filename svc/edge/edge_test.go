@@ -0,0 +1,137 @@
+package edge
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/proto"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/transport"
+	"github.com/quic-go/quic-go"
+)
+
+// Serves destination connections that either swallow everything sent to
+// them or send size bytes and close.
+func serveDestination(b *testing.B, size int64, download bool) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if download {
+					io.CopyN(conn, zeroReader{}, size)
+					return
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Connects a relay side to an edge over QUIC on loopback and returns the
+// relay side of the connection.
+func connectEdge(b *testing.B, edge *Edge) quic.Connection {
+	ln, err := quic.ListenAddr("127.0.0.1:0", quic_kingip.GenerateTLSConfig(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+
+	edgeConn, err := quic.DialAddr(context.Background(), ln.Addr().String(), quic_kingip.TlsClientConfig.Clone(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { edgeConn.CloseWithError(0, "") })
+
+	go func() {
+		for {
+			stream, err := edgeConn.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go edge.RelayHandle(stream)
+		}
+	}()
+
+	relayConn, err := ln.Accept(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return relayConn
+}
+
+// Runs one session per iteration through the edge, moving size bytes to
+// or from the destination.
+func benchmarkSession(b *testing.B, size int64, download bool) {
+	edge, err := NewEdge(DefaultConfig(), logging.Discard())
+	if err != nil {
+		b.Fatal(err)
+	}
+	relayConn := connectEdge(b, edge)
+	msg := proto.NewMsgGatewayProxy(proto.GatewayProxy{
+		Destination: serveDestination(b, size, download),
+	})
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		stream, err := relayConn.OpenStreamSync(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		stream, err = quic_kingip.SyncTransport(stream, func(w transport.ResponseWriter, r proto.Message) error {
+			_, err := r.UnmarshalProxyResult()
+			return err
+		}, msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if download {
+			stream.Close()
+			if n, err := io.Copy(io.Discard, stream); err != nil || n != size {
+				b.Fatalf("received %d bytes: %v", n, err)
+			}
+			continue
+		}
+		if _, err := io.CopyN(stream, zeroReader{}, size); err != nil {
+			b.Fatal(err)
+		}
+		stream.Close()
+		io.Copy(io.Discard, stream)
+	}
+}
+
+func BenchmarkSessionUpload(b *testing.B) {
+	benchmarkSession(b, 1<<20, false)
+}
+
+func BenchmarkSessionDownload(b *testing.B) {
+	benchmarkSession(b, 1<<20, true)
+}
+
+func BenchmarkSessionSmall(b *testing.B) {
+	benchmarkSession(b, 1<<10, true)
+}
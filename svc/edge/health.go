@@ -0,0 +1,189 @@
+package edge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type HealthConfig struct {
+	// Addresses dialed over TCP to check the uplink. The check passes if
+	// any of them connects, none disables probing.
+	Targets  []string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Number of recent sessions the success rate is taken over.
+	Window int
+	// The edge is unhealthy while fewer sessions than this reach their
+	// destination, once at least MinSessions are in the window.
+	MinSuccessRate float64
+	MinSessions    int
+}
+
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		Interval:       30 * time.Second,
+		Timeout:        5 * time.Second,
+		Window:         20,
+		MinSuccessRate: 0.5,
+		MinSessions:    10,
+	}
+}
+
+type HealthStats struct {
+	Healthy bool
+	// Success rate of the recent sessions, 1 if there were none.
+	SuccessRate float64
+	// Result of the last probe round, true if no targets are set.
+	ProbeOK bool
+	// Number of times the edge became unhealthy.
+	Withdrawals uint64
+}
+
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Tracks whether the edge can reach the internet, from probes of known
+// targets and from the outcomes of real sessions.
+type health struct {
+	config HealthConfig
+	dial   DialFunc
+
+	outcomes    []bool
+	next        int
+	count       int
+	probeOK     bool
+	healthy     bool
+	withdrawals uint64
+	// Signalled when the edge becomes unhealthy or healthy again.
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+func newHealth(config HealthConfig) *health {
+	var dialer net.Dialer
+	return &health{
+		config:   config,
+		dial:     dialer.DialContext,
+		outcomes: make([]bool, max(config.Window, 1)),
+		probeOK:  true,
+		healthy:  true,
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// Records whether a session reached its destination.
+func (h *health) record(ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.outcomes[h.next] = ok
+	h.next = (h.next + 1) % len(h.outcomes)
+	h.count = min(h.count+1, len(h.outcomes))
+	h.update()
+}
+
+// Whether a failed session setup points at the uplink rather than at the
+// destination. Unknown names and refused connections say nothing about
+// the uplink, timeouts and unreachable networks do.
+func uplinkFailure(err error) bool {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	case errors.Is(err, ErrorResolveNoAnswer),
+		errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETDOWN),
+		errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Probes the targets. An unhealthy edge gets no sessions to measure, so a
+// passing probe round also starts the session window over.
+func (h *health) check(ctx context.Context) bool {
+	ok := h.probe(ctx)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.probeOK = ok
+	if ok && !h.healthy {
+		h.next, h.count = 0, 0
+	}
+	h.update()
+	return h.healthy
+}
+
+func (h *health) probe(ctx context.Context) bool {
+	if len(h.config.Targets) == 0 {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	resultC := make(chan bool, len(h.config.Targets))
+	for _, target := range h.config.Targets {
+		go func(target string) {
+			conn, err := h.dial(ctx, "tcp", target)
+			if err == nil {
+				conn.Close()
+			}
+			resultC <- err == nil
+		}(target)
+	}
+
+	for range h.config.Targets {
+		if <-resultC {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *health) successRate() float64 {
+	if h.count == 0 {
+		return 1
+	}
+
+	var ok int
+	for i := 0; i < h.count; i++ {
+		if h.outcomes[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(h.count)
+}
+
+func (h *health) update() {
+	healthy := h.probeOK
+	if h.count >= h.config.MinSessions && h.successRate() < h.config.MinSuccessRate {
+		healthy = false
+	}
+
+	if healthy != h.healthy {
+		h.healthy = healthy
+		if !healthy {
+			h.withdrawals++
+		}
+		signal(h.changed)
+	}
+}
+
+func (h *health) stats() HealthStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return HealthStats{
+		Healthy:     h.healthy,
+		SuccessRate: h.successRate(),
+		ProbeOK:     h.probeOK,
+		Withdrawals: h.withdrawals,
+	}
+}
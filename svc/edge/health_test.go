@@ -0,0 +1,88 @@
+package edge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the address of a listener that accepts and closes connections,
+// and a func that stops it.
+func probeTarget(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestHealthProbe(t *testing.T) {
+	up, _ := probeTarget(t)
+	down, stop := probeTarget(t)
+	stop()
+
+	config := DefaultHealthConfig()
+	config.Targets = []string{down, up}
+	h := newHealth(config)
+	assert.True(t, h.check(context.Background()))
+
+	config.Targets = []string{down}
+	h = newHealth(config)
+	assert.False(t, h.check(context.Background()))
+	assert.Len(t, h.changed, 1)
+	assert.Equal(t, uint64(1), h.stats().Withdrawals)
+}
+
+func TestHealthSessions(t *testing.T) {
+	config := DefaultHealthConfig()
+	config.MinSessions = 4
+	h := newHealth(config)
+
+	// Too few sessions to judge.
+	for i := 0; i < 3; i++ {
+		h.record(false)
+	}
+	assert.True(t, h.stats().Healthy)
+
+	h.record(true)
+	h.record(false)
+	stats := h.stats()
+	assert.False(t, stats.Healthy)
+	assert.InDelta(t, 0.2, stats.SuccessRate, 0.01)
+
+	// A passing check gives the edge another chance.
+	assert.True(t, h.check(context.Background()))
+	assert.Equal(t, 1.0, h.stats().SuccessRate)
+}
+
+func TestUplinkFailure(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	assert.True(t, uplinkFailure(opErr(syscall.ENETUNREACH)))
+	assert.True(t, uplinkFailure(&net.DNSError{Err: "i/o timeout", IsTimeout: true}))
+	assert.True(t, uplinkFailure(ErrorResolveNoAnswer))
+	assert.True(t, uplinkFailure(context.DeadlineExceeded))
+
+	// Failures of the destination.
+	assert.False(t, uplinkFailure(opErr(syscall.ECONNREFUSED)))
+	assert.False(t, uplinkFailure(&net.DNSError{Err: "no such host", IsNotFound: true}))
+	assert.False(t, uplinkFailure(ErrorNoAddresses))
+	assert.False(t, uplinkFailure(ErrorDialWaitTimeout))
+	assert.False(t, uplinkFailure(errors.New("DNS query failed: RCodeNameError")))
+}
@@ -0,0 +1,91 @@
+package edge
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bacv/kingip/lib/pipe"
+)
+
+// Smallest burst of the limiter, so a single copy buffer of the pipe always
+// fits.
+const minBurst = 32 * 1024
+
+// Token bucket shared by all sessions of an edge. Reads take their bytes
+// after the fact and sleep off any debt, so the bucket may go negative by
+// at most one read. It also counts the bytes passed, to measure usage.
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	bytes  atomic.Int64
+	mu     sync.Mutex
+}
+
+func newLimiter(rate int64) *limiter {
+	l := &limiter{last: time.Now()}
+	l.setRate(rate)
+	l.tokens = l.burst
+	return l
+}
+
+// Zero means unlimited, bytes are still counted.
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(rate) == l.rate {
+		return
+	}
+	l.rate = float64(max(rate, 0))
+	l.burst = max(l.rate, minBurst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// Takes n bytes from the bucket and returns how long to wait before they
+// may be passed on.
+func (l *limiter) take(n int) time.Duration {
+	l.bytes.Add(int64(n))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Returns end with its reads throttled by l.
+func (l *limiter) limit(end pipe.End) pipe.End {
+	if l == nil {
+		return end
+	}
+	return &limitedEnd{End: end, limiter: l}
+}
+
+type limitedEnd struct {
+	pipe.End
+	limiter *limiter
+}
+
+func (e *limitedEnd) Read(p []byte) (int, error) {
+	n, err := e.End.Read(p)
+	if n > 0 {
+		if d := e.limiter.take(n); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
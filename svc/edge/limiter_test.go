@@ -0,0 +1,27 @@
+package edge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(0)
+	assert.Zero(t, l.take(10<<20))
+	assert.Equal(t, int64(10<<20), l.bytes.Load())
+}
+
+func TestLimiterTake(t *testing.T) {
+	l := newLimiter(1 << 20)
+
+	// The burst passes right away, the debt beyond it is slept off.
+	assert.Zero(t, l.take(1<<20))
+	d := l.take(1 << 19)
+	assert.InDelta(t, 500*time.Millisecond, d, float64(50*time.Millisecond))
+
+	// A lower rate takes longer to pay off the same debt.
+	l.setRate(1 << 19)
+	assert.InDelta(t, 2*time.Second, l.take(1<<19), float64(100*time.Millisecond))
+}
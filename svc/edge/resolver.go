@@ -0,0 +1,487 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	ErrorResolverScheme  = errors.New("Unsupported resolver scheme")
+	ErrorResolveNoAnswer = errors.New("No answer from resolvers")
+	ErrorDNSResponse     = errors.New("Invalid DNS response")
+	ErrorNoUpstreams     = errors.New("Remote resolution requires upstream servers")
+)
+
+const systemUpstream = "system"
+
+type ResolverConfig struct {
+	// Upstream servers, e.g. "udp://1.1.1.1:53", "tcp://8.8.8.8:53" or
+	// "https://dns.google/dns-query". When empty the system resolver is used.
+	Servers []string
+	// Timeout of a single query to a single upstream.
+	Timeout time.Duration
+	// Max number of cached hostnames, zero disables the cache.
+	CacheSize int
+	// Bounds applied to the TTL of cached answers.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Never fall back to the system resolver, even for default requests.
+	// Requires Servers.
+	RemoteOnly bool
+}
+
+func DefaultResolverConfig() ResolverConfig {
+	return ResolverConfig{
+		Timeout:   2 * time.Second,
+		CacheSize: 10_000,
+		MinTTL:    10 * time.Second,
+		MaxTTL:    time.Hour,
+	}
+}
+
+type ResolverStats struct {
+	Lookups   uint64
+	CacheHits uint64
+	Failures  uint64
+	// Cumulative time spent resolving uncached names.
+	ResolveTime time.Duration
+}
+
+type resolverStats struct {
+	lookups     atomic.Uint64
+	cacheHits   atomic.Uint64
+	failures    atomic.Uint64
+	resolveTime atomic.Int64
+}
+
+// Resolution describes how a single hostname was resolved.
+type Resolution struct {
+	IPs      []net.IP
+	Cached   bool
+	Upstream string
+	Duration time.Duration
+}
+
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+type cacheEntry struct {
+	ips      []net.IP
+	upstream string
+	expires  time.Time
+}
+
+// Resolver resolves destination hostnames on the edge, so the answers match
+// the edge's location and queries do not leak to other regions.
+type Resolver struct {
+	config    ResolverConfig
+	upstreams []upstream
+	cache     map[string]cacheEntry
+	stats     resolverStats
+	mu        sync.Mutex
+}
+
+func NewResolver(config ResolverConfig) (*Resolver, error) {
+	if config.RemoteOnly && len(config.Servers) == 0 {
+		return nil, ErrorNoUpstreams
+	}
+
+	r := &Resolver{
+		config: config,
+		cache:  make(map[string]cacheEntry),
+	}
+
+	for _, server := range config.Servers {
+		u, err := newUpstream(server, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	return r, nil
+}
+
+func (r *Resolver) Resolve(ctx context.Context, host string, remoteOnly bool) (Resolution, error) {
+	r.stats.lookups.Add(1)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return Resolution{IPs: []net.IP{ip}}, nil
+	}
+
+	remoteOnly = remoteOnly || r.config.RemoteOnly
+
+	// Answers that came from the system resolver don't satisfy remote-only
+	// requests.
+	if entry, ok := r.cached(host); ok && !(remoteOnly && entry.upstream == systemUpstream) {
+		r.stats.cacheHits.Add(1)
+		return Resolution{IPs: entry.ips, Cached: true, Upstream: entry.upstream}, nil
+	}
+
+	start := time.Now()
+	ips, upstream, ttl, err := r.resolve(ctx, host, remoteOnly)
+	duration := time.Since(start)
+	r.stats.resolveTime.Add(int64(duration))
+
+	if err != nil {
+		r.stats.failures.Add(1)
+		return Resolution{Duration: duration}, err
+	}
+
+	r.store(host, ips, upstream, ttl)
+	return Resolution{IPs: ips, Upstream: upstream, Duration: duration}, nil
+}
+
+func (r *Resolver) Stats() ResolverStats {
+	return ResolverStats{
+		Lookups:     r.stats.lookups.Load(),
+		CacheHits:   r.stats.cacheHits.Load(),
+		Failures:    r.stats.failures.Load(),
+		ResolveTime: time.Duration(r.stats.resolveTime.Load()),
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, host string, remoteOnly bool) ([]net.IP, string, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		if remoteOnly {
+			return nil, "", 0, ErrorNoUpstreams
+		}
+		ips, err := systemLookup(ctx, host)
+		return ips, systemUpstream, r.config.MinTTL, err
+	}
+
+	var lastErr error = ErrorResolveNoAnswer
+	for _, u := range r.upstreams {
+		ips, ttl, err := lookupUpstream(ctx, u, host)
+		if err == nil {
+			return ips, u.String(), ttl, nil
+		}
+		lastErr = err
+	}
+
+	if remoteOnly {
+		return nil, "", 0, lastErr
+	}
+
+	ips, err := systemLookup(ctx, host)
+	if err != nil {
+		return nil, "", 0, lastErr
+	}
+	return ips, systemUpstream, r.config.MinTTL, nil
+}
+
+func (r *Resolver) cached(host string) (cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[host]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, host)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (r *Resolver) store(host string, ips []net.IP, upstream string, ttl time.Duration) {
+	if r.config.CacheSize <= 0 {
+		return
+	}
+
+	if ttl < r.config.MinTTL {
+		ttl = r.config.MinTTL
+	}
+	if r.config.MaxTTL > 0 && ttl > r.config.MaxTTL {
+		ttl = r.config.MaxTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= r.config.CacheSize {
+		r.evict()
+	}
+	r.cache[host] = cacheEntry{ips: ips, upstream: upstream, expires: time.Now().Add(ttl)}
+}
+
+// Drops expired entries, or an arbitrary one if none has expired yet.
+func (r *Resolver) evict() {
+	now := time.Now()
+	for host, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+	if len(r.cache) < r.config.CacheSize {
+		return
+	}
+	for host := range r.cache {
+		delete(r.cache, host)
+		return
+	}
+}
+
+type lookupResult struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// Queries A and AAAA records in parallel and merges the answers.
+func lookupUpstream(ctx context.Context, u upstream, host string) ([]net.IP, time.Duration, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan lookupResult, len(types))
+
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := query(ctx, u, host, qtype)
+			results <- lookupResult{ips: ips, ttl: ttl, err: err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var lastErr error
+	for range types {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		if len(res.ips) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = ErrorNoAddresses
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+func query(ctx context.Context, u upstream, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := u.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseAnswers(resp, id)
+}
+
+func parseAnswers(resp []byte, id uint16) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	if msg.Header.ID != id || !msg.Header.Response {
+		return nil, 0, ErrorDNSResponse
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS query failed: %s", msg.Header.RCode)
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if ttl == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func dnsName(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
+
+func newUpstream(server string, timeout time.Duration) (upstream, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Host, "53")
+		}
+		return &netUpstream{network: u.Scheme, addr: addr, timeout: timeout}, nil
+	case "https":
+		return &dohUpstream{url: server, client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorResolverScheme, server)
+	}
+}
+
+// Plain DNS over UDP or TCP (RFC 1035).
+type netUpstream struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+func (u *netUpstream) String() string {
+	return u.network + "://" + u.addr
+}
+
+func (u *netUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if u.network == "tcp" {
+		return exchangeTCP(ctx, u.addr, query)
+	}
+
+	resp, err := exchangeUDP(ctx, u.addr, query)
+	// Answers that do not fit in a datagram come truncated, the server
+	// sends them in full over TCP.
+	if err == nil && truncated(resp) {
+		return exchangeTCP(ctx, u.addr, query)
+	}
+	return resp, err
+}
+
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	conn, err := dialDNS(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	conn, err := dialDNS(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// TCP messages are prefixed with a two byte length.
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func dialDNS(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// Whether the TC bit of the response header is set.
+func truncated(resp []byte) bool {
+	return len(resp) > 2 && resp[2]&0x02 != 0
+}
+
+// DNS over HTTPS (RFC 8484).
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query failed: %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
@@ -0,0 +1,169 @@
+package edge
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answers every A query with 10.0.0.1 and leaves AAAA queries empty.
+func serveDNS(t *testing.T, conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(answerDNS(t, buf[:n], false), addr)
+	}
+}
+
+// Like serveDNS over TCP.
+func serveDNSTCP(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			req := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, req); err == nil {
+				resp := answerDNS(t, req, false)
+				conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+				conn.Write(resp)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// Returns the response to a query, without answers and with the TC bit
+// set if truncated.
+func answerDNS(t *testing.T, query []byte, truncated bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.Header.ID, Response: true, Truncated: truncated},
+		Questions: req.Questions,
+	}
+	if q := req.Questions[0]; q.Type == dnsmessage.TypeA && !truncated {
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		}}
+	}
+
+	packed, _ := resp.Pack()
+	return packed
+}
+
+func TestResolverUpstreamAndCache(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	go serveDNS(t, conn)
+
+	config := DefaultResolverConfig()
+	config.Servers = []string{"udp://" + conn.LocalAddr().String()}
+	resolver, err := NewResolver(config)
+	assert.NoError(t, err)
+
+	res, err := resolver.Resolve(context.Background(), "example.com", true)
+	assert.NoError(t, err)
+	assert.False(t, res.Cached)
+	assert.Equal(t, "udp://"+conn.LocalAddr().String(), res.Upstream)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1).To4()}, res.IPs)
+
+	res, err = resolver.Resolve(context.Background(), "example.com", true)
+	assert.NoError(t, err)
+	assert.True(t, res.Cached)
+
+	stats := resolver.Stats()
+	assert.Equal(t, uint64(2), stats.Lookups)
+	assert.Equal(t, uint64(1), stats.CacheHits)
+}
+
+func TestResolverRemoteOnlyDoesNotFallBack(t *testing.T) {
+	// Nothing answers on this address.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	config := DefaultResolverConfig()
+	config.Servers = []string{"tcp://" + addr}
+	resolver, err := NewResolver(config)
+	assert.NoError(t, err)
+
+	_, err = resolver.Resolve(context.Background(), "localhost", true)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), resolver.Stats().Failures)
+}
+
+func TestResolverRemoteOnlyWithoutUpstreams(t *testing.T) {
+	resolver, err := NewResolver(DefaultResolverConfig())
+	assert.NoError(t, err)
+
+	// A system answer in the cache doesn't count either.
+	_, err = resolver.Resolve(context.Background(), "localhost", false)
+	assert.NoError(t, err)
+	_, err = resolver.Resolve(context.Background(), "localhost", true)
+	assert.ErrorIs(t, err, ErrorNoUpstreams)
+
+	config := DefaultResolverConfig()
+	config.RemoteOnly = true
+	_, err = NewResolver(config)
+	assert.ErrorIs(t, err, ErrorNoUpstreams)
+}
+
+func TestResolverUnsupportedScheme(t *testing.T) {
+	config := DefaultResolverConfig()
+	config.Servers = []string{"tls://1.1.1.1"}
+
+	_, err := NewResolver(config)
+	assert.ErrorIs(t, err, ErrorResolverScheme)
+}
+
+func TestResolverTruncatedRetriesTCP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	ln, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Skip("TCP port of the UDP server is taken:", err)
+	}
+	defer ln.Close()
+	go serveDNSTCP(t, ln)
+
+	// The UDP server only ever sends truncated answers.
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answerDNS(t, buf[:n], true), addr)
+		}
+	}()
+
+	config := DefaultResolverConfig()
+	config.Servers = []string{"udp://" + conn.LocalAddr().String()}
+	resolver, err := NewResolver(config)
+	assert.NoError(t, err)
+
+	res, err := resolver.Resolve(context.Background(), "example.com", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1).To4()}, res.IPs)
+}
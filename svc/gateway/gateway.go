@@ -1,22 +1,29 @@
 package gateway
 
 import (
+	"context"
 	"errors"
-	"io"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/bacv/kingip/lib/accesslog"
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/pipe"
 	"github.com/bacv/kingip/lib/proto"
 	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/trace"
 	"github.com/bacv/kingip/lib/transport"
+	"github.com/bacv/kingip/lib/watchdog"
 	"github.com/bacv/kingip/svc"
 	"github.com/quic-go/quic-go"
 )
 
 type relayConn struct {
-	conn    quic.Connection
+	conn    quic_kingip.Conn
 	stopC   chan error
 	regions []svc.Region
 	mu      sync.Mutex
@@ -47,7 +54,30 @@ func (r *relayConn) stop() {
 	close(r.stopC)
 }
 
+var (
+	ErrorDraining      = errors.New("Gateway is shutting down")
+	ErrorNoCredentials = errors.New("No credentials")
+)
+
+// Max number of relays a session is set up on while edges are full.
+const maxSetupAttempts = 3
+
+type Config struct {
+	// Receives a record of every session once it is closed, may be nil.
+	AccessLog *accesslog.Logger
+	// Exports spans of session phases, may be nil.
+	Tracer *trace.Tracer
+	// Closes sessions that transferred no data for this long, zero
+	// disables it.
+	IdleTimeout time.Duration
+	// Ask edges to resolve destinations with their own upstream resolvers
+	// only, so user DNS never leaves the edge region.
+	RemoteResolve bool
+}
+
 type Gateway struct {
+	config         Config
+	logger         *slog.Logger
 	bandwidthStore svc.BandwidthStore
 	userStore      svc.UserStore
 	sessionStore   svc.SessionStore
@@ -55,10 +85,16 @@ type Gateway struct {
 	relayConns map[svc.RelayID]*relayConn
 	regions    *svc.RegionCache
 	mu         sync.RWMutex
+
+	sessions sync.WaitGroup
+	draining bool
+	drainMu  sync.Mutex
 }
 
-func NewGateway(userStore svc.UserStore, bandwidthStore svc.BandwidthStore, sessionStore svc.SessionStore) *Gateway {
+func NewGateway(config Config, logger *slog.Logger, userStore svc.UserStore, bandwidthStore svc.BandwidthStore, sessionStore svc.SessionStore) *Gateway {
 	return &Gateway{
+		config:         config,
+		logger:         logging.OrDefault(logger),
 		userStore:      userStore,
 		bandwidthStore: bandwidthStore,
 		sessionStore:   sessionStore,
@@ -68,7 +104,7 @@ func NewGateway(userStore svc.UserStore, bandwidthStore svc.BandwidthStore, sess
 	}
 }
 
-func (g *Gateway) RegisterHandle(conn quic.Connection) (uint64, <-chan error, error) {
+func (g *Gateway) RegisterHandle(conn quic_kingip.Conn, _ *quic_kingip.Peer) (uint64, <-chan error, error) {
 	relayId, stopC := g.registerRelay(conn)
 	return uint64(relayId), stopC, nil
 }
@@ -77,6 +113,14 @@ func (g *Gateway) RegionsHandle(id uint64, regions map[string]string) error {
 	return g.registerRegions(svc.RelayID(id), regions)
 }
 
+// Stops routing new sessions to a draining relay, active ones continue.
+func (g *Gateway) DrainHandle(id uint64) {
+	regions := g.drainRelay(svc.RelayID(id))
+	for _, region := range regions {
+		g.regions.Remove(region, id)
+	}
+}
+
 func (g *Gateway) CloseHandle(id uint64) {
 	regions := g.closeRelay(svc.RelayID(id))
 	for _, region := range regions {
@@ -84,101 +128,288 @@ func (g *Gateway) CloseHandle(id uint64) {
 	}
 }
 
-func (g *Gateway) AuthHandle(name, password string) (*svc.User, error) {
-	user, err := g.userStore.GetUser(svc.UserAuth{Name: name, Password: password})
-	if err != nil {
-		return nil, err
+// Authenticates with credentials if the request has any, and by client IP
+// only if it has none. Wrong credentials never fall back to the client IP.
+func (g *Gateway) AuthHandle(req svc.AuthRequest) (*svc.User, error) {
+	if req.Credentials != nil {
+		return g.userStore.GetUser(*req.Credentials)
+	}
+
+	if req.ClientIP == nil {
+		return nil, ErrorNoCredentials
 	}
+	return g.userStore.GetUserByIP(req.ClientIP)
+}
 
-	return user, nil
+// Rejects sessions the user's policy doesn't allow, denied sessions are
+// logged like any other failed session.
+func (g *Gateway) PolicyHandle(req svc.SessionRequest) error {
+	err := req.User.Policy().Check(req.Region, req.Destination)
+	if err != nil {
+		s := g.newSession(req)
+		s.record.Reason = accesslog.ReasonPolicyDenied
+		g.closeSession(s, err)
+	}
+	return err
 }
 
-func (g *Gateway) SessionHandle(user *svc.User, destination svc.Destination, region svc.Region, userConn svc.Conn) error {
-	log.Print("Connecting to: ", destination)
+func (g *Gateway) SessionHandle(req svc.SessionRequest, userConn svc.Conn) error {
+	s := g.newSession(req)
+	err := g.proxySession(s, userConn)
+	g.closeSession(s, err)
+	return err
+}
 
-	relayId, ok := g.regions.Get(region)
-	if !ok {
-		return errors.New("No relay in region")
+func (g *Gateway) newSession(req svc.SessionRequest) *session {
+	traceID := trace.NewTraceID()
+	s := &session{
+		req: req,
+		logger: g.logger.With(
+			logging.KeySession, traceID.String(),
+			logging.KeyUser, req.User.Name(),
+			logging.KeyRegion, req.Region,
+			logging.KeyDestination, req.Destination,
+		),
+		span: g.config.Tracer.Start("gateway.session", traceID, trace.SpanID{}),
+		record: accesslog.Record{
+			Time:        time.Now(),
+			SessionID:   traceID.String(),
+			User:        req.User.Name(),
+			ClientIP:    clientIP(req.ClientAddr),
+			Protocol:    req.Protocol,
+			Region:      string(req.Region),
+			Destination: string(req.Destination),
+		},
 	}
+	s.span.SetAttr("user", s.record.User)
+	s.span.SetAttr("destination", s.record.Destination)
+	s.span.SetAttr("region", s.record.Region)
 
-	relayStream, err := g.openStream(svc.RelayID(relayId))
+	return s
+}
+
+// Logs the outcome of a session, ends its span and writes its access log
+// record.
+func (g *Gateway) closeSession(s *session, err error) {
 	if err != nil {
-		g.stopRelay(svc.RelayID(relayId))
+		s.record.Error = err.Error()
+		s.logger.Warn("Session failed",
+			logging.KeyRelay, s.record.RelayID,
+			logging.KeyEdge, s.record.EdgeID,
+			"reason", s.record.Reason,
+			logging.Err(err),
+		)
+	} else {
+		s.logger.Info("Session closed",
+			logging.KeyRelay, s.record.RelayID,
+			logging.KeyEdge, s.record.EdgeID,
+			"reason", s.record.Reason,
+			"bytes_up", s.record.BytesUp,
+			"bytes_down", s.record.BytesDown,
+		)
+	}
+
+	s.span.SetAttr("reason", s.record.Reason)
+	s.span.End(err)
+
+	s.record.DurationMs = time.Since(s.record.Time).Milliseconds()
+	g.config.AccessLog.Log(s.record)
+}
+
+// State of a single user session, shared by its setup and transfer phases.
+type session struct {
+	req    svc.SessionRequest
+	record accesslog.Record
+	span   *trace.Span
+	logger *slog.Logger
+}
+
+func (g *Gateway) proxySession(s *session, userConn svc.Conn) error {
+	if !g.trackSession() {
+		userConn.Close()
+		s.record.Reason = accesslog.ReasonShutdown
+		return ErrorDraining
+	}
+	defer g.sessions.Done()
+
+	user := s.req.User
+
+	// Checked again here, so no relay stream is ever opened for a denied
+	// destination whoever calls this handler.
+	if err := user.Policy().Check(s.req.Region, s.req.Destination); err != nil {
+		userConn.Close()
+		s.record.Reason = accesslog.ReasonPolicyDenied
 		return err
 	}
+	s.logger.Info("Connecting")
 
-	if _, err = quic_kingip.SyncTransport(
-		relayStream,
-		g.handleProxyInit,
-		proto.NewMsgGatewayProxy(string(destination), string(region)),
-	); err != nil {
+	s.record.Reason = accesslog.ReasonSetupFailed
+	setup := g.config.Tracer.Start("gateway.setup", s.span.TraceID(), s.span.SpanID())
+	relayStream, err := g.setupSessionRetry(s, setup.SpanID())
+	setup.End(err)
+	if err != nil {
+		userConn.Close()
 		return err
 	}
 
 	sessions := g.sessionStore.SessionAdd(user.ID())
 	defer g.sessionStore.SessionRemove(user.ID())
 
+	s.record.Reason = accesslog.ReasonLimitExceeded
 	if sessions > user.MaxSessions() {
+		userConn.Close()
+		relayStream.Close()
 		return errors.New("Max sessions")
 	}
 
 	mbs := g.bandwidthStore.GetUserTotalUsedMBs(user.ID())
 	if mbs/1024. > user.MaxGBs() {
+		userConn.Close()
+		relayStream.Close()
 		return errors.New("Max bandwidth used")
 	}
 
-	inboundC := make(chan transferResult)
-	go func() {
-		inbound, err := transferData(userConn, relayStream)
-		inboundC <- transferResult{bytesCopied: inbound, err: err}
-	}()
+	transfer := g.config.Tracer.Start("gateway.transfer", s.span.TraceID(), s.span.SpanID())
+	up, down, err := g.transfer(s, userConn, relayStream)
+	transfer.SetAttr("bytes_up", strconv.FormatInt(up, 10))
+	transfer.SetAttr("bytes_down", strconv.FormatInt(down, 10))
+	transfer.End(err)
 
-	outboundC := make(chan transferResult)
-	go func() {
-		outbound, err := transferData(relayStream, userConn)
-		outboundC <- transferResult{bytesCopied: outbound, err: err}
-	}()
+	megabytes := float64(up+down) / (1024.0 * 1024.0)
+	g.bandwidthStore.UpdateUserTotalUsedMBs(user.ID(), megabytes)
 
-	select {
-	case inboundRes := <-inboundC:
-		g.receiveIoRes(user, inboundRes, outboundC)
-		return nil
-	case outboundRes := <-outboundC:
-		g.receiveIoRes(user, outboundRes, inboundC)
-		return nil
-	case <-time.After(user.MaxSessionDuration()):
-		userConn.Close()
-		relayStream.Close()
-		return errors.New("Max session duration")
+	return err
+}
+
+// Sets the session up again, on whichever relay is next, while relays
+// report that all their edges of the region are full.
+func (g *Gateway) setupSessionRetry(s *session, span trace.SpanID) (quic.Stream, error) {
+	var retryErr *proto.RetryError
+	for attempt := 1; ; attempt++ {
+		relayStream, err := g.setupSession(s, span)
+		if !errors.As(err, &retryErr) || attempt == maxSetupAttempts {
+			return relayStream, err
+		}
+		s.logger.Debug("Retrying session setup", logging.Err(err))
 	}
 }
 
-func (g *Gateway) receiveIoRes(user *svc.User, res transferResult, otherC <-chan transferResult) (float64, error) {
-	origin, err := res.bytesCopied, res.err
+// Opens a stream to a relay serving the session region and waits until
+// the edge is connected to the destination.
+func (g *Gateway) setupSession(s *session, span trace.SpanID) (quic.Stream, error) {
+	relayId, ok := g.regions.Get(s.req.Region)
+	if !ok {
+		return nil, errors.New("No relay in region")
+	}
+	s.record.RelayID = svc.RelayID(relayId).String()
+
+	relayStream, err := g.openStream(svc.RelayID(relayId))
 	if err != nil {
-		return 0, err
+		g.stopRelay(svc.RelayID(relayId))
+		return nil, err
 	}
-	otherRes := <-otherC
-	other, err := otherRes.bytesCopied, otherRes.err
 
-	totalBytes := origin + other
-	megabytes := float64(totalBytes) / (1024.0 * 1024.0)
+	proxy := g.proxyDetails(s.req.Destination, s.req.Region)
+	proxy.MaxDuration = s.req.User.MaxSessionDuration()
+	proxy.SessionID = s.span.TraceID().String()
+	proxy.SpanID = span.String()
 
-	g.bandwidthStore.UpdateUserTotalUsedMBs(user.ID(), megabytes)
-	return 0, err
+	var result proto.ProxyResult
+	if relayStream, err = quic_kingip.SyncTransport(
+		relayStream,
+		func(w transport.ResponseWriter, r proto.Message) error {
+			result, err = r.UnmarshalProxyResult()
+			return err
+		},
+		proto.NewMsgGatewayProxy(proxy),
+	); err != nil {
+		relayStream.Close()
+		return nil, err
+	}
+	s.record.EdgeID = result.EdgeID
+	s.record.ExitIP = result.ExitIP
+
+	return relayStream, nil
 }
 
-func (g *Gateway) handleProxyInit(w transport.ResponseWriter, r proto.Message) error {
-	mt, _, err := r.UnmarshalString()
-	if err != nil {
-		return err
+// Copies data both ways until both sides are closed, the session is idle
+// for too long or the user's max session duration is reached.
+func (g *Gateway) transfer(s *session, userConn svc.Conn, relayStream quic.Stream) (int64, int64, error) {
+	userEnd := pipe.Conn(userConn)
+	timeout := watchdog.Start(g.config.IdleTimeout, s.req.User.MaxSessionDuration(), func(err error) {
+		// The relay stream keeps the first code it was cancelled with.
+		quic_kingip.CancelStream(relayStream, quic_kingip.StreamErrorCodeTimeout)
+		userEnd.Abort(err)
+	})
+	defer timeout.Stop()
+
+	result := pipe.Run(userEnd, quic_kingip.StreamEnd(relayStream), timeout.Touch)
+	s.record.BytesUp = result.AToB
+	s.record.BytesDown = result.BToA
+
+	err := result.Err
+	code, reset := quic_kingip.StreamErrorCodeOf(err)
+	switch {
+	case errors.Is(timeout.Err(), watchdog.ErrorMaxDuration):
+		s.record.Reason = accesslog.ReasonMaxDuration
+		err = timeout.Err()
+	case errors.Is(timeout.Err(), watchdog.ErrorIdleTimeout):
+		s.record.Reason = accesslog.ReasonIdleTimeout
+		err = timeout.Err()
+	case reset && code == quic_kingip.StreamErrorCodeTimeout:
+		s.record.Reason = accesslog.ReasonRemoteTimeout
+	case err != nil:
+		s.record.Reason = accesslog.ReasonTransferError
+	case result.First == pipe.SideA:
+		s.record.Reason = accesslog.ReasonClientClosed
+	default:
+		s.record.Reason = accesslog.ReasonDestinationClosed
 	}
 
-	if proto.MsgSuccess != mt {
-		errors.New("Proxy init failed")
+	return result.AToB, result.BToA, err
+}
+
+func (g *Gateway) proxyDetails(destination svc.Destination, region svc.Region) proto.GatewayProxy {
+	proxy := proto.GatewayProxy{
+		Destination: string(destination),
+		Region:      string(region),
+	}
+	if g.config.RemoteResolve {
+		proxy.Resolve = proto.ResolveRemote
 	}
+	return proxy
+}
 
-	return nil
+// Rejects new sessions and waits for active ones to finish or ctx to be
+// done.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.drainMu.Lock()
+	g.draining = true
+	g.drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.sessions.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *Gateway) trackSession() bool {
+	g.drainMu.Lock()
+	defer g.drainMu.Unlock()
+
+	if g.draining {
+		return false
+	}
+	g.sessions.Add(1)
+	return true
 }
 
 func (g *Gateway) openStream(relayId svc.RelayID) (quic.Stream, error) {
@@ -193,7 +424,7 @@ func (g *Gateway) openStream(relayId svc.RelayID) (quic.Stream, error) {
 	return relay.openStream()
 }
 
-func (g *Gateway) registerRelay(conn quic.Connection) (svc.RelayID, chan error) {
+func (g *Gateway) registerRelay(conn quic_kingip.Conn) (svc.RelayID, chan error) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
@@ -217,6 +448,17 @@ func (g *Gateway) stopRelay(id svc.RelayID) {
 	}
 }
 
+func (g *Gateway) drainRelay(id svc.RelayID) []svc.Region {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if relay, ok := g.relayConns[id]; ok {
+		return relay.getRegions()
+	}
+
+	return nil
+}
+
 func (g *Gateway) closeRelay(id svc.RelayID) []svc.Region {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -244,19 +486,12 @@ func (g *Gateway) registerRegions(relayId svc.RelayID, regions map[string]string
 	return nil
 }
 
-type transferResult struct {
-	bytesCopied int64
-	err         error
-}
-
-func transferData(dst svc.Conn, src svc.Conn) (int64, error) {
-	defer dst.Close()
-	defer src.Close()
-
-	bytesCopied, err := io.Copy(dst, src)
-	if err != nil {
-		return bytesCopied, err
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
 	}
-
-	return bytesCopied, nil
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
 }
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/svc"
+)
+
+// ProxyManager runs the user facing proxies of a gateway and applies
+// configuration changes without restarting the listeners that didn't change.
+type ProxyManager struct {
+	logger         *slog.Logger
+	authHandler    svc.GatewayAuthHandleFunc
+	policyHandler  svc.GatewayPolicyHandleFunc
+	sessionHandler svc.GatewaySessionHandleFunc
+	drainTimeout   time.Duration
+
+	proxies map[string]*Proxy
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+func NewProxyManager(
+	logger *slog.Logger,
+	authHandler svc.GatewayAuthHandleFunc,
+	policyHandler svc.GatewayPolicyHandleFunc,
+	sessionHandler svc.GatewaySessionHandleFunc,
+	drainTimeout time.Duration,
+) *ProxyManager {
+	return &ProxyManager{
+		logger:         logging.OrDefault(logger),
+		authHandler:    authHandler,
+		policyHandler:  policyHandler,
+		sessionHandler: sessionHandler,
+		drainTimeout:   drainTimeout,
+		proxies:        make(map[string]*Proxy),
+	}
+}
+
+// Starts proxies for new addresses, updates the region of existing ones
+// and drains proxies whose address is no longer configured.
+func (m *ProxyManager) Apply(configs []ProxyConfig) error {
+	wanted := make(map[string]ProxyConfig)
+	for _, cfg := range configs {
+		if _, exists := wanted[cfg.Addr]; exists {
+			return fmt.Errorf("Duplicate proxy address %s", cfg.Addr)
+		}
+		wanted[cfg.Addr] = cfg
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Bind all new listeners first, so a bad address leaves the running
+	// configuration untouched.
+	listeners := make(map[string]net.Listener)
+	for addr := range wanted {
+		if _, exists := m.proxies[addr]; exists {
+			continue
+		}
+
+		ln, err := net.Listen("tcp4", addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("Failed to listen on %s: %w", addr, err)
+		}
+		listeners[addr] = ln
+	}
+
+	for addr, cfg := range wanted {
+		if ln, ok := listeners[addr]; ok {
+			m.start(cfg, ln)
+			m.logger.Info("Started proxy", logging.KeyAddr, addr, logging.KeyRegion, cfg.Region)
+			continue
+		}
+
+		proxy := m.proxies[addr]
+		if proxy.Region() != cfg.Region {
+			m.logger.Info("Moved proxy to region", logging.KeyAddr, addr, logging.KeyRegion, cfg.Region, "previous", proxy.Region())
+			proxy.SetRegion(cfg.Region)
+		}
+	}
+
+	for addr, proxy := range m.proxies {
+		if _, exists := wanted[addr]; !exists {
+			delete(m.proxies, addr)
+			go m.drain(addr, proxy)
+		}
+	}
+
+	return nil
+}
+
+// Drains all proxies and waits until they are stopped or ctx is done.
+func (m *ProxyManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	proxies := m.proxies
+	m.proxies = make(map[string]*Proxy)
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for addr, proxy := range proxies {
+		wg.Add(1)
+		go func(addr string, proxy *Proxy) {
+			defer wg.Done()
+			if err := proxy.Shutdown(ctx); err != nil {
+				m.logger.Warn("Failed to drain proxy", logging.KeyAddr, addr, logging.Err(err))
+			}
+		}(addr, proxy)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.wg.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ProxyManager) start(cfg ProxyConfig, ln net.Listener) {
+	proxy, _ := NewProxyServer(cfg, m.authHandler, m.policyHandler, m.sessionHandler)
+	m.proxies[cfg.Addr] = proxy
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if err := proxy.Serve(ln); err != nil {
+			m.logger.Error("Proxy stopped", logging.KeyAddr, cfg.Addr, logging.Err(err))
+		}
+	}()
+}
+
+func (m *ProxyManager) drain(addr string, proxy *Proxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout)
+	defer cancel()
+
+	m.logger.Info("Draining proxy", logging.KeyAddr, addr)
+	if err := proxy.Shutdown(ctx); err != nil {
+		m.logger.Warn("Failed to drain proxy", logging.KeyAddr, addr, logging.Err(err))
+		return
+	}
+	m.logger.Info("Stopped proxy", logging.KeyAddr, addr)
+}
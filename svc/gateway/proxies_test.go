@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/svc"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProxyManagerApply(t *testing.T) {
+	manager := NewProxyManager(logging.Discard(), nil, nil, nil, time.Second)
+	addrA, addrB := freeAddr(t), freeAddr(t)
+
+	err := manager.Apply([]ProxyConfig{{Addr: addrA, Region: "red"}})
+	assert.NoError(t, err)
+	proxyA := manager.proxies[addrA]
+
+	err = manager.Apply([]ProxyConfig{
+		{Addr: addrA, Region: "green"},
+		{Addr: addrB, Region: "blue"},
+	})
+	assert.NoError(t, err)
+
+	// Existing listener is kept and only changes its region.
+	assert.Same(t, proxyA, manager.proxies[addrA])
+	assert.Equal(t, svc.Region("green"), proxyA.Region())
+	assert.Equal(t, svc.Region("blue"), manager.proxies[addrB].Region())
+
+	err = manager.Apply([]ProxyConfig{{Addr: addrB, Region: "blue"}})
+	assert.NoError(t, err)
+	assert.NotContains(t, manager.proxies, addrA)
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp4", addrA)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "removed proxy should stop listening")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, manager.Shutdown(ctx))
+}
+
+func TestProxyManagerApplyKeepsConfigOnError(t *testing.T) {
+	manager := NewProxyManager(logging.Discard(), nil, nil, nil, time.Second)
+	addr := freeAddr(t)
+
+	err := manager.Apply([]ProxyConfig{{Addr: addr, Region: "red"}})
+	assert.NoError(t, err)
+
+	err = manager.Apply([]ProxyConfig{
+		{Addr: addr, Region: "green"},
+		{Addr: "256.0.0.1:1", Region: "blue"},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, svc.Region("red"), manager.proxies[addr].Region())
+
+	err = manager.Apply([]ProxyConfig{{Addr: addr}, {Addr: addr}})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, manager.Shutdown(ctx))
+}
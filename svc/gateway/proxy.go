@@ -2,11 +2,14 @@ package gateway
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
-	"log"
 	"net"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bacv/kingip/svc"
 	"github.com/valyala/fasthttp"
@@ -19,35 +22,146 @@ type ProxyConfig struct {
 
 type Proxy struct {
 	config         ProxyConfig
+	server         *fasthttp.Server
 	authHandler    svc.GatewayAuthHandleFunc
+	policyHandler  svc.GatewayPolicyHandleFunc
 	sessionHandler svc.GatewaySessionHandleFunc
+
+	ln       net.Listener
+	closed   bool
+	sessions atomic.Int64
+	mu       sync.RWMutex
 }
 
 func NewProxyServer(
 	config ProxyConfig,
 	authHandler svc.GatewayAuthHandleFunc,
+	policyHandler svc.GatewayPolicyHandleFunc,
 	sessionHandler svc.GatewaySessionHandleFunc,
 ) (*Proxy, error) {
-	return &Proxy{
+	proxy := &Proxy{
 		config:         config,
 		authHandler:    authHandler,
+		policyHandler:  policyHandler,
 		sessionHandler: sessionHandler,
-	}, nil
+	}
+	proxy.server = &fasthttp.Server{Handler: proxy.handleRequest}
+
+	return proxy, nil
 }
 
 func (s *Proxy) ListenUser() error {
-	return fasthttp.ListenAndServe(s.config.Addr, s.handleRequest)
+	ln, err := net.Listen("tcp4", s.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+func (s *Proxy) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	err := s.server.Serve(ln)
+	if s.isClosed() {
+		return nil
+	}
+	return err
+}
+
+// Stops accepting user connections and waits for sessions started by this
+// proxy to finish, or ctx to be done.
+func (s *Proxy) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	ln := s.ln
+	s.mu.Unlock()
+
+	err := s.server.ShutdownWithContext(ctx)
+
+	// The server doesn't know about listeners it hasn't started serving
+	// yet, so close it here as well.
+	if ln != nil {
+		ln.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Hijacked connections may still start sessions after the server is
+	// shut down, so the counter is polled instead of waited on.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.sessions.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Proxy) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closed
+}
+
+func (s *Proxy) Region() svc.Region {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.config.Region
+}
+
+// Changes the region of new sessions, active ones keep their region.
+func (s *Proxy) SetRegion(region svc.Region) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config.Region = region
+}
+
+func (s *Proxy) handleSession(req svc.SessionRequest, userConn svc.Conn) error {
+	s.sessions.Add(1)
+	defer s.sessions.Add(-1)
+
+	return s.sessionHandler(req, userConn)
+}
+
+// Responds with 403 if the user may not start the session.
+func (s *Proxy) allowSession(ctx *fasthttp.RequestCtx, req svc.SessionRequest) bool {
+	if err := s.policyHandler(req); err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.Response.SetBodyString(err.Error())
+		ctx.Response.ConnectionClose()
+		return false
+	}
+	return true
 }
 
 func (s *Proxy) handleRequest(ctx *fasthttp.RequestCtx) {
-	username, password, ok := parseBasicAuth(ctx)
+	credentials, ok := parseBasicAuth(ctx)
 	if !ok {
 		ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
 		ctx.Response.ConnectionClose()
 		return
 	}
 
-	user, err := s.authHandler(username, password)
+	user, err := s.authHandler(svc.AuthRequest{
+		Credentials: credentials,
+		ClientIP:    ctx.RemoteIP(),
+	})
 	if err != nil {
 		ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
 		ctx.Response.ConnectionClose()
@@ -62,14 +176,23 @@ func (s *Proxy) handleRequest(ctx *fasthttp.RequestCtx) {
 }
 
 func (s *Proxy) handleConnect(ctx *fasthttp.RequestCtx, user *svc.User) {
+	req := svc.SessionRequest{
+		User:        user,
+		Destination: svc.Destination(ctx.Host()),
+		Region:      s.Region(),
+		ClientAddr:  ctx.RemoteAddr(),
+		Protocol:    svc.ProtocolConnect,
+	}
+	if !s.allowSession(ctx, req) {
+		return
+	}
+
 	ctx.Response.SetStatusCode(fasthttp.StatusOK)
 	ctx.Response.SetBody(nil)
-	host := string(ctx.Host())
 
 	ctx.Hijack(func(userConn net.Conn) {
-		if err := s.sessionHandler(user, svc.Destination(host), s.config.Region, userConn); err != nil {
-			log.Print(err)
-		}
+		// Errors are logged with the session id by the session handler.
+		s.handleSession(req, userConn)
 	})
 }
 
@@ -79,6 +202,17 @@ func (s *Proxy) handleHTTP(ctx *fasthttp.RequestCtx, user *svc.User) {
 		host += ":80"
 	}
 
+	req := svc.SessionRequest{
+		User:        user,
+		Destination: svc.Destination(host),
+		Region:      s.Region(),
+		ClientAddr:  ctx.RemoteAddr(),
+		Protocol:    svc.ProtocolHTTP,
+	}
+	if !s.allowSession(ctx, req) {
+		return
+	}
+
 	pipeConn, userConn := net.Pipe()
 	defer pipeConn.Close()
 
@@ -86,9 +220,8 @@ func (s *Proxy) handleHTTP(ctx *fasthttp.RequestCtx, user *svc.User) {
 	defer bufWriter.Flush()
 
 	go func() {
-		if err := s.sessionHandler(user, svc.Destination(host), s.config.Region, userConn); err != nil {
+		if err := s.handleSession(req, userConn); err != nil {
 			userConn.Close()
-			log.Print(err)
 		}
 	}()
 
@@ -126,23 +259,28 @@ func readResponse(ctx *fasthttp.RequestCtx, rd *bufio.Reader) error {
 	return nil
 }
 
-func parseBasicAuth(ctx *fasthttp.RequestCtx) (username, password string, ok bool) {
+// Returns nil credentials if the request has no Proxy-Authorization
+// header, and false if the header is malformed.
+func parseBasicAuth(ctx *fasthttp.RequestCtx) (*svc.UserAuth, bool) {
 	auth := string(ctx.Request.Header.Peek("Proxy-Authorization"))
+	if auth == "" {
+		return nil, true
+	}
 	if !strings.HasPrefix(auth, "Basic ") {
-		return "", "", false
+		return nil, false
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(auth[6:])
 	if err != nil {
-		return "", "", false
+		return nil, false
 	}
 
 	creds := strings.SplitN(string(decoded), ":", 2)
 	if len(creds) != 2 {
-		return "", "", false
+		return nil, false
 	}
 
-	return creds[0], creds[1], true
+	return &svc.UserAuth{Name: creds[0], Password: creds[1]}, true
 }
 
 func stripProxyHeaders(req *fasthttp.Request) {
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/svc"
+	"github.com/bacv/kingip/svc/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a proxy of a gateway using users, whose sessions are sent to the
+// returned channel instead of a relay.
+func startTestProxy(t *testing.T, users *store.MockUserStore) (string, <-chan svc.SessionRequest) {
+	gateway := NewGateway(Config{}, logging.Discard(), users, users, store.NewMockSessionStore())
+
+	sessions := make(chan svc.SessionRequest, 1)
+	sessionHandler := func(req svc.SessionRequest, conn svc.Conn) error {
+		sessions <- req
+		return conn.Close()
+	}
+
+	addr := freeAddr(t)
+	manager := NewProxyManager(logging.Discard(), gateway.AuthHandle, gateway.PolicyHandle, sessionHandler, time.Second)
+	assert.NoError(t, manager.Apply([]ProxyConfig{{Addr: addr, Region: "red"}}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		manager.Shutdown(ctx)
+	})
+
+	return addr, sessions
+}
+
+// Sends a CONNECT request with the given Proxy-Authorization header value,
+// if any.
+func connect(t *testing.T, addr, target, auth string) *http.Response {
+	conn, err := net.Dial("tcp4", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if auth != "" {
+		fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", auth)
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	return resp
+}
+
+func basicAuth(name, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))
+}
+
+func TestProxyRejectsDeniedDestinations(t *testing.T) {
+	policy := svc.UserPolicy{DeniedPorts: []svc.PortRange{{From: 25, To: 25}}}
+	user := svc.NewUser("user", 1, svc.DefaultUserConfig().WithPolicy(policy))
+
+	users := store.NewMockUserStore()
+	users.Users[svc.UserAuth{Name: "user", Password: "pass"}] = user
+	addr, sessions := startTestProxy(t, users)
+	auth := basicAuth("user", "pass")
+
+	resp := connect(t, addr, "mail.example.com:25", auth)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, svc.ErrorPortDenied.Error(), string(body))
+	assert.Empty(t, sessions)
+
+	resp = connect(t, addr, "mail.example.com:587", auth)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	req := <-sessions
+	assert.Equal(t, svc.Destination("mail.example.com:587"), req.Destination)
+	assert.Equal(t, svc.Region("red"), req.Region)
+}
+
+func TestProxyAuthenticatesByClientIP(t *testing.T) {
+	credentialsUser := svc.NewUser("user", 1, svc.DefaultUserConfig())
+	ipUser := svc.NewUser("office", 2, svc.DefaultUserConfig())
+
+	users := store.NewMockUserStore()
+	users.Users[svc.UserAuth{Name: "user", Password: "pass"}] = credentialsUser
+	assert.NoError(t, users.AddUserNetwork("127.0.0.0/8", ipUser))
+	addr, sessions := startTestProxy(t, users)
+
+	resp := connect(t, addr, "example.com:443", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Same(t, ipUser, (<-sessions).User)
+
+	// Credentials take precedence over the client IP.
+	resp = connect(t, addr, "example.com:443", basicAuth("user", "pass"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Same(t, credentialsUser, (<-sessions).User)
+
+	// Wrong or malformed credentials never fall back to the client IP.
+	resp = connect(t, addr, "example.com:443", basicAuth("user", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = connect(t, addr, "example.com:443", "Bearer token")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, sessions)
+}
+
+func TestProxyRejectsUnknownClientIP(t *testing.T) {
+	users := store.NewMockUserStore()
+	assert.NoError(t, users.AddUserNetwork("10.0.0.0/8", svc.NewUser("office", 1, svc.DefaultUserConfig())))
+	addr, sessions := startTestProxy(t, users)
+
+	resp := connect(t, addr, "example.com:443", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, sessions)
+}
@@ -1,8 +1,11 @@
 package svc
 
 import (
+	"fmt"
 	"io"
+	"net"
 
+	quic_kingip "github.com/bacv/kingip/lib/quic"
 	"github.com/quic-go/quic-go"
 )
 
@@ -10,6 +13,10 @@ type EdgeID uint64
 type RelayID uint64
 type SessionID uint64
 
+func (id RelayID) String() string {
+	return fmt.Sprint(uint64(id))
+}
+
 type Destination string
 type Region string
 
@@ -29,16 +36,45 @@ type EdgeConn interface {
 	ID() EdgeID
 }
 
-type GatewayAuthHandleFunc func(string, string) (*User, error)
-type GatewayRelayRegisterHandleFunc func(quic.Connection) (RelayID, <-chan error, error)
+// AuthRequest is what a proxy knows about the user of a request.
+type AuthRequest struct {
+	// Basic auth credentials, nil if the request carried none.
+	Credentials *UserAuth
+	ClientIP    net.IP
+}
+
+type GatewayAuthHandleFunc func(AuthRequest) (*User, error)
+type GatewayRelayRegisterHandleFunc func(quic_kingip.Conn, *quic_kingip.Peer) (RelayID, <-chan error, error)
 type GatewayRelayRegionsHandleFunc func(RelayID, map[string]string) error
-type GatewaySessionHandleFunc func(*User, Destination, Region, Conn) error
+
+const (
+	ProtocolConnect = "connect"
+	ProtocolHTTP    = "http"
+)
+
+// SessionRequest is what the gateway knows about a user session before it
+// is proxied.
+type SessionRequest struct {
+	User        *User
+	Destination Destination
+	Region      Region
+	ClientAddr  net.Addr
+	Protocol    string
+}
+
+type GatewaySessionHandleFunc func(SessionRequest, Conn) error
+
+// Checks whether a session may be started, before anything is sent back to
+// the user.
+type GatewayPolicyHandleFunc func(SessionRequest) error
 
 type RelayGatewayHandleFunc func(quic.Stream) error
 type RelayClientHandleFunc func(EdgeConn) error
 
 type UserStore interface {
 	GetUser(UserAuth) (*User, error)
+	// Returns the user whose client networks contain the IP.
+	GetUserByIP(net.IP) (*User, error)
 	GetUserSessionCount(UserID) uint16
 }
 
@@ -0,0 +1,145 @@
+package svc
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrorRegionDenied      = errors.New("Region not allowed")
+	ErrorDestinationDenied = errors.New("Destination not allowed")
+	ErrorPortDenied        = errors.New("Destination port not allowed")
+)
+
+// PortRange is an inclusive range of destination ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// UserPolicy limits where a user may proxy to. Empty allow lists allow
+// everything, and a denied entry always wins over an allowed one.
+//
+// Host patterns are either an exact hostname ("example.com"), a wildcard
+// matching any subdomain ("*.example.com"), "*" matching every host, or a
+// CIDR matching IP literal destinations ("10.0.0.0/8").
+type UserPolicy struct {
+	AllowedRegions []Region
+	DeniedRegions  []Region
+	AllowedHosts   []string
+	DeniedHosts    []string
+	AllowedPorts   []PortRange
+	DeniedPorts    []PortRange
+}
+
+// Returns nil if the user may proxy to destination through region.
+func (p UserPolicy) Check(region Region, destination Destination) error {
+	if containsRegion(p.DeniedRegions, region) {
+		return ErrorRegionDenied
+	}
+	if len(p.AllowedRegions) > 0 && !containsRegion(p.AllowedRegions, region) {
+		return ErrorRegionDenied
+	}
+
+	host, portStr, err := net.SplitHostPort(string(destination))
+	if err != nil || !validHost(host) {
+		return ErrorDestinationDenied
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return ErrorPortDenied
+	}
+
+	if matchHosts(p.DeniedHosts, host) {
+		return ErrorDestinationDenied
+	}
+	if len(p.AllowedHosts) > 0 && !matchHosts(p.AllowedHosts, host) {
+		return ErrorDestinationDenied
+	}
+
+	if containsPort(p.DeniedPorts, uint16(port)) {
+		return ErrorPortDenied
+	}
+	if len(p.AllowedPorts) > 0 && !containsPort(p.AllowedPorts, uint16(port)) {
+		return ErrorPortDenied
+	}
+
+	return nil
+}
+
+// Whether host is an IP literal or a hostname of letters, digits, "-" and
+// "_", so that it passes through proxy messages as is.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsRegion(regions []Region, region Region) bool {
+	for _, r := range regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHosts(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, pattern := range patterns {
+		if matchHost(strings.ToLower(pattern), host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string, ip net.IP) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if strings.Contains(pattern, "/") {
+		_, cidr, err := net.ParseCIDR(pattern)
+		return err == nil && ip != nil && cidr.Contains(ip)
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+
+	return host == strings.TrimSuffix(pattern, ".")
+}
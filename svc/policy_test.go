@@ -0,0 +1,69 @@
+package svc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserPolicyRegions(t *testing.T) {
+	policy := UserPolicy{
+		AllowedRegions: []Region{"red", "blue"},
+		DeniedRegions:  []Region{"blue"},
+	}
+
+	assert.NoError(t, policy.Check("red", "example.com:443"))
+	assert.ErrorIs(t, policy.Check("blue", "example.com:443"), ErrorRegionDenied)
+	assert.ErrorIs(t, policy.Check("green", "example.com:443"), ErrorRegionDenied)
+}
+
+func TestUserPolicyHosts(t *testing.T) {
+	policy := UserPolicy{
+		AllowedHosts: []string{"*.example.com", "example.org", "10.0.0.0/8"},
+		DeniedHosts:  []string{"admin.example.com", "10.0.0.1/32"},
+	}
+
+	assert.NoError(t, policy.Check("red", "www.example.com:443"))
+	assert.NoError(t, policy.Check("red", "WWW.Example.com.:443"))
+	assert.NoError(t, policy.Check("red", "example.org:80"))
+	assert.NoError(t, policy.Check("red", "10.1.2.3:80"))
+
+	assert.ErrorIs(t, policy.Check("red", "example.com:443"), ErrorDestinationDenied)
+	assert.ErrorIs(t, policy.Check("red", "admin.example.com:443"), ErrorDestinationDenied)
+	assert.ErrorIs(t, policy.Check("red", "10.0.0.1:80"), ErrorDestinationDenied)
+	assert.ErrorIs(t, policy.Check("red", "sub.example.org:80"), ErrorDestinationDenied)
+	assert.ErrorIs(t, policy.Check("red", "no-port"), ErrorDestinationDenied)
+}
+
+func TestUserPolicyInvalidHosts(t *testing.T) {
+	policy := UserPolicy{DeniedRegions: []Region{"blue"}}
+
+	assert.NoError(t, policy.Check("red", "[2001:db8::1]:443"))
+	assert.NoError(t, policy.Check("red", "_sip.example.com:443"))
+
+	// Fields of the proxy message must not be smuggled in the host.
+	for _, destination := range []string{
+		"[x;region=blue;maxDuration=10000h;y=]:443",
+		"[example.com,a]:443",
+		"example..com:443",
+		":443",
+	} {
+		assert.ErrorIs(t, policy.Check("red", Destination(destination)), ErrorDestinationDenied, destination)
+	}
+}
+
+func TestUserPolicyPorts(t *testing.T) {
+	policy := UserPolicy{
+		DeniedPorts: []PortRange{{From: 25, To: 25}},
+	}
+	assert.NoError(t, policy.Check("red", "mail.example.com:587"))
+	assert.ErrorIs(t, policy.Check("red", "mail.example.com:25"), ErrorPortDenied)
+
+	policy.AllowedPorts = []PortRange{{From: 80, To: 80}, {From: 443, To: 443}}
+	assert.NoError(t, policy.Check("red", "example.com:443"))
+	assert.ErrorIs(t, policy.Check("red", "example.com:8080"), ErrorPortDenied)
+}
+
+func TestEmptyUserPolicyAllowsAll(t *testing.T) {
+	assert.NoError(t, UserPolicy{}.Check("red", "anything.example:25"))
+}
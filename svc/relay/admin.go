@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bacv/kingip/svc"
+)
+
+// GatewayInfo describes the conn to a gateway or an upstream relay.
+type GatewayInfo struct {
+	Addr      string `json:"addr"`
+	Connected bool   `json:"connected"`
+	// Id the gateway assigned to this relay, and since when.
+	ConnID       string    `json:"conn_id"`
+	RegisteredAt time.Time `json:"registered_at"`
+	Draining     bool      `json:"draining"`
+}
+
+// Serves the admin API of the relay. It is unauthenticated, so it should
+// listen on a private address only.
+//
+//	GET  /edges                       connected edges
+//	POST /edges/{id or name}/drain    stop routing new sessions to edges
+//	POST /edges/{id or name}/disconnect
+//	GET  /gateways                    conns to gateways and upstream relays
+//	GET  /stats/edges                 session setup stats of edges
+func (g *Relay) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/edges", g.handleEdges)
+	mux.HandleFunc("/edges/", g.handleEdgeAction)
+	mux.HandleFunc("/gateways", g.handleGateways)
+	mux.HandleFunc("/stats/edges", g.handleEdgeStats)
+	return mux
+}
+
+func (g *Relay) handleEdges(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, g.Edges())
+}
+
+// Applies an action to every edge with the id or name in the path, and
+// returns their ids.
+func (g *Relay) handleEdgeAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	key, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/edges/"), "/")
+	var apply func(svc.EdgeID) error
+	switch action {
+	case "drain":
+		apply = g.DrainEdge
+	case "disconnect":
+		apply = g.DisconnectEdge
+	}
+	if !ok || key == "" || apply == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ids := g.FindEdges(key)
+	if len(ids) == 0 {
+		http.Error(w, ErrorEdgeNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	for _, id := range ids {
+		// An edge that closed meanwhile needs nothing done.
+		apply(id)
+	}
+	writeJSON(w, ids)
+}
+
+func (g *Relay) handleGateways(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	upstreams := g.Upstreams()
+	gateways := make([]GatewayInfo, 0, len(upstreams))
+	for _, status := range upstreams {
+		gateways = append(gateways, GatewayInfo{
+			Addr:         status.Addr,
+			Connected:    status.Connected,
+			ConnID:       status.ConnID,
+			RegisteredAt: status.RegisteredAt,
+			Draining:     status.Draining,
+		})
+	}
+	writeJSON(w, gateways)
+}
+
+func (g *Relay) handleEdgeStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, g.EdgeStats())
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
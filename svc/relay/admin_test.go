@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/svc"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Conn of an edge that never opens streams.
+type fakeConn struct {
+	ctx context.Context
+}
+
+func (c fakeConn) OpenStream() (quic.Stream, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (c fakeConn) AcceptStream(context.Context) (quic.Stream, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (c fakeConn) CloseWithError(quic.ApplicationErrorCode, string) error {
+	return nil
+}
+
+func (c fakeConn) Context() context.Context {
+	return c.ctx
+}
+
+func (c fakeConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+}
+
+func serveAdmin(relay *Relay, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	relay.AdminHandler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestAdminEdges(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	conn := fakeConn{ctx: context.Background()}
+	id, stopC, _ := relay.RegisterHandle(conn, &quic_kingip.Peer{Name: "edge-a"})
+	relay.RegionsHandle(id, map[string]string{"red": "vm-1", "blue": "vm-1"})
+	other, _, _ := relay.RegisterHandle(conn, nil)
+	relay.RegionsHandle(other, map[string]string{"red": "vm-2"})
+
+	w := serveAdmin(relay, http.MethodGet, "/edges")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var edges []EdgeInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &edges))
+	assert.Len(t, edges, 2)
+	assert.Equal(t, "edge-a", edges[0].Name)
+	assert.Equal(t, "10.0.0.1:4000", edges[0].RemoteAddr)
+	assert.Equal(t, []svc.Region{"blue", "red"}, edges[0].Regions)
+	assert.Equal(t, "vm-2", edges[1].Name)
+
+	// Edges are found by name as well as by id.
+	w = serveAdmin(relay, http.MethodPost, "/edges/vm-2/drain")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf("[%d]", other), w.Body.String())
+	edgeId, ok := relay.regions.Get("red")
+	assert.True(t, ok)
+	assert.Equal(t, id, edgeId)
+
+	go serveAdmin(relay, http.MethodPost, fmt.Sprintf("/edges/%d/disconnect", id))
+	assert.ErrorIs(t, <-stopC, ErrorDisconnected)
+
+	assert.Equal(t, http.StatusNotFound, serveAdmin(relay, http.MethodPost, "/edges/nobody/drain").Code)
+	assert.Equal(t, http.StatusNotFound, serveAdmin(relay, http.MethodPost, "/edges/edge-a/reboot").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serveAdmin(relay, http.MethodGet, "/edges/edge-a/drain").Code)
+}
+
+func TestAdminGateways(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	relay.AddUpstream(quic_kingip.NewDialer(quic_kingip.DialerConfig{Addr: "127.0.0.1:4444"}, logging.Discard(), nil))
+
+	w := serveAdmin(relay, http.MethodGet, "/gateways")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var gateways []GatewayInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &gateways))
+	assert.Equal(t, []GatewayInfo{{Addr: "127.0.0.1:4444"}}, gateways)
+}
+
+func TestAdminEdgeStats(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	id, _, _ := relay.RegisterHandle(nil, nil)
+	relay.RegionsHandle(id, map[string]string{"red": "edge"})
+	relay.recordOutcome(svc.EdgeID(id), errors.New("Connection refused"), 0)
+
+	w := serveAdmin(relay, http.MethodGet, "/stats/edges")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats []EdgeStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, relay.EdgeStats(), stats)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, serveAdmin(relay, http.MethodPost, "/stats/edges").Code)
+}
@@ -0,0 +1,163 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/svc"
+)
+
+// EdgeInfo describes a connected edge.
+type EdgeInfo struct {
+	ID svc.EdgeID `json:"id"`
+	// Name the edge authenticated with, or else its hostname. Unlike the
+	// id it stays the same when the edge reconnects.
+	Name        string        `json:"name"`
+	RemoteAddr  string        `json:"remote_addr"`
+	Regions     []svc.Region  `json:"regions"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	RTT         time.Duration `json:"rtt_ns"`
+	// Sessions being transferred, and the bytes of all sessions so far,
+	// as seen from the gateway.
+	ActiveStreams int64 `json:"active_streams"`
+	BytesUp       int64 `json:"bytes_up"`
+	BytesDown     int64 `json:"bytes_down"`
+	Draining      bool  `json:"draining"`
+	Quarantined   bool  `json:"quarantined"`
+}
+
+// Returns every connected edge, ordered by name and id.
+func (g *Relay) Edges() []EdgeInfo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	edges := make([]EdgeInfo, 0, len(g.edgeConns))
+	for id, edgeConn := range g.edgeConns {
+		edges = append(edges, edgeConn.info(id))
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Name != edges[j].Name {
+			return edges[i].Name < edges[j].Name
+		}
+		return edges[i].ID < edges[j].ID
+	})
+	return edges
+}
+
+// Returns the ids of the edges with the given id or name.
+func (g *Relay) FindEdges(idOrName string) []svc.EdgeID {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var ids []svc.EdgeID
+	for id, edgeConn := range g.edgeConns {
+		if fmt.Sprint(id) == idOrName || edgeConn.name() == idOrName {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Stops routing new sessions to an edge, like when the edge drains on its
+// own. Active sessions continue.
+func (g *Relay) DrainEdge(id svc.EdgeID) error {
+	g.mu.RLock()
+	_, ok := g.edgeConns[id]
+	g.mu.RUnlock()
+	if !ok {
+		return ErrorEdgeNotFound
+	}
+
+	g.logger.Info("Draining edge", logging.KeyEdge, id)
+	g.DrainHandle(uint64(id))
+	return nil
+}
+
+// Closes the conn of an edge along with its sessions. The edge may
+// reconnect.
+func (g *Relay) DisconnectEdge(id svc.EdgeID) error {
+	g.mu.RLock()
+	edgeConn, ok := g.edgeConns[id]
+	g.mu.RUnlock()
+	if !ok {
+		return ErrorEdgeNotFound
+	}
+
+	g.logger.Info("Disconnecting edge", logging.KeyEdge, id)
+	// The listener stops the conn unless it is closing already.
+	select {
+	case edgeConn.stopC <- ErrorDisconnected:
+	case <-edgeConn.conn.Context().Done():
+	}
+	return nil
+}
+
+// Lists the dialer among the upstream conns of the relay.
+func (g *Relay) AddUpstream(dialer *quic_kingip.Dialer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.upstreams = append(g.upstreams, dialer)
+}
+
+// Removes the dialer from the upstream conns of the relay.
+func (g *Relay) RemoveUpstream(dialer *quic_kingip.Dialer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, upstream := range g.upstreams {
+		if upstream == dialer {
+			g.upstreams = append(g.upstreams[:i], g.upstreams[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the state of the conns to gateways and upstream relays.
+func (g *Relay) Upstreams() []quic_kingip.DialerStatus {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	statuses := make([]quic_kingip.DialerStatus, 0, len(g.upstreams))
+	for _, dialer := range g.upstreams {
+		statuses = append(statuses, dialer.Status())
+	}
+	return statuses
+}
+
+func (r *edgeConn) name() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.peer.Name != "" {
+		return r.peer.Name
+	}
+	return r.hostname
+}
+
+func (r *edgeConn) info(id svc.EdgeID) EdgeInfo {
+	info := EdgeInfo{
+		ID:            id,
+		Name:          r.name(),
+		ConnectedAt:   r.peer.ConnectedAt,
+		RTT:           r.peer.RTT(),
+		ActiveStreams: r.active.Load(),
+		BytesUp:       r.bytesUp.Load(),
+		BytesDown:     r.bytesDown.Load(),
+	}
+	if r.conn != nil {
+		info.RemoteAddr = r.conn.RemoteAddr().String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info.Regions = r.regions
+	info.Draining = r.draining
+	info.Quarantined = r.quarantine.active()
+	return info
+}
@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+)
+
+// Delay before redialing a gateway, doubled after each failed attempt.
+const (
+	poolMinBackoff = time.Second
+	poolMaxBackoff = 30 * time.Second
+)
+
+// GatewayPool keeps the relay connected to a set of gateways, or upstream
+// relays, which may change at runtime such as those found by discovery.
+// Lost conns are redialed.
+type GatewayPool struct {
+	relay     *Relay
+	logger    *slog.Logger
+	newDialer func(addr string) *quic_kingip.Dialer
+	// How long removed gateways may take to drain.
+	drainTimeout time.Duration
+
+	gateways map[string]*pooledGateway
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+type pooledGateway struct {
+	addr    string
+	dialer  *quic_kingip.Dialer
+	stopped atomic.Bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewGatewayPool(relay *Relay, logger *slog.Logger, drainTimeout time.Duration, newDialer func(addr string) *quic_kingip.Dialer) *GatewayPool {
+	return &GatewayPool{
+		relay:        relay,
+		logger:       logging.OrDefault(logger),
+		newDialer:    newDialer,
+		drainTimeout: drainTimeout,
+		gateways:     make(map[string]*pooledGateway),
+	}
+}
+
+// Connects to the gateways not in the pool yet, and drains and closes
+// the conns to those no longer in addrs. Does nothing once shut down.
+func (p *GatewayPool) Set(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+		if _, ok := p.gateways[addr]; ok {
+			continue
+		}
+
+		p.logger.Info("Connecting to gateway", logging.KeyRemote, addr)
+		gw := &pooledGateway{addr: addr, dialer: p.newDialer(addr)}
+		gw.ctx, gw.cancel = context.WithCancel(context.Background())
+		p.gateways[addr] = gw
+		p.relay.AddUpstream(gw.dialer)
+
+		p.wg.Add(1)
+		go p.run(gw)
+	}
+
+	for addr, gw := range p.gateways {
+		if keep[addr] {
+			continue
+		}
+		p.logger.Info("Disconnecting from removed gateway", logging.KeyRemote, addr)
+		delete(p.gateways, addr)
+
+		p.wg.Add(1)
+		go func(gw *pooledGateway) {
+			defer p.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.drainTimeout)
+			defer cancel()
+			if err := p.stop(ctx, gw); err != nil {
+				p.logger.Warn("Failed to drain gateway connection", logging.KeyRemote, gw.addr, logging.Err(err))
+			}
+		}(gw)
+	}
+}
+
+// Returns the addresses of the gateways in the pool.
+func (p *GatewayPool) Addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := make([]string, 0, len(p.gateways))
+	for addr := range p.gateways {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Drains the conns to all gateways, waiting for active streams until ctx
+// is done.
+func (p *GatewayPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	gateways := p.gateways
+	p.gateways = make(map[string]*pooledGateway)
+	p.closed = true
+	p.mu.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(gateways))
+	)
+	for _, gw := range gateways {
+		wg.Add(1)
+		go func(gw *pooledGateway) {
+			defer wg.Done()
+			errs <- p.stop(ctx, gw)
+		}(gw)
+	}
+	wg.Wait()
+	close(errs)
+
+	p.wg.Wait()
+
+	var err error
+	for e := range errs {
+		err = errors.Join(err, e)
+	}
+	return err
+}
+
+func (p *GatewayPool) stop(ctx context.Context, gw *pooledGateway) error {
+	gw.stopped.Store(true)
+	err := gw.dialer.Shutdown(ctx)
+	gw.cancel()
+	p.relay.RemoveUpstream(gw.dialer)
+	return err
+}
+
+// Keeps the gateway connected until it is removed from the pool.
+func (p *GatewayPool) run(gw *pooledGateway) {
+	defer p.wg.Done()
+
+	backoff := poolMinBackoff
+	for {
+		started := time.Now()
+		err := gw.dialer.Dial(gw.ctx)
+		if gw.stopped.Load() {
+			return
+		}
+
+		if err == nil {
+			err = errors.New("Gateway closed the connection")
+		}
+		p.logger.Warn("Gateway connection lost", logging.KeyRemote, gw.addr, logging.Err(err))
+
+		// A connection that lasted resets the backoff.
+		if time.Since(started) > poolMaxBackoff {
+			backoff = poolMinBackoff
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-gw.ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff = min(2*backoff, poolMaxBackoff)
+	}
+}
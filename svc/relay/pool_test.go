@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns an address nothing answers QUIC on.
+func silentAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func upstreamAddrs(relay *Relay) []string {
+	var addrs []string
+	for _, status := range relay.Upstreams() {
+		addrs = append(addrs, status.Addr)
+	}
+	return addrs
+}
+
+func TestGatewayPool(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	pool := NewGatewayPool(relay, logging.Discard(), time.Second, func(addr string) *quic_kingip.Dialer {
+		return quic_kingip.NewDialer(quic_kingip.DialerConfig{Addr: addr, Network: quic_kingip.NetworkQUIC}, logging.Discard(), relay.GatewayHandle)
+	})
+	a, b := silentAddr(t), silentAddr(t)
+
+	pool.Set([]string{a, b})
+	assert.ElementsMatch(t, []string{a, b}, pool.Addrs())
+	assert.ElementsMatch(t, []string{a, b}, upstreamAddrs(relay))
+
+	pool.Set([]string{b})
+	assert.Equal(t, []string{b}, pool.Addrs())
+	assert.Eventually(t, func() bool {
+		return len(relay.Upstreams()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{b}, upstreamAddrs(relay))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, pool.Shutdown(ctx))
+	assert.Empty(t, relay.Upstreams())
+
+	// Discovery that finishes after shutdown adds nothing.
+	pool.Set([]string{a})
+	assert.Empty(t, pool.Addrs())
+}
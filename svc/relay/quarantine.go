@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"time"
+)
+
+// Keeps sessions away from an edge that fails most of its setups. Once
+// the quarantine is over, a single session is let through to probe the
+// edge: it is back in rotation if that succeeds and quarantined again
+// otherwise.
+type quarantine struct {
+	until time.Time
+	// Set while the probe session is being set up.
+	probing bool
+	// Number of times the edge was quarantined.
+	count uint64
+}
+
+func (q *quarantine) active() bool {
+	return !q.until.IsZero()
+}
+
+// Edges are routed to before and after their quarantine, as long as no
+// probe is in flight.
+func (q *quarantine) routable(now time.Time) bool {
+	return !q.active() || (!now.Before(q.until) && !q.probing)
+}
+
+// Returns whether a session may be set up on the edge, starting the probe
+// if the quarantine is over.
+func (q *quarantine) admit(now time.Time) bool {
+	if !q.active() {
+		return true
+	}
+	if !q.routable(now) {
+		return false
+	}
+
+	q.probing = true
+	return true
+}
+
+func (q *quarantine) start(now time.Time, d time.Duration) {
+	q.until = now.Add(d)
+	q.probing = false
+	q.count++
+}
+
+func (q *quarantine) end() {
+	q.until = time.Time{}
+	q.probing = false
+}
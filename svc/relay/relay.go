@@ -1,32 +1,62 @@
 package relay
 
 import (
-	"bufio"
 	"errors"
-	"io"
-	"log"
+	"fmt"
+	"log/slog"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/pipe"
 	"github.com/bacv/kingip/lib/proto"
 	quic_kingip "github.com/bacv/kingip/lib/quic"
+	"github.com/bacv/kingip/lib/trace"
 	"github.com/bacv/kingip/lib/transport"
+	"github.com/bacv/kingip/lib/watchdog"
 	"github.com/bacv/kingip/svc"
 	"github.com/quic-go/quic-go"
 )
 
 type edgeConn struct {
-	conn    quic.Connection
-	stopC   chan error
-	regions []svc.Region
-	mu      sync.Mutex
+	conn  quic_kingip.Conn
+	peer  *quic_kingip.Peer
+	stopC chan error
+	// Hostname the edge announced with its regions.
+	hostname   string
+	regions    []svc.Region
+	draining   bool
+	capacity   *proto.Capacity
+	outcomes   outcomes
+	quarantine quarantine
+	mu         sync.Mutex
+
+	active    atomic.Int64
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
 }
 
-func (r *edgeConn) updateRegions(regions []svc.Region) {
+// Edges are routed to unless they drain, are full or are quarantined.
+func (r *edgeConn) routable(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !r.draining && (r.capacity == nil || r.capacity.Available) && r.quarantine.routable(now)
+}
+
+func (r *edgeConn) updateRegions(regions []svc.Region, hostname string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	r.regions = regions
+	if hostname != "" {
+		r.hostname = hostname
+	}
 }
 
 func (r *edgeConn) getRegions() []svc.Region {
@@ -36,6 +66,20 @@ func (r *edgeConn) getRegions() []svc.Region {
 	return r.regions
 }
 
+func (r *edgeConn) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+}
+
+func (r *edgeConn) setCapacity(capacity proto.Capacity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.capacity = &capacity
+}
+
 func (e *edgeConn) openStream() (quic.Stream, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -43,21 +87,94 @@ func (e *edgeConn) openStream() (quic.Stream, error) {
 	return e.conn.OpenStream()
 }
 
+// Counts the bytes read from an end of a session on the edge.
+type countedEnd struct {
+	pipe.End
+	bytes *atomic.Int64
+}
+
+func (e *countedEnd) Read(p []byte) (int, error) {
+	n, err := e.End.Read(p)
+	e.bytes.Add(int64(n))
+	return n, err
+}
+
+var (
+	ErrorMaxHops      = errors.New("Max relay hops exceeded")
+	ErrorRelayLoop    = errors.New("Relay loop detected")
+	ErrorNoEdge       = &proto.RetryError{Reason: "No edge in region"}
+	ErrorEdgeNotFound = errors.New("Edge not found")
+	ErrorRelayID      = errors.New(`Relay id must be set and must not contain "," or ";"`)
+	// Sent to the listener to close the conn of an edge.
+	ErrorDisconnected = errors.New("Disconnected by admin")
+)
+
+// Max number of edges a session is offered to when they are full.
+const maxEdgeAttempts = 3
+
+type Config struct {
+	// Identifies this relay in proxy paths, must not contain "," or ";".
+	ID string
+	// Max number of relays a proxy request may pass through.
+	MaxHops int
+	// Closes sessions that transferred no data for this long, zero
+	// disables it.
+	IdleTimeout time.Duration
+	// Caps the max duration requested by the gateway, zero means no cap.
+	MaxDuration time.Duration
+	// Exports spans of proxied sessions, may be nil.
+	Tracer *trace.Tracer
+	// Edges failing at least this share of their recent session setups
+	// get no sessions for QuarantineTime, zero disables it. Edges are
+	// judged once they had QuarantineMinSetups setups.
+	QuarantineFailureRate float64
+	QuarantineMinSetups   int
+	QuarantineTime        time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ID:          fmt.Sprintf("%016x", rand.Uint64()),
+		MaxHops:     8,
+		IdleTimeout: 5 * time.Minute,
+
+		QuarantineFailureRate: 0.8,
+		QuarantineMinSetups:   10,
+		QuarantineTime:        30 * time.Second,
+	}
+}
+
+// Ids with "," or ";" would break the path encoding of proxy requests, and
+// with it loop detection.
+func (c Config) Validate() error {
+	if c.ID == "" || strings.ContainsAny(c.ID, ",;") {
+		return ErrorRelayID
+	}
+	return nil
+}
+
 type Relay struct {
+	config    Config
+	logger    *slog.Logger
 	edgeConns map[svc.EdgeID]*edgeConn
+	upstreams []*quic_kingip.Dialer
 	regions   *svc.RegionCache
+	now       func() time.Time
 	mu        sync.RWMutex
 }
 
-func NewRelay() *Relay {
+func NewRelay(config Config, logger *slog.Logger) *Relay {
 	return &Relay{
+		config:    config,
+		logger:    logging.OrDefault(logger),
 		edgeConns: make(map[svc.EdgeID]*edgeConn),
 		regions:   svc.NewRegionsCache(),
+		now:       time.Now,
 	}
 }
 
-func (g *Relay) RegisterHandle(conn quic.Connection) (uint64, <-chan error, error) {
-	relayId, stopC := g.registerEdge(conn)
+func (g *Relay) RegisterHandle(conn quic_kingip.Conn, peer *quic_kingip.Peer) (uint64, <-chan error, error) {
+	relayId, stopC := g.registerEdge(conn, peer)
 	return uint64(relayId), stopC, nil
 }
 
@@ -65,6 +182,29 @@ func (g *Relay) RegionsHandle(id uint64, regions map[string]string) error {
 	return g.registerRegions(svc.EdgeID(id), regions)
 }
 
+// Stops routing new streams to a draining edge, active ones continue.
+func (g *Relay) DrainHandle(id uint64) {
+	regions := g.drainEdge(svc.EdgeID(id))
+	for _, region := range regions {
+		g.regions.Remove(region, id)
+	}
+}
+
+// Takes an edge out of rotation while it is full and puts it back once it
+// has room again.
+func (g *Relay) CapacityHandle(id uint64, capacity proto.Capacity) {
+	// Holding the lock keeps a closing edge from being added back.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edgeConn, ok := g.edgeConns[svc.EdgeID(id)]
+	if !ok {
+		return
+	}
+	edgeConn.setCapacity(capacity)
+	g.route(svc.EdgeID(id), edgeConn)
+}
+
 func (g *Relay) CloseHandle(id uint64) {
 	regions := g.closeEdge(svc.EdgeID(id))
 	for _, region := range regions {
@@ -72,88 +212,237 @@ func (g *Relay) CloseHandle(id uint64) {
 	}
 }
 
+// Handles proxy requests from upstream, which is either a gateway or
+// another relay that this relay dialed as an edge.
 func (r *Relay) GatewayHandle(gatewayStream quic.Stream) error {
 	// Receive proxy destination and region.
-	destination, region, err := getProxyDetails(gatewayStream)
+	var edgeStream quic.Stream
+	var edgeConn *edgeConn
+	var result proto.ProxyResult
+	proxy, gatewayStream, err := getProxyDetails(gatewayStream)
 	if err != nil {
-		log.Println("Unable to create proxy", err)
+		gatewayStream.Close()
+		r.logger.Warn("Unable to create proxy", logging.Err(err))
+		return err
 	}
 
-	// Pass everything to the edge conn.
-	edgeId, ok := r.regions.Get(region)
-	if !ok {
-		return errors.New("No relay in region")
-	}
+	logger := r.logger.With(
+		logging.KeySession, proxy.SessionID,
+		logging.KeyRegion, proxy.Region,
+		logging.KeyDestination, proxy.Destination,
+	)
+	traceID, _ := trace.ParseTraceID(proxy.SessionID)
+	parent, _ := trace.ParseSpanID(proxy.SpanID)
 
-	edgeStream, err := r.openStream(svc.EdgeID(edgeId))
+	setup := r.config.Tracer.Start("relay.setup", traceID, parent)
+	setup.SetAttr("relay", r.config.ID)
+
+	proxy, err = r.addHop(proxy)
+	if err == nil {
+		proxy.SpanID = setup.SpanID().String()
+		proxy.MaxDuration = watchdog.Shortest(r.config.MaxDuration, proxy.MaxDuration)
+		edgeStream, edgeConn, result, err = r.openEdgeStream(proxy)
+	}
+	setup.SetAttr("edge", result.EdgeID)
+	setup.End(err)
 	if err != nil {
+		replyProxy(gatewayStream, errorMessage(err))
+		gatewayStream.Close()
+		logger.Warn("Unable to proxy", logging.KeyPath, strings.Join(proxy.Path, " > "), logging.Err(err))
 		return err
 	}
 
-	_, err = quic_kingip.SyncTransport(
-		edgeStream,
-		r.handleEdgeStreamInit,
-		proto.NewMsgGatewayProxy(string(destination), string(region)),
+	if err := replyProxy(gatewayStream, proto.NewMsgProxySuccess(result)); err != nil {
+		quic_kingip.CancelStream(edgeStream, quic_kingip.StreamErrorCodeAborted)
+		logger.Warn("Unable to reply to proxy request", logging.Err(err))
+		return err
+	}
+	logger.Info("Proxying", logging.KeyPath, strings.Join(proxy.Path, " > "), logging.KeyEdge, result.EdgeID)
+
+	transfer := r.config.Tracer.Start("relay.transfer", setup.TraceID(), parent)
+	timeout := watchdog.Start(r.config.IdleTimeout, proxy.MaxDuration, func(err error) {
+		logger.Info("Closing session", logging.Err(err))
+		quic_kingip.CancelStream(gatewayStream, quic_kingip.StreamErrorCodeTimeout)
+		quic_kingip.CancelStream(edgeStream, quic_kingip.StreamErrorCodeTimeout)
+	})
+
+	edgeConn.active.Add(1)
+	res := pipe.Run(
+		&countedEnd{End: quic_kingip.StreamEnd(gatewayStream), bytes: &edgeConn.bytesUp},
+		&countedEnd{End: quic_kingip.StreamEnd(edgeStream), bytes: &edgeConn.bytesDown},
+		timeout.Touch,
 	)
-
-	go transferData(gatewayStream, edgeStream)
-	transferData(edgeStream, gatewayStream)
+	edgeConn.active.Add(-1)
+	timeout.Stop()
+	if res.Err != nil {
+		logger.Debug("Transfer failed", logging.Err(res.Err))
+	}
+	transfer.SetAttr("bytes_up", strconv.FormatInt(res.AToB, 10))
+	transfer.SetAttr("bytes_down", strconv.FormatInt(res.BToA, 10))
+	transfer.End(errors.Join(timeout.Err(), res.Err))
 
 	return nil
+}
+
+// Adds this relay to the proxy path, rejecting loops and long chains.
+func (r *Relay) addHop(proxy proto.GatewayProxy) (proto.GatewayProxy, error) {
+	for _, id := range proxy.Path {
+		if id == r.config.ID {
+			return proxy, ErrorRelayLoop
+		}
+	}
+
+	proxy.Path = append(proxy.Path, r.config.ID)
+	if len(proxy.Path) > r.config.MaxHops {
+		return proxy, ErrorMaxHops
+	}
 
+	return proxy, nil
 }
 
-func (r *Relay) handleEdgeStreamInit(w transport.ResponseWriter, rd proto.Message) error {
-	mt, _, err := rd.UnmarshalMap()
+// Offers the session to edges of the region until one that is not full
+// takes it.
+func (r *Relay) openEdgeStream(proxy proto.GatewayProxy) (quic.Stream, *edgeConn, proto.ProxyResult, error) {
+	// Edges held back by their quarantine are not tried at all.
+	var lastErr error = ErrorNoEdge
+	tried := make(map[uint64]bool)
+	for attempt := 0; attempt < maxEdgeAttempts; attempt++ {
+		edgeId, ok := r.regions.Get(svc.Region(proxy.Region))
+		if !ok {
+			return nil, nil, proto.ProxyResult{}, ErrorNoEdge
+		}
+		if tried[edgeId] {
+			break
+		}
+		tried[edgeId] = true
+		if !r.admit(svc.EdgeID(edgeId)) {
+			continue
+		}
+
+		start := time.Now()
+		edgeStream, edgeConn, result, err := r.proxyEdge(edgeId, proxy)
+		r.recordOutcome(svc.EdgeID(edgeId), err, time.Since(start))
+		var retryErr *proto.RetryError
+		if !errors.As(err, &retryErr) {
+			return edgeStream, edgeConn, result, err
+		}
+		lastErr = err
+	}
+	return nil, nil, proto.ProxyResult{}, lastErr
+}
+
+func (r *Relay) proxyEdge(edgeId uint64, proxy proto.GatewayProxy) (quic.Stream, *edgeConn, proto.ProxyResult, error) {
+	edgeStream, edgeConn, err := r.openStream(svc.EdgeID(edgeId))
 	if err != nil {
-		return err
+		return nil, nil, proto.ProxyResult{}, err
 	}
 
-	if proto.MsgSuccess != mt {
-		errors.New("Wrong protocol message")
+	var result proto.ProxyResult
+	if edgeStream, err = quic_kingip.SyncTransport(
+		edgeStream,
+		func(w transport.ResponseWriter, rd proto.Message) error {
+			result, err = rd.UnmarshalProxyResult()
+			return err
+		},
+		proto.NewMsgGatewayProxy(proxy),
+	); err != nil {
+		edgeStream.Close()
+		return nil, nil, proto.ProxyResult{}, err
 	}
 
-	return nil
+	// Relays further down the chain already set the id of the actual edge.
+	if result.EdgeID == "" {
+		result.EdgeID = fmt.Sprint(edgeId)
+	}
+
+	return edgeStream, edgeConn, result, nil
 }
 
-func (g *Relay) openStream(edgeId svc.EdgeID) (quic.Stream, error) {
+func (g *Relay) openStream(edgeId svc.EdgeID) (quic.Stream, *edgeConn, error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
 	relay, ok := g.edgeConns[edgeId]
 	if !ok {
-		return nil, errors.New("Relay not found")
+		return nil, nil, errors.New("Relay not found")
 	}
 
-	return relay.openStream()
+	stream, err := relay.openStream()
+	return stream, relay, err
 }
 
-func (g *Relay) registerEdge(conn quic.Connection) (svc.EdgeID, chan error) {
+func (g *Relay) registerEdge(conn quic_kingip.Conn, peer *quic_kingip.Peer) (svc.EdgeID, chan error) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
 	id := svc.EdgeID(rand.Uint64())
+	if peer == nil {
+		peer = &quic_kingip.Peer{ConnectedAt: g.now()}
+	}
 
 	if _, ok := g.edgeConns[id]; !ok {
 		stopC := make(chan error)
-		g.edgeConns[id] = &edgeConn{conn: conn, stopC: stopC}
+		g.edgeConns[id] = &edgeConn{conn: conn, peer: peer, stopC: stopC}
 		return id, stopC
 	}
 
 	return svc.EdgeID(0), nil
 }
 
+// Replaces the regions of an edge, it is routed to in the new ones unless
+// it drains or is full.
 func (g *Relay) registerRegions(relayId svc.EdgeID, regions map[string]string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edgeConn, ok := g.edgeConns[relayId]
+	if !ok {
+		return errors.New("Relay not found")
+	}
+
+	for _, region := range edgeConn.getRegions() {
+		if _, ok := regions[string(region)]; !ok {
+			g.regions.Remove(region, uint64(relayId))
+		}
+	}
+
 	var edgeRegions []svc.Region
-	for region, _ := range regions {
-		g.regions.Add(svc.Region(region), uint64(relayId))
+	var hostname string
+	for region, host := range regions {
 		edgeRegions = append(edgeRegions, svc.Region(region))
+		// Edges announce one hostname for all regions, max keeps the
+		// choice stable if they do not.
+		hostname = max(hostname, host)
 	}
+	sort.Slice(edgeRegions, func(i, j int) bool { return edgeRegions[i] < edgeRegions[j] })
+	edgeConn.updateRegions(edgeRegions, hostname)
+	g.route(relayId, edgeConn)
+	return nil
+}
 
-	g.mu.Lock()
-	defer g.mu.Unlock()
+// Adds an edge to its regions or removes it, depending on whether it is
+// routable. Callers hold g.mu, which keeps a closing edge from being
+// added back.
+func (g *Relay) route(id svc.EdgeID, edgeConn *edgeConn) {
+	routable := edgeConn.routable(g.now())
+	for _, region := range edgeConn.getRegions() {
+		if routable {
+			g.regions.Add(region, uint64(id))
+		} else {
+			g.regions.Remove(region, uint64(id))
+		}
+	}
+}
+
+func (g *Relay) drainEdge(id svc.EdgeID) []svc.Region {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if edgeConn, ok := g.edgeConns[id]; ok {
+		edgeConn.drain()
+		return edgeConn.getRegions()
+	}
 
-	g.edgeConns[relayId].updateRegions(edgeRegions)
 	return nil
 }
 
@@ -170,27 +459,34 @@ func (g *Relay) closeEdge(id svc.EdgeID) []svc.Region {
 	return nil
 }
 
-func getProxyDetails(stream quic.Stream) (svc.Destination, svc.Region, error) {
+// Reads the proxy request and returns the stream to copy the session
+// data from, which starts with any bytes sent right after the request.
+func getProxyDetails(stream quic.Stream) (proto.GatewayProxy, quic.Stream, error) {
 	t := transport.NewTransport(stream, nil)
-	defer t.Abandon()
-
-	bytes, err := bufio.NewReader(t).ReadBytes(proto.ByteLF)
-
-	mt, proxy, err := proto.Message(bytes).UnmarshalMap()
+	msg, err := t.ReadMessage()
+	stream = quic_kingip.AbandonTransport(stream, t)
 	if err != nil {
-		return "", "", err
+		return proto.GatewayProxy{}, stream, err
 	}
 
-	if proto.MsgGatewayProxy != mt {
-		return "", "", errors.New("Wrong protocol message")
-	}
+	proxy, err := msg.UnmarshalGatewayProxy()
+	return proxy, stream, err
+}
 
-	t.Write(proto.NewMsgSuccess())
-	return svc.Destination(proxy["destination"]), svc.Region(proxy["region"]), nil
+// Passes on that a session may be retried elsewhere, or that it failed
+// for its destination rather than the edge.
+func errorMessage(err error) proto.Message {
+	var retryErr *proto.RetryError
+	if errors.As(err, &retryErr) {
+		return proto.NewMsgRetry(err.Error())
+	}
+	var destErr *proto.DestinationError
+	if errors.As(err, &destErr) {
+		return proto.NewMsgDestinationError(err.Error())
+	}
+	return proto.NewMsgError(err.Error())
 }
 
-func transferData(dst svc.Conn, src svc.Conn) {
-	defer dst.Close()
-	defer src.Close()
-	io.Copy(dst, src)
+func replyProxy(stream quic.Stream, msg proto.Message) error {
+	return transport.NewTransport(stream, nil).Write(msg)
 }
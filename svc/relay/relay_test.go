@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/proto"
+	"github.com/bacv/kingip/svc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddHopDetectsLoop(t *testing.T) {
+	relay := NewRelay(Config{ID: "b", MaxHops: 8}, logging.Discard())
+
+	_, err := relay.addHop(proto.GatewayProxy{
+		Destination: "example.com:80",
+		Region:      "red",
+		Path:        []string{"a", "b", "c"},
+	})
+	assert.ErrorIs(t, err, ErrorRelayLoop)
+}
+
+func TestAddHopMaxHops(t *testing.T) {
+	relay := NewRelay(Config{ID: "c", MaxHops: 2}, logging.Discard())
+
+	_, err := relay.addHop(proto.GatewayProxy{
+		Destination: "example.com:80",
+		Region:      "red",
+		Path:        []string{"a", "b"},
+	})
+	assert.ErrorIs(t, err, ErrorMaxHops)
+}
+
+func TestAddHopAppendsID(t *testing.T) {
+	relay := NewRelay(Config{ID: "b", MaxHops: 8}, logging.Discard())
+
+	proxy, err := relay.addHop(proto.GatewayProxy{Path: []string{"a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, proxy.Path)
+}
+
+func TestConfigValidateID(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+	for _, id := range []string{"", "a,b", "a;b"} {
+		assert.ErrorIs(t, Config{ID: id}.Validate(), ErrorRelayID)
+	}
+}
+
+func TestCapacityHandle(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	id, _, _ := relay.RegisterHandle(nil, nil)
+	relay.RegionsHandle(id, map[string]string{"red": "edge"})
+
+	relay.CapacityHandle(id, proto.Capacity{Available: false})
+	_, ok := relay.regions.Get("red")
+	assert.False(t, ok)
+
+	relay.CapacityHandle(id, proto.Capacity{Available: true, Sessions: 1})
+	edgeId, ok := relay.regions.Get("red")
+	assert.True(t, ok)
+	assert.Equal(t, id, edgeId)
+
+	// A draining edge stays out of rotation when it has room again.
+	relay.DrainHandle(id)
+	relay.CapacityHandle(id, proto.Capacity{Available: true, Sessions: 2})
+	_, ok = relay.regions.Get("red")
+	assert.False(t, ok)
+}
+
+func TestRegionsHandleReplaces(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	id, _, _ := relay.RegisterHandle(nil, nil)
+	relay.RegionsHandle(id, map[string]string{"red": "edge", "blue": "edge"})
+
+	// An unhealthy edge withdraws from all regions.
+	relay.RegionsHandle(id, map[string]string{})
+	_, ok := relay.regions.Get("red")
+	assert.False(t, ok)
+
+	relay.RegionsHandle(id, map[string]string{"blue": "edge"})
+	_, ok = relay.regions.Get("red")
+	assert.False(t, ok)
+	_, ok = relay.regions.Get("blue")
+	assert.True(t, ok)
+}
+
+func TestEdgeStats(t *testing.T) {
+	relay := NewRelay(DefaultConfig(), logging.Discard())
+	id, _, _ := relay.RegisterHandle(nil, nil)
+
+	relay.recordOutcome(svc.EdgeID(id), nil, 10*time.Millisecond)
+	relay.recordOutcome(svc.EdgeID(id), nil, 30*time.Millisecond)
+	relay.recordOutcome(svc.EdgeID(id), errors.New("Connection refused"), time.Second)
+	relay.recordOutcome(svc.EdgeID(id), &proto.RetryError{Reason: "full"}, 0)
+	relay.recordOutcome(svc.EdgeID(id), &proto.DestinationError{Reason: "no such host"}, 20*time.Millisecond)
+
+	stats := relay.EdgeStats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, uint64(4), stats[0].Sessions)
+	assert.Equal(t, uint64(1), stats[0].Failures)
+	assert.InDelta(t, 0.25, stats[0].FailureRate, 0.01)
+	assert.Equal(t, 20*time.Millisecond, stats[0].Latency)
+}
+
+func TestQuarantine(t *testing.T) {
+	config := DefaultConfig()
+	config.QuarantineMinSetups = 2
+	config.QuarantineTime = time.Hour
+	relay := NewRelay(config, logging.Discard())
+	now := time.Now()
+	relay.now = func() time.Time { return now }
+
+	id, _, _ := relay.RegisterHandle(nil, nil)
+	edgeId := svc.EdgeID(id)
+	relay.RegionsHandle(id, map[string]string{"red": "edge"})
+
+	relay.recordOutcome(edgeId, errors.New("Connection refused"), 0)
+	_, ok := relay.regions.Get("red")
+	assert.True(t, ok)
+	relay.recordOutcome(edgeId, errors.New("Connection refused"), 0)
+	_, ok = relay.regions.Get("red")
+	assert.False(t, ok)
+	assert.False(t, relay.admit(edgeId))
+
+	// Once the quarantine is over, one session probes the edge.
+	now = now.Add(time.Hour)
+	relay.reroute(edgeId)
+	_, ok = relay.regions.Get("red")
+	assert.True(t, ok)
+	assert.True(t, relay.admit(edgeId))
+	assert.False(t, relay.admit(edgeId))
+	_, ok = relay.regions.Get("red")
+	assert.False(t, ok)
+
+	// A failed probe quarantines the edge again.
+	relay.recordOutcome(edgeId, errors.New("Connection refused"), 0)
+	now = now.Add(time.Hour)
+	relay.reroute(edgeId)
+	assert.True(t, relay.admit(edgeId))
+	relay.recordOutcome(edgeId, nil, time.Millisecond)
+	_, ok = relay.regions.Get("red")
+	assert.True(t, ok)
+
+	stats := relay.EdgeStats()
+	assert.False(t, stats[0].Quarantined)
+	assert.Equal(t, uint64(2), stats[0].Quarantines)
+	assert.Equal(t, 0.0, stats[0].FailureRate)
+	assert.Equal(t, time.Millisecond, stats[0].Latency)
+}
+
+func TestOpenEdgeStreamNotAdmitted(t *testing.T) {
+	config := DefaultConfig()
+	config.QuarantineMinSetups = 1
+	relay := NewRelay(config, logging.Discard())
+	now := time.Now()
+	relay.now = func() time.Time { return now }
+
+	id, _, _ := relay.RegisterHandle(nil, nil)
+	edgeId := svc.EdgeID(id)
+	relay.RegionsHandle(id, map[string]string{"red": "edge"})
+	relay.recordOutcome(edgeId, errors.New("Connection refused"), 0)
+
+	// Another session probes the edge, which a concurrent lookup still
+	// found in its region.
+	now = now.Add(config.QuarantineTime)
+	assert.True(t, relay.admit(edgeId))
+	relay.regions.Add("red", id)
+
+	_, _, _, err := relay.openEdgeStream(proto.GatewayProxy{Region: "red"})
+	assert.ErrorIs(t, err, ErrorNoEdge)
+	msgType, err := errorMessage(err).Type()
+	assert.NoError(t, err)
+	assert.Equal(t, proto.MsgRetry, msgType)
+}
@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/proto"
+	"github.com/bacv/kingip/svc"
+)
+
+// Number of recent session setups the failure rate of an edge is taken
+// over.
+const outcomeWindow = 50
+
+type EdgeStats struct {
+	ID      svc.EdgeID   `json:"id"`
+	Regions []svc.Region `json:"regions"`
+	// Session setups offered to the edge, and those that failed. Sessions
+	// rejected because the edge was full are no failures.
+	Sessions uint64 `json:"sessions"`
+	Failures uint64 `json:"failures"`
+	// Share of failed setups among the recent ones, 0 if there were none.
+	FailureRate float64 `json:"failure_rate"`
+	// Mean duration of the recent successful setups.
+	Latency     time.Duration `json:"latency_ns"`
+	Quarantined bool          `json:"quarantined"`
+	Quarantines uint64        `json:"quarantines"`
+}
+
+// Outcomes of the recent session setups of an edge.
+type outcomes struct {
+	failed   [outcomeWindow]bool
+	latency  [outcomeWindow]time.Duration
+	next     int
+	count    int
+	sessions uint64
+	failures uint64
+}
+
+func (o *outcomes) record(err error, latency time.Duration) {
+	o.failed[o.next] = err != nil
+	o.latency[o.next] = latency
+	o.next = (o.next + 1) % outcomeWindow
+	o.count = min(o.count+1, outcomeWindow)
+	o.sessions++
+	if err != nil {
+		o.failures++
+	}
+}
+
+// Forgets the recent setups, the totals are kept.
+func (o *outcomes) reset() {
+	o.next, o.count = 0, 0
+}
+
+func (o *outcomes) failureRate() float64 {
+	if o.count == 0 {
+		return 0
+	}
+
+	var failed int
+	for i := 0; i < o.count; i++ {
+		if o.failed[i] {
+			failed++
+		}
+	}
+	return float64(failed) / float64(o.count)
+}
+
+func (o *outcomes) meanLatency() time.Duration {
+	var total time.Duration
+	var ok int
+	for i := 0; i < o.count; i++ {
+		if !o.failed[i] {
+			total += o.latency[i]
+			ok++
+		}
+	}
+	if ok == 0 {
+		return 0
+	}
+	return total / time.Duration(ok)
+}
+
+// Returns the stats of every connected edge, ordered by id.
+func (g *Relay) EdgeStats() []EdgeStats {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	stats := make([]EdgeStats, 0, len(g.edgeConns))
+	for id, edgeConn := range g.edgeConns {
+		stats = append(stats, edgeConn.stats(id))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// Records how a session setup on an edge went, quarantining the edge when
+// it fails too often.
+func (g *Relay) recordOutcome(id svc.EdgeID, err error, latency time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edgeConn, ok := g.edgeConns[id]
+	if !ok {
+		return
+	}
+
+	switch edgeConn.recordOutcome(err, latency, g.now(), g.config) {
+	case outcomeQuarantined:
+		g.logger.Warn("Quarantining edge", logging.KeyEdge, id, "duration", g.config.QuarantineTime, logging.Err(err))
+		time.AfterFunc(g.config.QuarantineTime, func() { g.reroute(id) })
+	case outcomeReleased:
+		g.logger.Info("Edge out of quarantine", logging.KeyEdge, id)
+	}
+	g.route(id, edgeConn)
+}
+
+// Returns whether a session may be set up on an edge. The first session
+// after a quarantine probes the edge, which is out of rotation until it
+// is set up.
+func (g *Relay) admit(id svc.EdgeID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edgeConn, ok := g.edgeConns[id]
+	if !ok {
+		return true
+	}
+
+	admitted, probe := edgeConn.admit(g.now())
+	if probe {
+		g.logger.Info("Probing quarantined edge", logging.KeyEdge, id)
+		g.route(id, edgeConn)
+	}
+	return admitted
+}
+
+// Puts an edge back into rotation once its quarantine is over.
+func (g *Relay) reroute(id svc.EdgeID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if edgeConn, ok := g.edgeConns[id]; ok {
+		g.route(id, edgeConn)
+	}
+}
+
+const (
+	outcomeRecorded = iota
+	outcomeQuarantined
+	outcomeReleased
+)
+
+func (r *edgeConn) recordOutcome(err error, latency time.Duration, now time.Time, config Config) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A full edge says nothing about its health, so a probe it rejects
+	// is retried with a later session.
+	var retryErr *proto.RetryError
+	if errors.As(err, &retryErr) {
+		r.quarantine.probing = false
+		return outcomeRecorded
+	}
+	// Neither does a session the edge denied or whose destination it
+	// could not reach, the edge itself worked.
+	var destErr *proto.DestinationError
+	if errors.As(err, &destErr) {
+		err = nil
+	}
+
+	if r.quarantine.probing {
+		if err != nil {
+			r.outcomes.record(err, latency)
+			r.quarantine.start(now, config.QuarantineTime)
+			return outcomeQuarantined
+		}
+		// The failures before the quarantine no longer count.
+		r.outcomes.reset()
+		r.outcomes.record(err, latency)
+		r.quarantine.end()
+		return outcomeReleased
+	}
+
+	r.outcomes.record(err, latency)
+
+	if config.QuarantineFailureRate > 0 && !r.quarantine.active() &&
+		r.outcomes.count >= config.QuarantineMinSetups &&
+		r.outcomes.failureRate() >= config.QuarantineFailureRate {
+		r.quarantine.start(now, config.QuarantineTime)
+		return outcomeQuarantined
+	}
+	return outcomeRecorded
+}
+
+func (r *edgeConn) admit(now time.Time) (bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	probing := r.quarantine.probing
+	admitted := r.quarantine.admit(now)
+	return admitted, !probing && r.quarantine.probing
+}
+
+func (r *edgeConn) stats(id svc.EdgeID) EdgeStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return EdgeStats{
+		ID:          id,
+		Regions:     r.regions,
+		Sessions:    r.outcomes.sessions,
+		Failures:    r.outcomes.failures,
+		FailureRate: r.outcomes.failureRate(),
+		Latency:     r.outcomes.meanLatency(),
+		Quarantined: r.quarantine.active(),
+		Quarantines: r.quarantine.count,
+	}
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/redis"
+	"github.com/bacv/kingip/svc"
+)
+
+type RedisConfig struct {
+	// Identifies this gateway among those sharing the store.
+	GatewayID string
+	// Prepended to every key.
+	Prefix string
+	// Sessions of a gateway that did not renew its lease for this long are
+	// no longer counted.
+	LeaseTTL time.Duration
+	// How often the lease is renewed and the shared session counts are
+	// reset to those of this gateway, correcting any drift.
+	ReconcileInterval time.Duration
+}
+
+func DefaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		GatewayID:         fmt.Sprintf("%016x", rand.Uint64()),
+		Prefix:            "kingip:",
+		LeaseTTL:          30 * time.Second,
+		ReconcileInterval: 10 * time.Second,
+	}
+}
+
+// RedisStore shares session counts and bandwidth use of users between
+// gateways through a Redis server.
+//
+// Each gateway counts its sessions of a user in a field of the user's
+// hash, and holds a lease that expires unless renewed. Counts of gateways
+// without a lease are ignored and eventually removed, so sessions of a
+// gateway that died stop counting after LeaseTTL. If the server is
+// unreachable, sessions are limited per gateway and bandwidth use is kept
+// until it can be added.
+type RedisStore struct {
+	config RedisConfig
+	client *redis.Client
+	logger *slog.Logger
+
+	// Sessions of users on this gateway.
+	sessions map[svc.UserID]int
+	// Bandwidth use not yet added to the shared counts, and the last known
+	// shared counts.
+	pendingMBs map[svc.UserID]float64
+	usedMBs    map[svc.UserID]float64
+	mu         sync.Mutex
+
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+func NewRedisStore(config RedisConfig, client *redis.Client, logger *slog.Logger) *RedisStore {
+	defaults := DefaultRedisConfig()
+	if config.GatewayID == "" {
+		config.GatewayID = defaults.GatewayID
+	}
+	if config.LeaseTTL <= 0 {
+		config.LeaseTTL = defaults.LeaseTTL
+	}
+	if config.ReconcileInterval <= 0 {
+		config.ReconcileInterval = defaults.ReconcileInterval
+	}
+
+	s := &RedisStore{
+		config:     config,
+		client:     client,
+		logger:     logging.OrDefault(logger).With("gateway", config.GatewayID),
+		sessions:   make(map[svc.UserID]int),
+		pendingMBs: make(map[svc.UserID]float64),
+		usedMBs:    make(map[svc.UserID]float64),
+		stopC:      make(chan struct{}),
+		doneC:      make(chan struct{}),
+	}
+	// Takes the lease before counting any session.
+	s.reconcile()
+	go s.run()
+	return s
+}
+
+// Counts a new session of the user and returns the sessions of the user
+// on all live gateways.
+func (s *RedisStore) SessionAdd(userID svc.UserID) uint16 {
+	s.mu.Lock()
+	s.sessions[userID]++
+	local := s.sessions[userID]
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	key := s.sessionsKey(userID)
+	replies, err := s.client.Pipeline(ctx,
+		[]string{"MULTI"},
+		[]string{"HINCRBY", key, s.config.GatewayID, "1"},
+		[]string{"PEXPIRE", key, s.leaseMillis()},
+		[]string{"HGETALL", key},
+		[]string{"EXEC"},
+	)
+	var counts map[string]int64
+	if err == nil {
+		counts, err = execCounts(replies)
+	}
+	if err == nil {
+		var total int64
+		total, err = s.liveTotal(ctx, counts)
+		if err == nil {
+			return uint16(min(total, 1<<16-1))
+		}
+	}
+
+	s.logger.Warn("Unable to count sessions in store, counting locally", logging.KeyUser, userID, logging.Err(err))
+	return uint16(min(local, 1<<16-1))
+}
+
+func (s *RedisStore) SessionRemove(userID svc.UserID) {
+	s.mu.Lock()
+	if s.sessions[userID] > 0 {
+		s.sessions[userID]--
+	}
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	// A failed decrement is fixed by the next reconciliation.
+	if _, err := s.client.Do(ctx, "HINCRBY", s.sessionsKey(userID), s.config.GatewayID, "-1"); err != nil {
+		s.logger.Warn("Unable to remove session from store", logging.KeyUser, userID, logging.Err(err))
+	}
+}
+
+func (s *RedisStore) UpdateUserTotalUsedMBs(userID svc.UserID, mbs float64) {
+	ctx := context.Background()
+	total, err := redis.Float(s.client.Do(ctx, "INCRBYFLOAT", s.bandwidthKey(userID), formatFloat(mbs)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Warn("Unable to add bandwidth use to store, retrying later", logging.KeyUser, userID, logging.Err(err))
+		s.pendingMBs[userID] += mbs
+		return
+	}
+	s.usedMBs[userID] = total
+}
+
+// Returns the bandwidth use of the user on all gateways, or the last
+// known one if the store is unreachable.
+func (s *RedisStore) GetUserTotalUsedMBs(userID svc.UserID) float64 {
+	ctx := context.Background()
+	total, err := redis.Float(s.client.Do(ctx, "GET", s.bandwidthKey(userID)))
+	if err == redis.ErrorNil {
+		total, err = 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Warn("Unable to get bandwidth use from store", logging.KeyUser, userID, logging.Err(err))
+		return s.usedMBs[userID] + s.pendingMBs[userID]
+	}
+	s.usedMBs[userID] = total
+	return total + s.pendingMBs[userID]
+}
+
+// Stops reconciling, adds pending bandwidth use and gives up the lease, so
+// other gateways stop counting sessions of this one right away.
+func (s *RedisStore) Close() error {
+	close(s.stopC)
+	<-s.doneC
+
+	ctx := context.Background()
+	s.flushBandwidth(ctx)
+	_, err := s.client.Do(ctx, "DEL", s.leaseKey(s.config.GatewayID))
+	return err
+}
+
+func (s *RedisStore) run() {
+	defer close(s.doneC)
+
+	ticker := time.NewTicker(s.config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reconcile()
+		case <-s.stopC:
+			return
+		}
+	}
+}
+
+// Renews the lease, sets the session counts of this gateway to the local
+// ones, removes counts of gateways whose lease expired and adds pending
+// bandwidth use.
+func (s *RedisStore) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ReconcileInterval)
+	defer cancel()
+
+	if _, err := s.client.Do(ctx, "SET", s.leaseKey(s.config.GatewayID), "1", "PX", s.leaseMillis()); err != nil {
+		s.logger.Warn("Unable to renew lease in store", logging.Err(err))
+		return
+	}
+
+	s.mu.Lock()
+	sessions := make(map[svc.UserID]int, len(s.sessions))
+	for userID, count := range s.sessions {
+		sessions[userID] = count
+		if count == 0 {
+			delete(s.sessions, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	for userID, count := range sessions {
+		if err := s.reconcileSessions(ctx, userID, count); err != nil {
+			s.logger.Warn("Unable to reconcile sessions", logging.KeyUser, userID, logging.Err(err))
+		}
+	}
+	s.flushBandwidth(ctx)
+}
+
+func (s *RedisStore) reconcileSessions(ctx context.Context, userID svc.UserID, count int) error {
+	key := s.sessionsKey(userID)
+	set := []string{"HDEL", key, s.config.GatewayID}
+	if count > 0 {
+		set = []string{"HSET", key, s.config.GatewayID, strconv.Itoa(count)}
+	}
+
+	replies, err := s.client.Pipeline(ctx,
+		[]string{"MULTI"},
+		set,
+		[]string{"PEXPIRE", key, s.leaseMillis()},
+		[]string{"HGETALL", key},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return err
+	}
+	counts, err := execCounts(replies)
+	if err != nil {
+		return err
+	}
+
+	dead, err := s.deadGateways(ctx, counts)
+	if err != nil || len(dead) == 0 {
+		return err
+	}
+	_, err = s.client.Do(ctx, append([]string{"HDEL", key}, dead...)...)
+	return err
+}
+
+func (s *RedisStore) flushBandwidth(ctx context.Context) {
+	s.mu.Lock()
+	pending := s.pendingMBs
+	s.pendingMBs = make(map[svc.UserID]float64)
+	s.mu.Unlock()
+
+	for userID, mbs := range pending {
+		total, err := redis.Float(s.client.Do(ctx, "INCRBYFLOAT", s.bandwidthKey(userID), formatFloat(mbs)))
+
+		s.mu.Lock()
+		if err != nil {
+			s.pendingMBs[userID] += mbs
+		} else {
+			s.usedMBs[userID] = total
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Sums the session counts of this gateway and of those with a lease.
+func (s *RedisStore) liveTotal(ctx context.Context, counts map[string]int64) (int64, error) {
+	dead, err := s.deadGateways(ctx, counts)
+	if err != nil {
+		return 0, err
+	}
+	for _, gatewayID := range dead {
+		delete(counts, gatewayID)
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += max(count, 0)
+	}
+	return total, nil
+}
+
+// Returns the gateways among counts, other than this one, without a lease.
+func (s *RedisStore) deadGateways(ctx context.Context, counts map[string]int64) ([]string, error) {
+	var gateways, keys []string
+	for gatewayID := range counts {
+		if gatewayID != s.config.GatewayID {
+			gateways = append(gateways, gatewayID)
+			keys = append(keys, s.leaseKey(gatewayID))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	leases, err := redis.Strings(s.client.Do(ctx, append([]string{"MGET"}, keys...)...))
+	if err != nil {
+		return nil, err
+	}
+
+	var dead []string
+	for i, lease := range leases {
+		if lease == "" {
+			dead = append(dead, gateways[i])
+		}
+	}
+	return dead, nil
+}
+
+// Returns the session counts by gateway from the HGETALL reply of a
+// MULTI ... EXEC pipeline, which comes second to last among the replies
+// of EXEC.
+func execCounts(replies []any) (map[string]int64, error) {
+	exec := replies[len(replies)-1]
+	if err, ok := exec.(redis.Error); ok {
+		return nil, err
+	}
+	results, ok := exec.([]any)
+	if !ok || len(results) == 0 {
+		return nil, redis.ErrorProtocol
+	}
+	for _, result := range results {
+		if err, ok := result.(redis.Error); ok {
+			return nil, err
+		}
+	}
+
+	fields, err := redis.Strings(results[len(results)-1], nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		count, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counts[fields[i]] = count
+	}
+	return counts, nil
+}
+
+func (s *RedisStore) leaseMillis() string {
+	return strconv.FormatInt(s.config.LeaseTTL.Milliseconds(), 10)
+}
+
+func (s *RedisStore) sessionsKey(userID svc.UserID) string {
+	return fmt.Sprintf("%ssessions:%d", s.config.Prefix, userID)
+}
+
+func (s *RedisStore) bandwidthKey(userID svc.UserID) string {
+	return fmt.Sprintf("%sbandwidth:%d", s.config.Prefix, userID)
+}
+
+func (s *RedisStore) leaseKey(gatewayID string) string {
+	return fmt.Sprintf("%sgateway:%s", s.config.Prefix, gatewayID)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
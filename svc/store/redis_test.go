@@ -0,0 +1,103 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bacv/kingip/lib/logging"
+	"github.com/bacv/kingip/lib/redis"
+	"github.com/bacv/kingip/lib/redis/redistest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRedisStore(t *testing.T, server *redistest.Server, gatewayID string) *RedisStore {
+	client := redis.NewClient(redis.Config{Addr: server.Addr(), Password: server.Password})
+	t.Cleanup(func() { client.Close() })
+
+	config := DefaultRedisConfig()
+	config.GatewayID = gatewayID
+	// Tests reconcile by hand.
+	config.ReconcileInterval = time.Hour
+	return NewRedisStore(config, client, logging.Discard())
+}
+
+func TestRedisStoreSessions(t *testing.T) {
+	server := redistest.NewServer(t)
+	server.Password = "secret"
+	a := newRedisStore(t, server, "a")
+	b := newRedisStore(t, server, "b")
+
+	assert.Equal(t, uint16(1), a.SessionAdd(1))
+	assert.Equal(t, uint16(2), b.SessionAdd(1))
+	assert.Equal(t, uint16(1), b.SessionAdd(2))
+	b.SessionRemove(1)
+	assert.Equal(t, uint16(2), a.SessionAdd(1))
+
+	// Sessions of a gateway that closed no longer count.
+	b.SessionAdd(1)
+	assert.NoError(t, b.Close())
+	assert.Equal(t, uint16(3), a.SessionAdd(1))
+}
+
+func TestRedisStoreLeaseExpiry(t *testing.T) {
+	server := redistest.NewServer(t)
+	a := newRedisStore(t, server, "a")
+	b := newRedisStore(t, server, "b")
+
+	b.SessionAdd(1)
+	b.SessionAdd(1)
+	assert.Equal(t, uint16(3), a.SessionAdd(1))
+
+	// Gateway b dies while a keeps renewing its lease.
+	server.FastForward(a.config.LeaseTTL * 2 / 3)
+	a.reconcile()
+	server.FastForward(a.config.LeaseTTL / 2)
+	assert.Equal(t, uint16(2), a.SessionAdd(1))
+
+	a.reconcile()
+	assert.Equal(t, map[string]string{"a": "2"}, server.Hash("kingip:sessions:1"))
+}
+
+func TestRedisStoreReconcile(t *testing.T) {
+	server := redistest.NewServer(t)
+	a := newRedisStore(t, server, "a")
+
+	a.SessionAdd(1)
+	a.SessionAdd(1)
+
+	// Counts that drifted are reset to those of the gateway.
+	server.SetDown(true)
+	a.SessionRemove(1)
+	server.SetDown(false)
+	assert.Equal(t, "2", server.Hash("kingip:sessions:1")["a"])
+
+	a.reconcile()
+	assert.Equal(t, "1", server.Hash("kingip:sessions:1")["a"])
+
+	a.SessionRemove(1)
+	a.reconcile()
+	assert.Nil(t, server.Hash("kingip:sessions:1"))
+}
+
+func TestRedisStoreBandwidth(t *testing.T) {
+	server := redistest.NewServer(t)
+	a := newRedisStore(t, server, "a")
+	b := newRedisStore(t, server, "b")
+
+	assert.Equal(t, 0.0, a.GetUserTotalUsedMBs(1))
+	a.UpdateUserTotalUsedMBs(1, 1.5)
+	b.UpdateUserTotalUsedMBs(1, 2)
+	assert.Equal(t, 3.5, a.GetUserTotalUsedMBs(1))
+
+	// Use while the server is unreachable is added once it is back.
+	server.SetDown(true)
+	a.UpdateUserTotalUsedMBs(1, 1)
+	assert.Equal(t, 4.5, a.GetUserTotalUsedMBs(1))
+	assert.Equal(t, uint16(1), a.SessionAdd(2))
+
+	server.SetDown(false)
+	a.reconcile()
+	value, _ := server.Get("kingip:bandwidth:1")
+	assert.Equal(t, "4.5", value)
+	assert.Equal(t, 4.5, b.GetUserTotalUsedMBs(1))
+}
@@ -2,15 +2,26 @@ package store
 
 import (
 	"errors"
+	"net"
 	"sync"
 
 	"github.com/bacv/kingip/svc"
 )
 
+var ErrorAmbiguousNetwork = errors.New("client network belongs to several users")
+
+// UserNetwork lets clients from a network use the proxy as the user,
+// without sending credentials.
+type UserNetwork struct {
+	Network *net.IPNet
+	User    *svc.User
+}
+
 // MockUserStore is a mock implementation of UserStore for testing purposes.
 type MockUserStore struct {
 	mu            sync.Mutex
 	Users         map[svc.UserAuth]*svc.User
+	Networks      []UserNetwork
 	SessionCounts map[svc.UserID]uint16
 	TotalUsedMBs  map[svc.UserID]float64
 }
@@ -33,6 +44,52 @@ func (store *MockUserStore) GetUser(auth svc.UserAuth) (*svc.User, error) {
 	return nil, errors.New("user not found")
 }
 
+// Adds a client network in CIDR notation, a single IP is taken as a /32 or
+// /128 network.
+func (store *MockUserStore) AddUserNetwork(cidr string, user *svc.User) error {
+	network, err := parseNetwork(cidr)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.Networks = append(store.Networks, UserNetwork{Network: network, User: user})
+	return nil
+}
+
+// The most specific network containing the IP wins, networks of the same
+// size that belong to different users don't match at all.
+func (store *MockUserStore) GetUserByIP(ip net.IP) (*svc.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var found *svc.User
+	bestSize := -1
+	for _, network := range store.Networks {
+		if !network.Network.Contains(ip) {
+			continue
+		}
+
+		size, _ := network.Network.Mask.Size()
+		switch {
+		case size > bestSize:
+			found, bestSize = network.User, size
+		case size == bestSize && found != network.User:
+			found = nil
+		}
+	}
+
+	if found == nil {
+		if bestSize >= 0 {
+			return nil, ErrorAmbiguousNetwork
+		}
+		return nil, errors.New("user not found")
+	}
+	return found, nil
+}
+
 func (store *MockUserStore) GetUserSessionCount(userID svc.UserID) uint16 {
 	store.mu.Lock()
 	defer store.mu.Unlock()
@@ -59,3 +116,16 @@ func (store *MockUserStore) GetUserTotalUsedMBs(userID svc.UserID) float64 {
 	}
 	return 0
 }
+
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
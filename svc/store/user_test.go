@@ -0,0 +1,42 @@
+package store
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bacv/kingip/svc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUserByIP(t *testing.T) {
+	office := svc.NewUser("office", 1, svc.DefaultUserConfig())
+	server := svc.NewUser("server", 2, svc.DefaultUserConfig())
+	other := svc.NewUser("other", 3, svc.DefaultUserConfig())
+
+	store := NewMockUserStore()
+	assert.NoError(t, store.AddUserNetwork("10.0.0.0/8", office))
+	assert.NoError(t, store.AddUserNetwork("10.1.2.3", server))
+	assert.NoError(t, store.AddUserNetwork("192.168.0.0/16", office))
+	assert.NoError(t, store.AddUserNetwork("192.168.0.0/16", other))
+	assert.NoError(t, store.AddUserNetwork("2001:db8::/32", other))
+	assert.Error(t, store.AddUserNetwork("10.0.0.0/33", office))
+
+	user, err := store.GetUserByIP(net.ParseIP("10.9.9.9"))
+	assert.NoError(t, err)
+	assert.Same(t, office, user)
+
+	// The most specific network wins.
+	user, err = store.GetUserByIP(net.ParseIP("10.1.2.3"))
+	assert.NoError(t, err)
+	assert.Same(t, server, user)
+
+	user, err = store.GetUserByIP(net.ParseIP("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.Same(t, other, user)
+
+	_, err = store.GetUserByIP(net.ParseIP("192.168.1.1"))
+	assert.ErrorIs(t, err, ErrorAmbiguousNetwork)
+
+	_, err = store.GetUserByIP(net.ParseIP("172.16.0.1"))
+	assert.Error(t, err)
+}
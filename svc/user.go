@@ -8,6 +8,7 @@ type UserConfig struct {
 	maxSessions        uint16
 	maxSessionDuration time.Duration
 	maxGBs             float64
+	policy             UserPolicy
 }
 
 func NewUserConfig(sessions uint16, gbs float64, duration time.Duration) UserConfig {
@@ -18,6 +19,12 @@ func NewUserConfig(sessions uint16, gbs float64, duration time.Duration) UserCon
 	}
 }
 
+// Returns a copy of the config with the given destination policy.
+func (c UserConfig) WithPolicy(policy UserPolicy) UserConfig {
+	c.policy = policy
+	return c
+}
+
 func DefaultUserConfig() UserConfig {
 	return NewUserConfig(10, 1, time.Hour)
 }
@@ -56,6 +63,10 @@ func (u *User) MaxSessionDuration() time.Duration {
 	return u.config.maxSessionDuration
 }
 
+func (u *User) Policy() UserPolicy {
+	return u.config.policy
+}
+
 type UserAuth struct {
 	Name     string
 	Password string